@@ -0,0 +1,131 @@
+package main
+
+// author index, books with several authors are listed under each of them
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// separators between author names, e.g. [Bob, Alice] [作者A×作者B]
+var regexAuthorSeparator = regexp.MustCompile(`\s*(?:,|，|、|&|＆|×|/|／)\s*`)
+
+// splitAuthors gives each author name, width and spacing normalised, blank names are left out
+func splitAuthors(author string) []string {
+	names := []string{}
+	for _, name := range regexAuthorSeparator.Split(author, -1) {
+		name = strings.TrimSpace(regexSpaces.ReplaceAllString(normaliseWidth(name), " "))
+		if name == "" || StringSliceContain(names, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// authorKey gives key for finding author by name, case and width are ignored
+func authorKey(name string) string {
+	return normaliseName(name)
+}
+
+// copyAuthor gives copy of the author with copies of the books, books known to be missing are left out.
+// nil when the author has no book left
+func copyAuthor(author *Author) *Author {
+	if author == nil {
+		return nil
+	}
+	books := []*Book{}
+	for _, book := range author.Books {
+		if book.Cond == 2 {
+			continue
+		}
+		books = append(books, copyBook(book))
+	}
+	if len(books) == 0 {
+		return nil
+	}
+	return &Author{
+		Name:  author.Name,
+		Books: books,
+	}
+}
+
+// copyAuthors gives copies of the authors that still have books
+func copyAuthors(authors []*Author) []*Author {
+	list := []*Author{}
+	for _, author := range authors {
+		if author = copyAuthor(author); author != nil {
+			list = append(list, author)
+		}
+	}
+	return list
+}
+
+// sortAuthors orders authors by name
+func sortAuthors(authors []*Author) []*Author {
+	keys := naturalKeys{}
+	sort.Slice(authors, func(i, j int) bool {
+		return keys.less(authors[i].Name, authors[j].Name)
+	})
+	return authors
+}
+
+// buildAuthors groups books by each author, ordered by name
+func buildAuthors(books []*Book) []*Author {
+	byKey := map[string]*Author{}
+	authors := []*Author{}
+
+	for _, book := range books {
+		for _, name := range splitAuthors(book.Author) {
+			key := authorKey(name)
+			author := byKey[key]
+			if author == nil {
+				author = &Author{Name: name}
+				byKey[key] = author
+				authors = append(authors, author)
+			}
+			author.Books = append(author.Books, book)
+		}
+	}
+
+	return sortAuthors(authors)
+}
+
+// Authors gives all authors ordered by name, with copies of their books
+func (db *FlatDB) Authors() []*Author {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return sortAuthors(copyAuthors(db.authors))
+}
+
+// GetAuthor get author by name, case and width are ignored. nil if not found
+func (db *FlatDB) GetAuthor(name string) *Author {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return copyAuthor(db.mapperAuthor[authorKey(name)])
+}
+
+// Authors gives all authors ordered by name, with copies of their books
+func (db *LogDB) Authors() []*Author {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return copyAuthors(buildAuthors(db.books))
+}
+
+// GetAuthor get author by name, case and width are ignored. nil if not found
+func (db *LogDB) GetAuthor(name string) *Author {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	key := authorKey(name)
+	for _, author := range buildAuthors(db.books) {
+		if authorKey(author.Name) == key {
+			return copyAuthor(author)
+		}
+	}
+	return nil
+}
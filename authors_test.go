@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitAuthors(t *testing.T) {
+	cases := []struct {
+		author string
+		names  []string
+	}{
+		{"Oda", []string{"Oda"}},
+		{"Bob, Alice", []string{"Bob", "Alice"}},
+		{"作者A、作者B", []string{"作者A", "作者B"}},
+		{"作者A×作者B", []string{"作者A", "作者B"}},
+		{"作者A／作者B", []string{"作者A", "作者B"}},
+		{"Bob & Alice", []string{"Bob", "Alice"}},
+		{"Bob＆Alice，Carol", []string{"Bob", "Alice", "Carol"}},
+		{"Ｂｏｂ　Ｓｍｉｔｈ", []string{"Bob Smith"}},
+		{"Bob,, Bob", []string{"Bob"}},
+		{"", []string{}},
+	}
+
+	for _, c := range cases {
+		names := splitAuthors(c.author)
+		if strings.Join(names, "|") != strings.Join(c.names, "|") {
+			t.Errorf("%q: %q, want %q", c.author, names, c.names)
+		}
+	}
+}
+
+func TestBuildAuthors(t *testing.T) {
+	books := []*Book{
+		{ID: "a", Author: "Oda", Cond: 1},
+		{ID: "b", Author: "ODA × Kishimoto", Cond: 1},
+		{ID: "c", Author: "Ｏｄａ", Cond: 1},
+		{ID: "d", Author: "Gone", Cond: 2},
+		{ID: "e", Author: "Kishimoto, Gone", Cond: 2},
+	}
+
+	authors := copyAuthors(buildAuthors(books))
+	got := map[string]string{}
+	for _, author := range authors {
+		ids := ""
+		for _, book := range author.Books {
+			ids += book.ID
+		}
+		got[author.Name] = ids
+	}
+	// first seen spelling is kept, missing books are left out
+	want := map[string]string{"Oda": "abc", "Kishimoto": "b"}
+	if len(got) != len(want) {
+		t.Errorf("authors %v, want %v", got, want)
+	}
+	for name, ids := range want {
+		if got[name] != ids {
+			t.Errorf("%s: books %q, want %q", name, got[name], ids)
+		}
+	}
+}
+
+func TestGetAuthor(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			for _, name := range []string{"[Oda] One Piece 01.cbz", "[ODA×Kishimoto] Crossover 01.cbz", "[Gone] Lost 01.cbz"} {
+				fpath := filepath.Join(dir, name)
+				writeTestBook(t, fpath, 3)
+				_, err := db.AddFile(fpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range []string{"Oda", "oda", "ＯＤＡ"} {
+				author := db.GetAuthor(name)
+				if author == nil {
+					t.Errorf("%q not found", name)
+					continue
+				}
+				if author.Name != "Oda" || len(author.Books) != 2 {
+					t.Errorf("%q gives %s with %d books", name, author.Name, len(author.Books))
+				}
+			}
+
+			// author with only missing books is gone
+			gone := db.GetBookByPath(filepath.Join(dir, "[Gone] Lost 01.cbz"))
+			gone.Cond = 2
+			err := db.UpdateFileState([]*Book{gone})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if author := db.GetAuthor("Gone"); author != nil {
+				t.Errorf("author of missing book %+v", author)
+			}
+			for _, author := range db.Authors() {
+				if author.Name == "Gone" {
+					t.Error("author of missing book listed")
+				}
+			}
+			if len(db.Authors()) != 2 {
+				t.Errorf("%d authors, want 2", len(db.Authors()))
+			}
+		})
+	}
+}
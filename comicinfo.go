@@ -0,0 +1,322 @@
+package main
+
+// ComicInfo.xml inside the cbz, the ComicRack schema
+//
+// e.g.
+//   <ComicInfo>
+//     <Series>Some Title</Series>
+//     <Number>1</Number>
+//     <Writer>Bob</Writer>
+//     <Manga>YesAndRightToLeft</Manga>
+//     <PageCount>180</PageCount>
+//     <Pages>
+//       <Page Image="0" Type="FrontCover" />
+//     </Pages>
+//   </ComicInfo>
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ComicInfoName is file name of the metadata in cbz
+const ComicInfoName = "ComicInfo.xml"
+
+// comicInfoMaxSize is the most read from ComicInfo.xml, it should only be a few KB
+const comicInfoMaxSize = 1 << 20
+
+// ComicInfo is metadata from the book file, takes precedence over the guess from file name. blank is not set
+type ComicInfo struct {
+	Title   string `json:"title,omitempty"`   // title of the book, often the chapter title
+	Series  string `json:"series,omitempty"`  // series name
+	Number  string `json:"number,omitempty"`  // number in the series, or volume when number is not given
+	Author  string `json:"author,omitempty"`  // writers then pencillers, seperated by comma
+	Summary string `json:"summary,omitempty"` // on one line
+	Genre   string `json:"genre,omitempty"`   // seperated by comma
+	Manga   string `json:"manga,omitempty"`   // Yes, No, YesAndRightToLeft
+
+	PageCount int64 `json:"page_count,omitempty"` // pages the file says it has
+	Cover     int64 `json:"cover,omitempty"`      // page of the front cover counted from 1, first page when not set
+}
+
+// comicInfoXML is the xml layout, fields not in use are kept in Other so they survive a rewrite
+type comicInfoXML struct {
+	XMLName   xml.Name         `xml:"ComicInfo"`
+	XSI       string           `xml:"xmlns:xsi,attr,omitempty"`
+	XSD       string           `xml:"xmlns:xsd,attr,omitempty"`
+	Title     string           `xml:"Title,omitempty"`
+	Series    string           `xml:"Series,omitempty"`
+	Number    string           `xml:"Number,omitempty"`
+	Volume    string           `xml:"Volume,omitempty"`
+	Summary   string           `xml:"Summary,omitempty"`
+	Writer    string           `xml:"Writer,omitempty"`
+	Penciller string           `xml:"Penciller,omitempty"`
+	Genre     string           `xml:"Genre,omitempty"`
+	Manga     string           `xml:"Manga,omitempty"`
+	PageCount string           `xml:"PageCount,omitempty"`
+	Pages     []comicInfoPage  `xml:"Pages>Page"`
+	Other     []comicInfoOther `xml:",any"`
+}
+
+// comicInfoPage is page of the book, Image counts from 0. attributes not in use are kept in Attrs
+type comicInfoPage struct {
+	Image string     `xml:"Image,attr,omitempty"`
+	Type  string     `xml:"Type,attr,omitempty"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+// comicInfoOther is element not in use, e.g. AgeRating, Web
+type comicInfoOther struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// RightToLeft tells if pages are read from right to left, e.g. japanese manga
+func (c ComicInfo) RightToLeft() bool {
+	return c.Manga == "YesAndRightToLeft"
+}
+
+// Genres gives each genre
+func (c ComicInfo) Genres() []string {
+	genres := []string{}
+	for _, genre := range strings.Split(c.Genre, ",") {
+		genre = strings.TrimSpace(genre)
+		if genre != "" {
+			genres = append(genres, genre)
+		}
+	}
+	return genres
+}
+
+// parseComicInfo reads ComicInfo.xml content
+func parseComicInfo(dat []byte) (ComicInfo, error) {
+	// xml decoder does not skip utf-8 byte order mark
+	dat = bytes.TrimPrefix(dat, []byte("\xef\xbb\xbf"))
+
+	x := comicInfoXML{}
+	err := xml.Unmarshal(dat, &x)
+	if err != nil {
+		return ComicInfo{}, err
+	}
+
+	oneLine := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+
+	number := oneLine(x.Number)
+	if number == "" && oneLine(x.Volume) != "" {
+		number = "Vol." + oneLine(x.Volume)
+	}
+
+	// writers first, same person can be both
+	authors := splitAuthors(x.Writer)
+	for _, name := range splitAuthors(x.Penciller) {
+		if !StringSliceContain(authors, name) {
+			authors = append(authors, name)
+		}
+	}
+
+	// unreadable number is taken as not given
+	pageCount, _ := strconv.ParseInt(strings.TrimSpace(x.PageCount), 10, 64)
+	if pageCount < 0 {
+		pageCount = 0
+	}
+	cover := int64(0)
+	for _, page := range x.Pages {
+		if !strings.EqualFold(strings.TrimSpace(page.Type), "FrontCover") {
+			continue
+		}
+		image, err := strconv.ParseInt(strings.TrimSpace(page.Image), 10, 64)
+		if err == nil && image >= 0 {
+			cover = image + 1
+			break
+		}
+	}
+
+	return ComicInfo{
+		Title:     oneLine(x.Title),
+		Series:    oneLine(x.Series),
+		Number:    number,
+		Author:    strings.Join(authors, ", "),
+		Summary:   oneLine(x.Summary),
+		Genre:     strings.Join(ComicInfo{Genre: x.Genre}.Genres(), ", "),
+		Manga:     oneLine(x.Manga),
+		PageCount: pageCount,
+		Cover:     cover,
+	}, nil
+}
+
+// zipComicInfoFile gives ComicInfo.xml entry of the opened cbz, nil if there is none
+func zipComicInfoFile(zr *zip.Reader) *zip.File {
+	var found *zip.File
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Base(f.Name), ComicInfoName) {
+			continue
+		}
+		found = f
+		// the one in top level is the one for the book
+		if !strings.Contains(f.Name, "/") {
+			break
+		}
+	}
+	return found
+}
+
+// readZipFile gives content of the zip entry, up to max bytes
+func readZipFile(f *zip.File, max int64) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(io.LimitReader(r, max))
+}
+
+// zipComicInfo reads ComicInfo.xml from the opened cbz, blank if there is none or it is unreadable
+func zipComicInfo(zr *zip.Reader) ComicInfo {
+	found := zipComicInfoFile(zr)
+	if found == nil {
+		return ComicInfo{}
+	}
+
+	dat, err := readZipFile(found, comicInfoMaxSize)
+	if err != nil {
+		return ComicInfo{}
+	}
+	info, err := parseComicInfo(dat)
+	if err != nil {
+		return ComicInfo{}
+	}
+
+	return info
+}
+
+// writeComicInfo rewrites the cbz with ComicInfo.xml updated from the book metadata, other entries are copied as is.
+// new file is written next to the book file then renamed over it, so the book is never half written
+func writeComicInfo(fpath string, book *Book) error {
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	// keep what is already there, unreadable one is replaced
+	x := comicInfoXML{}
+	old := zipComicInfoFile(&zr.Reader)
+	if old != nil {
+		dat, err := readZipFile(old, comicInfoMaxSize)
+		if err == nil {
+			err = xml.Unmarshal(bytes.TrimPrefix(dat, []byte("\xef\xbb\xbf")), &x)
+		}
+		if err != nil {
+			x = comicInfoXML{}
+		}
+	}
+	x.XSI = "http://www.w3.org/2001/XMLSchema-instance"
+	x.XSD = "http://www.w3.org/2001/XMLSchema"
+	x.Series = book.Series
+	x.Number = book.Number
+	if book.Meta.Title != "" && book.Meta.Title != book.Series {
+		x.Title = book.Meta.Title
+	}
+	// author edited, penciller cannot be told apart anymore
+	if book.Author != book.Info.Author {
+		x.Writer = strings.Join(splitAuthors(book.Author), ", ")
+		x.Penciller = ""
+	}
+	dat, err := xml.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return err
+	}
+	dat = append([]byte(xml.Header), dat...)
+
+	fstat, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	// dot file is skipped by scan
+	tmpPath := filepath.Join(filepath.Dir(fpath), "."+filepath.Base(fpath)+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fstat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// removes the new file if anything fails, does nothing after rename
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	// writes the new ComicInfo.xml, once
+	written := false
+	writeInfo := func() error {
+		if written {
+			return nil
+		}
+		written = true
+
+		fh := &zip.FileHeader{
+			Name:   ComicInfoName,
+			Method: zip.Deflate,
+		}
+		fh.Modified = time.Now()
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dat)
+		return err
+	}
+
+	for _, zf := range zr.File {
+		// top level one is replaced in place, any other entry is copied as stored without decompressing
+		if strings.EqualFold(zf.Name, ComicInfoName) {
+			err = writeInfo()
+		} else {
+			err = zw.Copy(zf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// book had none at top level
+	err = writeInfo()
+	if err != nil {
+		return err
+	}
+
+	err = zw.SetComment(zr.Comment)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, fpath)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(fpath))
+
+	return nil
+}
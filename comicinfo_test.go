@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseComicInfo(t *testing.T) {
+	dat := []byte("\xef\xbb\xbf" + `<?xml version="1.0"?>
+<ComicInfo xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <Series>One Piece</Series>
+  <Volume>3</Volume>
+  <Summary>Luffy says
+    "hi"</Summary>
+  <Writer>Oda, Someone</Writer>
+  <Penciller>Oda</Penciller>
+  <Genre>Action, , Comedy</Genre>
+  <Manga>YesAndRightToLeft</Manga>
+  <PageCount> 180 </PageCount>
+  <Pages>
+    <Page Image="0" Type="InnerCover" ImageSize="1024" />
+    <Page Image="2" Type="FrontCover" DoublePage="true" />
+    <Page Image="5" Type="FrontCover" />
+  </Pages>
+</ComicInfo>`)
+
+	info, err := parseComicInfo(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ComicInfo{
+		Series:    "One Piece",
+		Number:    "Vol.3",
+		Author:    "Oda, Someone",
+		Summary:   `Luffy says "hi"`,
+		Genre:     "Action, Comedy",
+		Manga:     "YesAndRightToLeft",
+		PageCount: 180,
+		Cover:     3,
+	}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if !info.RightToLeft() {
+		t.Error("not right to left")
+	}
+
+	// no pages, bad page count
+	info, err = parseComicInfo([]byte(`<ComicInfo><PageCount>many</PageCount><Pages><Page Image="x" Type="FrontCover"/></Pages></ComicInfo>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PageCount != 0 || info.Cover != 0 {
+		t.Errorf("page count %d, cover %d", info.PageCount, info.Cover)
+	}
+}
+
+func TestComicInfoStored(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			fpath := filepath.Join(dir, "book.cbz")
+			writeTestBookInfo(t, fpath, 4, `<ComicInfo><Series>Naruto</Series><Writer>Kishimoto</Writer><PageCount>4</PageCount>`+
+				`<Pages><Page Image="1" Type="FrontCover"/></Pages></ComicInfo>`)
+			book, err := db.AddFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db = reopenTestLibrary(t, db)
+			got := db.GetBookByID(book.ID)
+			if got.Title != "Naruto" || got.Author != "Kishimoto" || got.Info.PageCount != 4 || got.Info.Cover != 2 {
+				t.Errorf("reloaded %+v", got)
+			}
+		})
+	}
+}
+
+func TestWriteComicInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamishibai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// stored and deflated images, old ComicInfo.xml in the middle, nested one is left alone
+	fpath := filepath.Join(dir, "book.cbz")
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	entries := []struct {
+		name   string
+		method uint16
+		body   string
+	}{
+		{"001.jpg", zip.Store, "page 1"},
+		{ComicInfoName, zip.Deflate, `<ComicInfo><Series>Old</Series><AgeRating>Teen</AgeRating><PageCount>2</PageCount>` +
+			`<Pages><Page Image="1" Type="FrontCover" ImageSize="6"/></Pages></ComicInfo>`},
+		{"extra/" + ComicInfoName, zip.Deflate, `<ComicInfo><Series>Nested</Series></ComicInfo>`},
+		{"002.jpg", zip.Deflate, "page 2"},
+	}
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, e.body)
+	}
+	zw.SetComment("comment")
+	zw.Close()
+	f.Close()
+
+	_, hash, _, err := cbzRead(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book := &Book{Fullpath: fpath}
+	book.setMetadata("New", "Author", "1")
+	err = writeComicInfo(fpath, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	if len(zr.File) != len(entries) || zr.Comment != "comment" {
+		t.Fatalf("%d entries, comment %q", len(zr.File), zr.Comment)
+	}
+	for i, zf := range zr.File {
+		if zf.Name != entries[i].name || zf.Method != entries[i].method {
+			t.Errorf("entry %d is %s method %d, want %s method %d", i, zf.Name, zf.Method, entries[i].name, entries[i].method)
+		}
+	}
+
+	dat, err := readZipFile(zr.File[1], comicInfoMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseComicInfo(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Series != "New" || info.Author != "Author" || info.PageCount != 2 || info.Cover != 2 {
+		t.Errorf("written %+v", info)
+	}
+	for _, s := range []string{"<AgeRating>Teen</AgeRating>", `ImageSize="6"`} {
+		if !strings.Contains(string(dat), s) {
+			t.Errorf("%s is lost", s)
+		}
+	}
+	dat, err = readZipFile(zr.File[2], comicInfoMaxSize)
+	if err != nil || !strings.Contains(string(dat), "Nested") {
+		t.Errorf("nested ComicInfo changed %q %v", dat, err)
+	}
+
+	_, hash2, _, err := cbzRead(fpath)
+	if err != nil || hash2 != hash {
+		t.Errorf("fingerprint %s, want %s %v", hash2, hash, err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+// command line sub commands, run instead of the server
+//
+// usage
+//   shin-kamishibai [-conf-dir config.json] db fsck [-fix]
+//   shin-kamishibai [-conf-dir config.json] db compact
+//   shin-kamishibai [-conf-dir config.json] db duplicates
+//   shin-kamishibai [-conf-dir config.json] db rekey
+//   shin-kamishibai [-conf-dir config.json] progress export file
+//   shin-kamishibai [-conf-dir config.json] progress restore file
+//   shin-kamishibai [-conf-dir config.json] migrate [-rewrite old=new]... [-write] db.json
+//   shin-kamishibai [-conf-dir config.json] parse-test [-r] dir
+//   shin-kamishibai [-conf-dir config.json] reparse
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrUnknownCommand unsupported sub command
+var ErrUnknownCommand = errors.New("unknown command")
+
+// runCommand runs the sub command given in args
+func runCommand(cfg *Config, args []string) error {
+	switch args[0] {
+	case "db":
+		return runCommandDB(cfg, args[1:])
+	case "progress":
+		return runCommandProgress(cfg, args[1:])
+	case "migrate":
+		return runCommandMigrate(cfg, args[1:])
+	case "parse-test":
+		return runCommandParseTest(args[1:])
+	case "reparse":
+		return runCommandReparse(cfg)
+	}
+
+	return fmt.Errorf("%w %q", ErrUnknownCommand, args[0])
+}
+
+// runCommandDB runs db maintenance command
+func runCommandDB(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w, db needs one of: fsck, compact, duplicates, rekey", ErrUnknownCommand)
+	}
+
+	switch args[0] {
+	case "fsck":
+		fs := flag.NewFlagSet("db fsck", flag.ExitOnError)
+		fix := fs.Bool("fix", false, "rewrite db file in canonical form, dropping bad and duplicate records")
+		fs.Parse(args[1:])
+
+		report, err := FsckFlatDB(cfg, *fix, os.Stdout)
+		if err != nil {
+			return err
+		}
+		if !*fix && report.Problems() > 0 {
+			fmt.Println("run with --fix to rewrite db file")
+		}
+		return nil
+
+	case "compact":
+		db := &FlatDB{}
+		db.New(cfg.PathDB)
+		err := db.Import(cfg.PathDB)
+		if err != nil {
+			return err
+		}
+
+		report, err := db.Compact(cfg.PurgeGrace())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d records, %d missing, %d purged to %s\n", report.Checked, report.Missing, report.Purged, archivePath(cfg.PathDB))
+		return nil
+
+	case "duplicates":
+		db := &FlatDB{}
+		db.New(cfg.PathDB)
+		err := db.Import(cfg.PathDB)
+		if err != nil {
+			return err
+		}
+		_, err = db.FillHashes(cfg.ScanWorkers)
+		if err != nil {
+			return err
+		}
+
+		groups := db.Duplicates()
+		for _, group := range groups {
+			fmt.Printf("%s %s\n", group.By, group.Key)
+			for _, book := range group.Books {
+				fmt.Printf("  %s %10d bytes %4d pages  %s\n", book.ID, book.Size, book.Pages, book.Fullpath)
+			}
+		}
+		fmt.Printf("%d duplicate groups\n", len(groups))
+		return nil
+
+	case "rekey":
+		db := &FlatDB{}
+		db.New(cfg.PathDB)
+		db.IDLength = cfg.IDLength
+		err := db.Import(cfg.PathDB)
+		if err != nil {
+			return err
+		}
+
+		n, err := db.Rekey(cfg.PathCache)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d books given %d character id, old id kept in %s\n", n, cfg.IDLength, aliasPath(cfg.PathDB))
+		return nil
+	}
+
+	return fmt.Errorf("%w %q", ErrUnknownCommand, "db "+args[0])
+}
+
+// runCommandProgress runs reading progress backup command, works on either backend
+func runCommandProgress(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w, progress needs one of: export, restore", ErrUnknownCommand)
+	}
+
+	db, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	err = db.Load()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "export":
+		if len(args) < 2 {
+			return errors.New("progress export needs the backup file")
+		}
+
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		err = writeProgress(db, f)
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Println("progress exported to", args[1])
+		return nil
+
+	case "restore":
+		if len(args) < 2 {
+			return errors.New("progress restore needs the backup file")
+		}
+
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		backup, err := readProgress(f)
+		if err != nil {
+			return err
+		}
+		report, err := restoreProgress(db, backup)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d records, %d matched, %d books updated, %d without book\n", report.Records, report.Matched, report.Updated, report.Unmatched)
+		return nil
+	}
+
+	return fmt.Errorf("%w %q", ErrUnknownCommand, "progress "+args[0])
+}
+
+// runCommandMigrate adds books from the original kamishibai db.json to flat db, dry run unless -write is given
+func runCommandMigrate(cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	rewrites := PathRewrites{}
+	fs.Var(&rewrites, "rewrite", "rewrite book path prefix, old=new, can be given more than once")
+	write := fs.Bool("write", false, "add the books to db file, otherwise only report what would be done")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("migrate needs the legacy db.json")
+	}
+
+	db := &FlatDB{}
+	db.New(cfg.PathDB)
+	db.IDLength = cfg.IDLength
+	err := db.Import(cfg.PathDB)
+	if err != nil {
+		return err
+	}
+
+	report, err := db.Migrate(fs.Arg(0), rewrites, *write)
+	if err != nil {
+		return err
+	}
+	printMigrateReport(os.Stdout, report)
+	if !*write {
+		fmt.Println("dry run, run with -write to add the books to", cfg.PathDB)
+	}
+	return nil
+}
+
+// runCommandParseTest shows title, author and number each book file in dir is guessed to have, with name_rules from config
+func runCommandParseTest(args []string) error {
+	fs := flag.NewFlagSet("parse-test", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "include sub dirs")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("parse-test needs the dir")
+	}
+
+	fpaths, err := listFiles(fs.Arg(0), *recursive)
+	if err != nil {
+		return err
+	}
+	for _, fpath := range fpaths {
+		if checkBookFileType(fpath) != nil {
+			continue
+		}
+		fname := filepath.Base(fpath)
+		fmt.Println(fname)
+		fmt.Printf("  title:  %s\n", getTitle(fname))
+		fmt.Printf("  author: %s\n", getAuthor(fname))
+		fmt.Printf("  number: %s\n", getNumber(fname))
+	}
+	return nil
+}
+
+// runCommandReparse guess title, author and number of books in db again, after name_rules changed
+func runCommandReparse(cfg *Config) error {
+	db, err := openLibrary(cfg)
+	if err != nil {
+		return err
+	}
+	err = db.Load()
+	if err != nil {
+		return err
+	}
+
+	n, err := db.Reparse()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d books, %d changed\n", db.Count(), n)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 // Config holds server config
@@ -18,6 +19,8 @@ type Config struct {
 	PathDir      string   `json:"-"`                  // runtime value; config dir path
 	PathCache    string   `json:"-"`                  // runtime value; book cover cache dir path
 	PathDB       string   `json:"-"`                  // runtime value; db file path
+	PathDBLog    string   `json:"-"`                  // runtime value; binary log db file path
+	PathReadLog  string   `json:"-"`                  // runtime value; reading event log file path
 	Username     string   `json:"username"`           // username for the http authentication
 	Password     string   `json:"password,omitempty"` // one time, and it will be cleared after computed
 	Iterations   int      `json:"iterations"`         // safety, min 100,000
@@ -26,11 +29,28 @@ type Config struct {
 	AllowedDirs  []string `json:"allowed_dirs"`       // directory allowed to be browse
 	ImageResize  bool     `json:"image_resize"`       // resize images in reader
 	ImageQuality int      `json:"image_quality"`      // image quality for resized image
+	PurgeDays    int      `json:"purge_days"`         // days a missing book is kept in db before compaction purge it
+	IDLength     int      `json:"id_length"`          // length of new book id
+	Backend      string   `json:"backend"`            // book storage, flat or log
+	RescanMins   int      `json:"rescan_minutes"`     // minutes between rescan of allowed dirs, negative to disable
+	ScanWorkers  int      `json:"scan_workers"`       // number of book files read at the same time during scan
+
+	// rules guessing title, author and number from file name, built-in rules if not given
+	NameRules *NameRules `json:"name_rules,omitempty"`
 }
 
 // ConfigHashIterations how many times the password should be hashed
 const ConfigHashIterations = 100000
 
+// ConfigPurgeDays default days a missing book is kept in db
+const ConfigPurgeDays = 30
+
+// ConfigRescanMins default minutes between rescan of allowed dirs
+const ConfigRescanMins = 60
+
+// ConfigScanWorkers default number of book files read at the same time during scan
+const ConfigScanWorkers = 4
+
 // Read read and parse configuration file
 func (cfg *Config) Read(fpath string) error {
 	byteDat, err := ioutil.ReadFile(fpath)
@@ -59,7 +79,32 @@ func (cfg *Config) Read(fpath string) error {
 	cfg.PathDir = filepath.Dir(fpath)
 	cfg.PathCache = filepath.Join(cfg.PathDir, "cache")
 	cfg.PathDB = filepath.Join(cfg.PathDir, "/db.txt")
+	cfg.PathDBLog = filepath.Join(cfg.PathDir, "/db.binlog")
+	cfg.PathReadLog = filepath.Join(cfg.PathDir, "/reads.log")
 	cfg.Iterations = ConfigHashIterations
+	if cfg.PurgeDays <= 0 {
+		cfg.PurgeDays = ConfigPurgeDays
+	}
+	if cfg.RescanMins == 0 {
+		cfg.RescanMins = ConfigRescanMins
+	}
+	if cfg.ScanWorkers <= 0 {
+		cfg.ScanWorkers = ConfigScanWorkers
+	}
+	if cfg.IDLength < FlatDBIDLengthMin {
+		cfg.IDLength = FlatDBIDLength
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = LibraryBackendFlat
+	}
+	if cfg.Backend != LibraryBackendFlat && cfg.Backend != LibraryBackendLog {
+		return errors.New("unknown backend " + cfg.Backend + ", use flat or log")
+	}
+	// bad rule is found now rather than at first book
+	err = setNameRules(cfg.NameRules)
+	if err != nil {
+		return err
+	}
 
 	// hash password
 	if cfg.Crypt == "" {
@@ -86,6 +131,19 @@ func (cfg *Config) Read(fpath string) error {
 	return nil
 }
 
+// PurgeGrace gives how long a missing book is kept in db
+func (cfg *Config) PurgeGrace() time.Duration {
+	return time.Duration(cfg.PurgeDays) * 24 * time.Hour
+}
+
+// RescanInterval gives time between rescan of allowed dirs, 0 is disabled
+func (cfg *Config) RescanInterval() time.Duration {
+	if cfg.RescanMins < 0 {
+		return 0
+	}
+	return time.Duration(cfg.RescanMins) * time.Minute
+}
+
 // Save save config to json file
 func (cfg *Config) Save(fpath string) error {
 	// create a copy
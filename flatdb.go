@@ -4,23 +4,26 @@ package main
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unicode/utf8"
 )
 
 // FlatDBCharsPage is number of characters reserved for the pages/page
@@ -32,6 +35,15 @@ const FlatDBCharsFSize = "%010d"
 // FlatDBCharsEpoch is number of character reserved for the epoch time
 const FlatDBCharsEpoch = "%010d"
 
+// FlatDBCharsInode is number of character reserved for the inode, enough for any int64 with sign
+const FlatDBCharsInode = "%020d"
+
+// FlatDBIDLength is default length of new book id, 62^10 possibilities
+const FlatDBIDLength = 10
+
+// FlatDBIDLengthMin is shortest book id allowed, the original length
+const FlatDBIDLengthMin = 3
+
 // RegexSupportedImageExt supported image extension
 var RegexSupportedImageExt = regexp.MustCompile(`(?i)\.(jpg|jpeg|gif|png)$`)
 
@@ -45,25 +57,96 @@ var (
 	ErrNilIBook        = errors.New("ibook is nil")
 	ErrDBColumnChanged = errors.New("db column has changed")
 	ErrCSVIncomplete   = errors.New("incomplete csv line")
+	ErrCSVColumn       = errors.New("invalid csv column")
+	ErrRankingRange    = errors.New("ranking must be 0 to 5")
 )
 
 // Book contains all the information of book
 type Book struct {
-	ID       string `json:"id,omitempty"`   // unique id for indexing
-	Title    string `json:"title"`          // book title
-	Author   string `json:"author"`         // book author, seperated by comma
-	Number   string `json:"number"`         // volume, chapter, etc
-	Fullpath string `json:"-"`              // book file path
-	Ranking  int64  `json:"ranking"`        // 1-5 ranking, least to most liked
-	Fav      int64  `json:"fav"`            // favourite, 0 false, 1 true
-	Cond     int64  `json:"cond,omitempty"` // 0 unknown, 1 exists, 2 not exist, 3 deleted, 4 inaccessible
-	Pages    int64  `json:"pages"`          // total pages
-	Page     int64  `json:"page"`           // read upto
-	Size     int64  `json:"size"`           // fs file size
-	Inode    int64  `json:"-"`              // fs inode
-	Mtime    int64  `json:"mtime"`          // fs modified time
-	Itime    int64  `json:"itime"`          // import time
-	Rtime    int64  `json:"rtime"`          // read time
+	ID       string    `json:"id,omitempty"`   // unique id for indexing
+	Title    string    `json:"title"`          // book title
+	Author   string    `json:"author"`         // book author, seperated by comma
+	Number   string    `json:"number"`         // volume, chapter, etc
+	Fullpath string    `json:"-"`              // book file path
+	Ranking  int64     `json:"ranking"`        // 1-5 ranking, least to most liked
+	Fav      int64     `json:"fav"`            // favourite, 0 false, 1 true
+	Cond     int64     `json:"cond,omitempty"` // 0 unknown, 1 exists, 2 not exist, 3 deleted, 4 inaccessible
+	Pages    int64     `json:"pages"`          // total pages
+	Page     int64     `json:"page"`           // read upto
+	Size     int64     `json:"size"`           // fs file size
+	Inode    int64     `json:"-"`              // fs inode
+	Dev      int64     `json:"-"`              // fs device of the inode
+	Mtime    int64     `json:"mtime"`          // fs modified time
+	Itime    int64     `json:"itime"`          // import time
+	Rtime    int64     `json:"rtime"`          // read time
+	Gtime    int64     `json:"gtime"`          // time book file was first found missing
+	Hash     string    `json:"hash"`           // content fingerprint, to find same book
+	Series   string    `json:"series"`         // series the book belongs to, title if not set
+	Meta     BookMeta  `json:"meta"`           // user edited metadata
+	Info     ComicInfo `json:"info"`           // metadata from ComicInfo.xml in book file
+}
+
+// BookMeta is user edited metadata, takes precedence over the guess from file name. blank is not set
+type BookMeta struct {
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+	Number string `json:"number,omitempty"`
+	Series string `json:"series,omitempty"`
+}
+
+// copyBook gives copy of the book, so it can be changed or kept without touching the db record
+func copyBook(b *Book) *Book {
+	if b == nil {
+		return nil
+	}
+	c := *b
+	return &c
+}
+
+// clean gives metadata with each field on one line and without extra spaces
+func (m BookMeta) clean() BookMeta {
+	oneLine := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return BookMeta{
+		Title:  oneLine(m.Title),
+		Author: oneLine(m.Author),
+		Number: oneLine(m.Number),
+		Series: oneLine(m.Series),
+	}
+}
+
+// setMetadata sets title, author, number and series from the guess,
+// ComicInfo takes precedence over the guess, user edited metadata takes precedence over both
+func (b *Book) setMetadata(title, author, number string) {
+	if b.Info.Series != "" {
+		title = b.Info.Series
+	} else if b.Info.Title != "" {
+		title = b.Info.Title
+	}
+	if b.Info.Author != "" {
+		author = b.Info.Author
+	}
+	if b.Info.Number != "" {
+		number = b.Info.Number
+	}
+
+	b.Title = title
+	b.Author = author
+	b.Number = number
+	if b.Meta.Title != "" {
+		b.Title = b.Meta.Title
+	}
+	if b.Meta.Author != "" {
+		b.Author = b.Meta.Author
+	}
+	if b.Meta.Number != "" {
+		b.Number = b.Meta.Number
+	}
+	b.Series = b.Title
+	if b.Meta.Series != "" {
+		b.Series = b.Meta.Series
+	}
 }
 
 // Note:
@@ -74,7 +157,7 @@ type Book struct {
 // aid debugging
 func (b Book) String() string {
 	return fmt.Sprintf(
-		`{ID:%s Title:%q Author:%q Number:%q Ranking:%d Fav:%d Cond:%d Pages:%d Page:%d Size:%d Inode:%d Mtime:%d Itime:%d Rtime:%d Fullpath:%q }`,
+		`{ID:%s Title:%q Author:%q Number:%q Ranking:%d Fav:%d Cond:%d Pages:%d Page:%d Size:%d Inode:%d Dev:%d Mtime:%d Itime:%d Rtime:%d Gtime:%d Hash:%s Series:%q Meta:%+v Info:%+v Fullpath:%q }`,
 		b.ID,
 		b.Title,
 		b.Author,
@@ -86,9 +169,15 @@ func (b Book) String() string {
 		b.Page,
 		b.Size,
 		b.Inode,
+		b.Dev,
 		b.Mtime,
 		b.Itime,
 		b.Rtime,
+		b.Gtime,
+		b.Hash,
+		b.Series,
+		b.Meta,
+		b.Info,
 		b.Fullpath)
 }
 
@@ -101,13 +190,13 @@ type IBook struct {
 
 // Author holds info regards to book
 type Author struct {
-	Name  string
-	Books []*IBook
+	Name  string  // first seen spelling of the name
+	Books []*Book // books the author has worked on
 }
 
 // FlatDB is flat text file database struct
 type FlatDB struct {
-	mutex        *sync.Mutex
+	mutex        *sync.RWMutex
 	books        []*Book
 	ibooks       []*IBook
 	authors      []*Author
@@ -115,33 +204,40 @@ type FlatDB struct {
 	mapperIID    map[string]*IBook  // map ibooks by id (unique)
 	mapperPath   map[string]*Book   // map books by file path (unique)
 	mapperTitle  map[string][]*Book // group books by title (array)
-	mapperAuthor map[string][]*Book // group books by author (array)
+	mapperAuthor map[string]*Author // map authors by normalised name (unique)
+	search       *searchIndex       // bigram index of author, title and series
 	Path         string             // where the database is stored
 	FileModDate  int64              // file last modified date
-}
+	IDLength     int                // length of new book id
 
-// convert string to int64
-func mustInt64(s string) int64 {
-	i, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		panic(err)
-	}
-	return i
+	journalEntries int               // number of patches in journal since last checkpoint
+	writes         uint64            // number of writes to db file, to tell if it changed while loading
+	schema         *flatDBSchema     // layout of the db file
+	aliases        map[string]string // old book id to current id
 }
 
 // generate random characters for the unique book ID, argument needs length
-func genChar(minLen int) string {
-	rand.Seed(time.Now().UnixNano())
-
+func genChar(length int) string {
 	validChars := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") // 62 uniq chars
 	var chars []byte
 
 	ttlValidChars := len(validChars)
+	// bytes above the last multiple of 62 are skipped, so every char is equally likely
+	maxByte := 256 - 256%ttlValidChars
 
-	for len(chars) < minLen {
-		rnum := rand.Intn(ttlValidChars)
+	b := make([]byte, length)
+	for len(chars) < length {
+		_, err := rand.Read(b)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		chars = append(chars, validChars[rnum])
+		for _, rnum := range b {
+			if int(rnum) >= maxByte || len(chars) >= length {
+				continue
+			}
+			chars = append(chars, validChars[int(rnum)%ttlValidChars])
+		}
 	}
 
 	return string(chars)
@@ -161,13 +257,17 @@ func bookCond(fp string) int64 {
 
 // New initialize new Flat Database
 func (db *FlatDB) New(dbPath string) {
-	db.mutex = &sync.Mutex{}
+	db.mutex = &sync.RWMutex{}
 	db.Path = dbPath
+	db.IDLength = FlatDBIDLength
+	db.schema = flatDBSchemas[FlatDBSchemaVersion]
+	db.aliases = make(map[string]string)
 	db.mapperID = make(map[string]*Book)
 	db.mapperIID = make(map[string]*IBook)
 	db.mapperPath = make(map[string]*Book)
 	db.mapperTitle = make(map[string][]*Book)
-	db.mapperAuthor = make(map[string][]*Book)
+	db.mapperAuthor = make(map[string]*Author)
+	db.search = newSearchIndex()
 }
 
 // Clear all data
@@ -175,6 +275,11 @@ func (db *FlatDB) Clear() {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	db.clear()
+}
+
+// clear all data, caller must hold the lock
+func (db *FlatDB) clear() {
 	db.books = nil
 	db.ibooks = nil
 	db.authors = nil
@@ -182,50 +287,130 @@ func (db *FlatDB) Clear() {
 	db.mapperIID = make(map[string]*IBook)
 	db.mapperPath = make(map[string]*Book)
 	db.mapperTitle = make(map[string][]*Book)
-	db.mapperAuthor = make(map[string][]*Book)
+	db.mapperAuthor = make(map[string]*Author)
+	db.search = newSearchIndex()
 }
 
 // Load data using default file path
-func (db *FlatDB) Load() {
-	db.Import(db.Path)
+func (db *FlatDB) Load() error {
+	return db.Import(db.Path)
 }
 
-// Reload data using default file path
-func (db *FlatDB) Reload() {
-	db.Clear()
-	db.Import(db.Path)
+// Reload data using default file path, books in use stay until the new ones are loaded
+func (db *FlatDB) Reload() error {
+	return db.Import(db.Path)
 }
 
-// Import data from alternative path
+// Import data from alternative path. books are read into new index then swapped in at once,
+// so readers see either the old or the new books, never half loaded
 func (db *FlatDB) Import(dbPath string) error {
 	fmt.Println("importing...")
 	// make sure db exists
-	fstat, err := os.Stat(db.Path)
+	_, err := os.Stat(dbPath)
 	if os.IsNotExist(err) {
 		// create blank not exist
-		f, err := os.OpenFile(db.Path, os.O_CREATE, 0644)
+		f, err := os.OpenFile(dbPath, os.O_CREATE, 0644)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		f.Close()
+	}
+
+	for try := 1; ; try++ {
+		// last try holds the lock throughout, so steady writes cannot keep it from loading
+		err = db.importFile(dbPath, try >= FlatDBImportTries)
+		if err != errImportChanged {
+			return err
+		}
+		log.Println("db file changed while loading, loading again")
+	}
+}
+
+// FlatDBImportTries is number of times db file is loaded without holding the lock, when written to during load
+const FlatDBImportTries = 3
+
+// errImportChanged db file was written while it was loaded, the change is in the file but not in the loaded books
+var errImportChanged = errors.New("db file changed while loading")
+
+// importFile reads db file then swaps in the books. the lock is released while lines are parsed unless hold,
+// errImportChanged if db was written meanwhile
+func (db *FlatDB) importFile(dbPath string, hold bool) error {
+	// no patch while the file is read
+	db.mutex.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			db.mutex.Unlock()
+		}
+	}()
+
+	writes := db.writes
+	dat, schema, aliases, err := db.readDBFile(dbPath)
+	if err != nil {
+		return err
 	}
+	fstat, err := os.Stat(dbPath)
 	if err != nil {
 		return err
 	}
 
+	if !hold {
+		db.mutex.Unlock()
+		locked = false
+	}
+	next := parseDBFile(dbPath, dat, schema)
+	if !hold {
+		db.mutex.Lock()
+		locked = true
+	}
+
+	// record appended or patched while parsing
+	if db.writes != writes && dbPath == db.Path {
+		return errImportChanged
+	}
+
+	db.books = next.books
+	db.ibooks = next.ibooks
+	db.authors = next.authors
+	db.mapperID = next.mapperID
+	db.mapperIID = next.mapperIID
+	db.mapperPath = next.mapperPath
+	db.mapperTitle = next.mapperTitle
+	db.mapperAuthor = next.mapperAuthor
+	db.search = next.search
+	db.schema = schema
 	// remember file last modified time, will use it later for checking
 	db.FileModDate = fstat.ModTime().Unix()
+	if aliases != nil {
+		db.aliases = aliases
+	}
 
-	dat, err := ioutil.ReadFile(dbPath)
+	if schema.Version == FlatDBSchemaVersion || dbPath != db.Path {
+		return nil
+	}
+
+	// keep the old layout file, then rewrite in current layout
+	bakPath := fmt.Sprintf("%s.schema%d.bak", dbPath, schema.Version)
+	err = ioutil.WriteFile(bakPath, dat, 0644)
 	if err != nil {
 		return err
 	}
-	strs := string(dat)
-	lines := strings.Split(strs, "\n")
+	log.Printf("migrating db schema %d to %d, old db file kept as %s\n", schema.Version, FlatDBSchemaVersion, bakPath)
+
+	return db.export(dbPath)
+}
+
+// parseDBFile indexes the db file lines in the layout into new db, bad line is skipped
+func parseDBFile(dbPath string, dat []byte, schema *flatDBSchema) *FlatDB {
+	lines := strings.Split(string(dat), "\n")
+
+	next := &FlatDB{}
+	next.New(dbPath)
 
 	var prevLen uint64
+	badLines := 0
 
-	for _, line := range lines {
+	for i, line := range lines {
 		// skip blank
 		if len(line) == 0 {
 			prevLen += uint64(len(line) + 1)
@@ -237,33 +422,99 @@ func (db *FlatDB) Import(dbPath string) error {
 			continue
 		}
 
-		// parse csv line
-		book, err := csvToBook(line)
+		book, err := lineToBook(schema, line)
 		if err != nil {
+			// bad line should not stop the server, run fsck to repair
+			log.Printf("db line %d skipped, %v\n", i+1, err)
+			badLines++
 			prevLen += uint64(len(line) + 1)
 			continue
 		}
 
-		ibook := &IBook{
-			Address: prevLen,
-			Book:    book,
-			Length:  uint64(len(line)),
+		next.indexBook(book, prevLen, uint64(len(line)))
+
+		prevLen += uint64(len(line) + 1)
+	}
+	if badLines > 0 {
+		log.Printf("%d db lines could not be read, run db fsck -fix to move them to %s\n", badLines, dbPath+FsckBadSuffix)
+	}
+
+	return next
+}
+
+// readDBFile reads db file and its layout. for own db file, journal is replayed first and aliases are read.
+// caller must hold the lock
+func (db *FlatDB) readDBFile(dbPath string) (dat []byte, schema *flatDBSchema, aliases map[string]string, err error) {
+	dat, err = ioutil.ReadFile(dbPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// layout of the db file, blank file will get current layout
+	schema = flatDBSchemas[FlatDBSchemaVersion]
+	if len(dat) > 0 {
+		schema, err = parseSchemaHeader(strings.SplitN(string(dat), "\n", 2)[0])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if dbPath != db.Path {
+		return dat, schema, nil, nil
+	}
+
+	// redo in-place changes that may not have reached the db file
+	n, err := replayJournal(dbPath, schema)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n > 0 {
+		log.Println("journal replayed", n)
+
+		dat, err = ioutil.ReadFile(dbPath)
+		if err != nil {
+			return nil, nil, nil, err
 		}
+	}
+	db.journalEntries = 0
 
-		db.mutex.Lock()
-		db.books = append(db.books, book)
-		db.ibooks = append(db.ibooks, ibook)
-		db.mapperID[book.ID] = book
-		db.mapperIID[book.ID] = ibook
-		db.mapperPath[book.Fullpath] = book
-		db.mapperTitle[book.Title] = append(db.mapperTitle[book.Title], book)
-		db.mapperAuthor[book.Author] = append(db.mapperAuthor[book.Author], book)
-		db.mutex.Unlock()
+	aliases, err = loadAliases(dbPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		prevLen += uint64(len(line) + 1)
+	return dat, schema, aliases, nil
+}
+
+// indexBook adds book into the in-memory index, address and length is the line record position in db file.
+// caller must hold the lock
+func (db *FlatDB) indexBook(book *Book, address, length uint64) *IBook {
+	ibook := &IBook{
+		Address: address,
+		Book:    book,
+		Length:  length,
+	}
+
+	db.books = append(db.books, book)
+	db.ibooks = append(db.ibooks, ibook)
+	db.mapperID[book.ID] = book
+	db.mapperIID[book.ID] = ibook
+	db.mapperPath[book.Fullpath] = book
+	db.mapperTitle[book.Title] = append(db.mapperTitle[book.Title], book)
+	// book with several authors is under each of them
+	for _, name := range splitAuthors(book.Author) {
+		key := authorKey(name)
+		author := db.mapperAuthor[key]
+		if author == nil {
+			author = &Author{Name: name}
+			db.mapperAuthor[key] = author
+			db.authors = append(db.authors, author)
+		}
+		author.Books = append(author.Books, book)
 	}
+	db.search.put(book)
 
-	return nil
+	return ibook
 }
 
 // Save dabase in default path
@@ -271,34 +522,95 @@ func (db *FlatDB) Save() {
 	db.Export(db.Path)
 }
 
-// Export is save database to another path
+// Export is save database to another path.
+// written to temp file first then renamed over, so the old file stays intact if anything goes wrong
 func (db *FlatDB) Export(dbPath string) error {
-	f, err := os.Create(dbPath)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.export(dbPath)
+}
+
+// export save database to path, caller must hold the lock
+func (db *FlatDB) export(dbPath string) error {
+	tmpPath := dbPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpPath)
 	defer f.Close()
 
-	ibooks := db.ibooks
-	for _, ibook := range ibooks {
-		f.Write(bookToCSV(ibook.Book))
+	// new record positions
+	addresses := make([]uint64, len(db.ibooks))
+	lengths := make([]uint64, len(db.ibooks))
+
+	w := bufio.NewWriter(f)
+	header := flatDBSchemas[FlatDBSchemaVersion].header()
+	_, err = w.WriteString(header)
+	if err != nil {
+		return err
+	}
+	offset := uint64(len(header))
+	for i, ibook := range db.ibooks {
+		b := bookToCSV(ibook.Book)
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+		addresses[i] = offset
+		lengths[i] = uint64(len(b) - 1)
+		offset += uint64(len(b))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, dbPath)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(dbPath))
+
+	if dbPath != db.Path {
+		return nil
+	}
+
+	// exported file has all the changes, journal is obsolete
+	err = os.Remove(journalPath(db.Path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.journalEntries = 0
+	db.schema = flatDBSchemas[FlatDBSchemaVersion]
+	db.writes++
+
+	// records could have moved
+	for i, ibook := range db.ibooks {
+		ibook.Address = addresses[i]
+		ibook.Length = lengths[i]
 	}
+
 	return nil
 }
 
-// check if csv line commas are still valid
-func validCommaPos(line string) bool {
-	poss := []int{
-		3, 5, 10, 15, 17, 19, 30, 41, 52, 63, 74,
-	}
-	for _, pos := range poss {
-		// ascii 44 is comma
-		if line[pos] != 44 {
-			fmt.Println("fail", pos)
-			return false
-		}
+// syncDir flush directory entry changes such as rename, not supported on every os so error is ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
 	}
-	return true
+	defer d.Close()
+	d.Sync()
 }
 
 // UpdatePage change database record on page read, returns written byte size
@@ -306,6 +618,8 @@ func (db *FlatDB) UpdatePage(id string, page int) (writeSize int, err error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	id = db.resolveID(id)
+
 	ibook := db.mapperIID[id]
 	if ibook == nil {
 		return 0, ErrNilIBook
@@ -316,7 +630,7 @@ func (db *FlatDB) UpdatePage(id string, page int) (writeSize int, err error) {
 	// read out from db
 	b := make([]byte, ibook.Length)
 
-	f, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	f, err := os.Open(db.Path)
 	if err != nil {
 		return 0, err
 	}
@@ -326,41 +640,33 @@ func (db *FlatDB) UpdatePage(id string, page int) (writeSize int, err error) {
 	strs := string(b)
 
 	// make sure the column spacing is still the same
-	if !validCommaPos(strs) {
+	if !db.schema.validCommaPos(strs) {
 		return 0, ErrDBColumnChanged
 	}
 
 	// page with extended chars
 	strPage := fmt.Sprintf(FlatDBCharsPage, ibook.Page)
-	bPage := bytes.NewBufferString(strPage)
-	// absolute position for the page, Page
-	posPage := int64(ibook.Address + 11)
-	bSize, err := f.WriteAt(bPage.Bytes(), posPage)
-	if err != nil {
-		return
-	}
-	writeSize += bSize
-
 	// epoch with extended chars
 	strRtime := fmt.Sprintf(FlatDBCharsEpoch, ibook.Rtime)
-	bRtime := bytes.NewBufferString(strRtime)
+
+	// absolute position for the page, Page
+	posPage := int64(ibook.Address) + int64(db.schema.offset(len(id), flatDBColPage))
 	// absolute position for the read time, RTime
-	posRtime := int64(ibook.Address + 64)
-	bSize, err = f.WriteAt(bRtime.Bytes(), posRtime)
-	if err != nil {
-		return
-	}
-	writeSize += bSize
+	posRtime := int64(ibook.Address) + int64(db.schema.offset(len(id), flatDBColRtime))
 
-	return
+	return db.patch(
+		journalPatch{ID: id, Address: posPage, Data: []byte(strPage)},
+		journalPatch{ID: id, Address: posRtime, Data: []byte(strRtime)},
+	)
 }
 
 // UpdateFav change database record favourited, returns written byte size
 func (db *FlatDB) UpdateFav(id string, fav bool) (int, error) {
-	fmt.Println(">>>>> UpdateFav", id, fav)
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	id = db.resolveID(id)
+
 	ibook := db.mapperIID[id]
 	if ibook == nil {
 		return 0, ErrNilIBook
@@ -374,7 +680,7 @@ func (db *FlatDB) UpdateFav(id string, fav bool) (int, error) {
 	// read out from db
 	b := make([]byte, ibook.Length)
 
-	f, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	f, err := os.Open(db.Path)
 	if err != nil {
 		return 0, err
 	}
@@ -384,320 +690,667 @@ func (db *FlatDB) UpdateFav(id string, fav bool) (int, error) {
 	strs := string(b)
 
 	// make sure the column spacing is still the same
-	if !validCommaPos(strs) {
+	if !db.schema.validCommaPos(strs) {
 		return 0, ErrDBColumnChanged
 	}
 
 	// convert uint64 to str
 	strFav := fmt.Sprintf("%d", ibook.Fav)
-	b2 := bytes.NewBufferString(strFav)
 	// absolute position for the fav
-	posFav := int64(ibook.Address + 18)
-	b2len, err := f.WriteAt(b2.Bytes(), posFav)
+	posFav := int64(ibook.Address) + int64(db.schema.offset(len(id), flatDBColFav))
 
-	return b2len, err
+	return db.patch(journalPatch{ID: id, Address: posFav, Data: []byte(strFav)})
 }
 
-// BookIDs gives list of all the book ids in the db
-func (db *FlatDB) BookIDs() []string {
-	ids := make([]string, len(db.ibooks))
-
-	for _, ibook := range db.ibooks {
-		ids = append(ids, ibook.ID)
+// UpdateRanking change database record ranking, 1-5 or 0 to unrank, returns written byte size
+func (db *FlatDB) UpdateRanking(id string, ranking int) (int, error) {
+	if ranking < 0 || ranking > 5 {
+		return 0, ErrRankingRange
 	}
 
-	return ids
-}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-// AddBook by file path, returns generated book id. return non-pointer book because db will be reloaded
-func (db *FlatDB) AddBook(bookPath string) (*Book, error) {
-	// generate unique book id
-	id := genChar(3)
-	// make sure book id is unique
-	for db.GetBookByID(id) != nil {
-		id = genChar(3)
-	}
+	id = db.resolveID(id)
 
-	fstat, err := os.Stat(bookPath)
-	if err != nil {
-		return nil, err
+	ibook := db.mapperIID[id]
+	if ibook == nil {
+		return 0, ErrNilIBook
 	}
+	ibook.Ranking = int64(ranking)
 
-	// // get file inode
-	// fstat2, ok := fstat.Sys().(*syscall.Stat_t)
-	// if !ok {
-	// 	return nil, errors.New("Not a syscall.Stat_t")
-	// }
+	// read out from db
+	b := make([]byte, ibook.Length)
 
-	pages, err := cbzGetPages(bookPath)
+	f, err := os.Open(db.Path)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	defer f.Close()
 
-	// filename
-	fname := path.Base(bookPath)
-
-	book := Book{
-		ID:       id,
-		Title:    getTitle(fname),
-		Author:   getAuthor(fname),
-		Number:   getNumber(fname),
-		Fullpath: bookPath,
-		Cond:     bookCond(bookPath),
-		Pages:    pages,
-		Size:     fstat.Size(),
-		// Inode:    fstat2.Ino,
-		Mtime: fstat.ModTime().Unix(),
-		Itime: time.Now().Unix(),
-	}
+	f.ReadAt(b, int64(ibook.Address))
+	strs := string(b)
 
-	f, err := os.OpenFile(db.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, err
+	// make sure the column spacing is still the same
+	if !db.schema.validCommaPos(strs) {
+		return 0, ErrDBColumnChanged
 	}
-	defer f.Close()
 
-	// save to db file
-	b := bookToCSV(&book)
-	f.Write(b)
-	f.Close()
+	strRanking := fmt.Sprintf("%d", ibook.Ranking)
+	// absolute position for the ranking
+	posRanking := int64(ibook.Address) + int64(db.schema.offset(len(id), flatDBColRanking))
 
-	// reload from db file
-	db.Reload()
-
-	return &book, nil
+	return db.patch(journalPatch{ID: id, Address: posRanking, Data: []byte(strRanking)})
 }
 
-func visit(db *FlatDB) func(string, os.FileInfo, error) error {
-	return func(fpath string, f os.FileInfo, err error) error {
-		// skip folder
-		if f.IsDir() {
-			return nil
-		}
-		if strings.HasPrefix(f.Name(), ".") {
-			return nil
-		}
+// UpdateMeta change user edited metadata of the book, blank field goes back to the guess from file name.
+// record length changes, so db is rewritten
+func (db *FlatDB) UpdateMeta(id string, meta BookMeta) (*Book, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-		// add book, with sanity checks
-		db.AddFile(fpath)
+	id = db.resolveID(id)
 
-		return nil
+	book := db.mapperID[id]
+	if book == nil {
+		return nil, ErrNilIBook
 	}
-}
 
-// AddFile adds book to db
-func (db *FlatDB) AddFile(fpath string) (*Book, error) {
-	var err error
+	book.Meta = meta.clean()
 
-	// get file state, e.g. size
-	f, err := os.Stat(fpath)
-	if err != nil {
-		return nil, err
-	}
+	fname := path.Base(book.Fullpath)
+	book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
 
-	// skip folder
-	if f.IsDir() {
-		return nil, ErrNotFile
-	}
-	// skip dot file
-	if strings.HasPrefix(f.Name(), ".") {
-		return nil, ErrDotFile
-	}
-	// skip non cbz extension
-	lname := strings.ToLower(f.Name())
-	if !strings.HasSuffix(lname, ".cbz") {
-		return nil, ErrNotBook
-	}
+	return copyBook(book), db.reindex()
+}
 
-	// make sure books are unique so no duplicate db record
-	book := db.GetBookByPath(fpath)
-	if book != nil {
-		// skip
-		return nil, ErrDupBook
-	}
+// BookIDs gives list of all the book ids in the db
+func (db *FlatDB) BookIDs() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	book, err = db.AddBook(fpath)
-	if err != nil {
-		return nil, err
+	ids := make([]string, 0, len(db.ibooks))
+
+	for _, ibook := range db.ibooks {
+		ids = append(ids, ibook.ID)
 	}
-	log.Println("Added book", fpath)
 
-	return book, nil
+	return ids
 }
 
-// AddDirR recursively add books from directory
-func (db *FlatDB) AddDirR(dir string) error {
-	return filepath.Walk(dir, visit(db))
+// Count gives number of books in the db
+func (db *FlatDB) Count() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return len(db.books)
 }
 
-// AddDir add books from directory
-func (db *FlatDB) AddDir(dir string) error {
-	// filepath.Glob() dont work with unicode file name dir so using ioutil.ReadDir()
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return err
-	}
+// Books gives copies of all books, missing ones too
+func (db *FlatDB) Books() []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	for _, file := range files {
-		err = visit(db)(filepath.Join(dir, file.Name()), file, err)
-		if err != nil {
-			return err
-		}
+	books := make([]*Book, len(db.books))
+	for i, book := range db.books {
+		books[i] = copyBook(book)
 	}
 
-	return nil
+	return books
 }
 
-func getAuthor(str string) string {
-	// get first [...]
-	result := regexp.MustCompile(`\[(.+?)\]`).FindStringSubmatch(str)
-	if result != nil {
-		return result[1]
+// UpdateFileState saves state read from the book files, books are matched by id.
+// sizes of records may change, so db file is rewritten
+func (db *FlatDB) UpdateFileState(books []*Book) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, b := range books {
+		book := db.mapperID[db.resolveID(b.ID)]
+		if book == nil {
+			continue
+		}
+		book.setFileState(b)
 	}
 
-	// no author found
-	return ""
+	return db.reindex()
 }
 
-func getTitle(str string) string {
-	s := str
-	// get rid of extension, case insensitive
-	s = regexp.MustCompile(`(?i).cbz`).ReplaceAllString(s, ``)
-	// get rid of english
-	s = regexp.MustCompile(` - [ \?\!\-\+\.\,\~\(\)\[\]A-Za-z0-9]+`).ReplaceAllString(s, ``)
-	// underline to space
-	s = regexp.MustCompile(`_`).ReplaceAllString(s, ` `)
-	// change unicode wide space to narrow(ascii) space
-	s = regexp.MustCompile(`　`).ReplaceAllString(s, ` `)
-	// get rid of (...)
-	s = regexp.MustCompile(`\(.+?\)`).ReplaceAllString(s, ``)
-	// get rid of [...]
-	s = regexp.MustCompile(`\[.+?\]`).ReplaceAllString(s, ``)
-	//s.gsub!(/ \S\d+.*/,'')
-
-	// get rid of vol or chapter
-	s = strings.Replace(s, getNumber(str), ``, -1)
+// UpdateProgress saves page, read time, favourite and ranking of the books, books are matched by id.
+// many books change at once, so db file is rewritten instead of patched
+func (db *FlatDB) UpdateProgress(books []*Book) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-	// change multi-spaces to single space
-	s = regexp.MustCompile(` +`).ReplaceAllString(s, ` `)
-	// trim leading and trailing space
-	s = strings.TrimSpace(s)
+	for _, b := range books {
+		book := db.mapperID[db.resolveID(b.ID)]
+		if book == nil {
+			continue
+		}
+		book.setProgress(b)
+	}
 
-	return s
+	return db.reindex()
 }
 
-func getNumber(str string) string {
-	var result []string
-
-	// remove extension
-	s := regexp.MustCompile(`\.cbz`).ReplaceAllString(str, ``)
+// Reparse guess title, author and number from file name again with the rules in use, gives number of books changed.
+// db file is rewritten only if any changed
+func (db *FlatDB) Reparse() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	n := 0
+	for _, book := range db.books {
+		if book.reparse() {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, db.reindex()
+}
+
+// FlatDBBatchSize is number of books written to db file at a time during bulk add
+const FlatDBBatchSize = 100
+
+// AddBook by file path, returns the newly indexed book
+func (db *FlatDB) AddBook(bookPath string) (*Book, error) {
+	book, err := newBook(bookPath)
+	if err != nil {
+		return nil, err
+	}
+
+	books, err := db.appendBooks([]*Book{book})
+	if err != nil {
+		return nil, err
+	}
+	// added by someone else meanwhile
+	if len(books) == 0 {
+		return nil, ErrDupBook
+	}
+
+	return book, nil
+}
+
+// newBook reads book file and fill in the details, book id is not generated yet
+func newBook(bookPath string) (*Book, error) {
+	fstat, err := os.Stat(bookPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, hash, info, err := cbzRead(bookPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// filename
+	fname := path.Base(bookPath)
+
+	book := &Book{
+		Fullpath: bookPath,
+		Cond:     bookCond(bookPath),
+		Pages:    pages,
+		Size:     fstat.Size(),
+		Inode:    fileInode(fstat),
+		Dev:      fileDevice(fstat),
+		Mtime:    fstat.ModTime().Unix(),
+		Itime:    time.Now().Unix(),
+		Hash:     hash,
+		Info:     info,
+	}
+	book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+
+	return book, nil
+}
+
+// appendBooks gives the books unique id, appends them to the end of db file and index them in place.
+// address of each record is calculated from the append offset, so no reload is needed.
+// book which path is already in db is left out, returns the books appended
+func (db *FlatDB) appendBooks(books []*Book) ([]*Book, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// path was checked before the lock, could be added by other call since
+	books = db.newPaths(books)
+	if len(books) == 0 {
+		return books, nil
+	}
+
+	f, err := os.OpenFile(db.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	// change unicode wide space to narrow(ascii) space
-	s = regexp.MustCompile(`　`).ReplaceAllString(s, ` `)
+	fstat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := uint64(fstat.Size())
+
+	// new db file starts with the layout version
+	if offset == 0 {
+		header := db.schema.header()
+		_, err = f.Write([]byte(header))
+		if err != nil {
+			return nil, err
+		}
+		offset = uint64(len(header))
+	}
+
+	// make sure last record is terminated, otherwise new record will join the last line
+	if offset > 0 {
+		b := make([]byte, 1)
+		_, err = f.ReadAt(b, int64(offset-1))
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '\n' {
+			_, err = f.Write([]byte("\n"))
+			if err != nil {
+				return nil, err
+			}
+			offset++
+		}
+	}
+
+	buf := bytes.Buffer{}
+	type position struct {
+		address uint64
+		length  uint64
+	}
+	positions := []position{}
+	for _, book := range books {
+		// generate unique book id
+		book.ID = genChar(db.IDLength)
+		// make sure book id is unique, within db, aliases and the batch
+		for db.idTaken(book.ID) || bookIDInSlice(books, book) {
+			book.ID = genChar(db.IDLength)
+		}
+
+		b := bookToCSV(book)
+		positions = append(positions, position{
+			address: offset + uint64(buf.Len()),
+			length:  uint64(len(b) - 1), // without newline
+		})
+		buf.Write(b)
+	}
+
+	// save to db file in one go
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	db.writes++
+
+	// update index in place, books given stay with the caller
+	for i, book := range books {
+		db.indexBook(copyBook(book), positions[i].address, positions[i].length)
+	}
+
+	return books, nil
+}
+
+// newPaths gives the books which path is not in db, nor listed before in books. caller must hold the lock
+func (db *FlatDB) newPaths(books []*Book) []*Book {
+	fresh := []*Book{}
+	seen := map[string]bool{}
+	for _, book := range books {
+		if db.mapperPath[book.Fullpath] != nil || seen[book.Fullpath] {
+			continue
+		}
+		seen[book.Fullpath] = true
+		fresh = append(fresh, book)
+	}
+	return fresh
+}
 
-	// e.g.  第01巻   第1-3話     巻(まき)  卷(かん)
-	result = regexp.MustCompile(`(?i) (第[\d\-\~]+)(巻|卷|部|話)`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1] + result[2]
+// bookIDInSlice checks if book id is used by other book in the slice
+func bookIDInSlice(books []*Book, book *Book) bool {
+	for _, b := range books {
+		if b != book && b.ID == book.ID {
+			return true
+		}
 	}
+	return false
+}
 
-	// e.g.  1巻   1-3話
-	result = regexp.MustCompile(`(?i) ([\d\-\~\,]+)(巻|卷|部|話)`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1] + result[2]
+// checkBookFile do sanity checks on file before adding as a book
+func (db *FlatDB) checkBookFile(fpath string) error {
+	err := checkBookFileType(fpath)
+	if err != nil {
+		return err
 	}
 
-	// e.g.  上巻
-	result = regexp.MustCompile(`(?i) (上|中|下)(巻|卷|部|話)`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1] + result[2]
+	// make sure books are unique so no duplicate db record
+	book := db.GetBookByPath(fpath)
+	if book != nil {
+		// skip
+		return ErrDupBook
 	}
 
-	// e.g.  vol.01.cbz
-	result = regexp.MustCompile(`(?i) (vol.{0,2}\d+)$`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	return nil
+}
+
+// checkBookFileType checks the file can be a book, regardless of db
+func checkBookFileType(fpath string) error {
+	// get file state, e.g. size
+	f, err := os.Stat(fpath)
+	if err != nil {
+		return err
 	}
 
-	// e.g.  ch.01.cbz
-	result = regexp.MustCompile(`(?i) (ch.{0,2}\d+)$`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	// skip folder
+	if f.IsDir() {
+		return ErrNotFile
+	}
+	// skip dot file
+	if strings.HasPrefix(f.Name(), ".") {
+		return ErrDotFile
+	}
+	// skip non cbz extension
+	lname := strings.ToLower(f.Name())
+	if !strings.HasSuffix(lname, ".cbz") {
+		return ErrNotBook
 	}
 
-	// e.g.  上.cbz
-	result = regexp.MustCompile(`(?i) (上|中|下)$`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	return nil
+}
+
+// AddFile adds book to db
+func (db *FlatDB) AddFile(fpath string) (*Book, error) {
+	err := db.checkBookFile(fpath)
+	if err != nil {
+		return nil, err
 	}
 
-	// e.g.  v01.cbz
-	result = regexp.MustCompile(`(?i) (v\d+)$`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	// read once, for both relink and add
+	file, err := newBook(fpath)
+	if err != nil {
+		return nil, err
 	}
 
-	// e.g.  c01.cbz
-	result = regexp.MustCompile(`(?i) (c\d+\.)$`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	// moved book keeps the old record
+	book, err := db.relink(file)
+	if err != nil {
+		return nil, err
+	}
+	if book != nil {
+		return book, nil
 	}
 
-	// 2018年10月号
-	result = regexp.MustCompile(`(?i) (\d{4}年\d{2}月号)`).FindStringSubmatch(s)
-	if result != nil {
-		return result[1]
+	books, err := db.appendBooks([]*Book{file})
+	if err != nil {
+		return nil, err
 	}
+	// added by someone else meanwhile
+	if len(books) == 0 {
+		return nil, ErrDupBook
+	}
+	book = books[0]
+	log.Println("Added book", fpath)
 
-	// commented out. because some book title could have number
-	// // e.g.  01.cbz
-	// result = regexp.MustCompile(`(?i) (\d+)$`).FindStringSubmatch(s)
-	// if result != nil {
-	// 	return result[1]
-	// }
+	return book, nil
+}
+
+// AddFiles adds many books to db in batches, files that failed sanity checks or unreadable are skipped.
+// file that is a moved book takes over the old record. returns the added books
+func (db *FlatDB) AddFiles(fpaths []string) ([]*Book, error) {
+	return db.addFiles(fpaths, nil)
+}
+
+// AddBooks adds books already read by newBook, e.g. by scanner workers, same as AddFiles otherwise
+func (db *FlatDB) AddBooks(books []*Book) ([]*Book, error) {
+	fpaths := make([]string, len(books))
+	read := make(map[string]*Book, len(books))
+	for i, book := range books {
+		fpaths[i] = book.Fullpath
+		read[book.Fullpath] = book
+	}
 
-	return ""
+	return db.addFiles(fpaths, read)
+}
+
+// addFiles adds the files, book file is only read when not found in read
+func (db *FlatDB) addFiles(fpaths []string, read map[string]*Book) ([]*Book, error) {
+	added := []*Book{}
+	batch := []*Book{}
+	// books in this call not yet commited, prevent same path twice
+	pending := map[string]bool{}
+
+	// moved books found, applied at the end in one reindex
+	type move struct {
+		book *Book // copy of missing book
+		file *Book // file read by newBook
+	}
+	moves := []move{}
+	var idx *relinkIndex
+
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		books, err := db.appendBooks(batch)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			log.Println("Added book", book.Fullpath)
+		}
+		added = append(added, books...)
+		batch = []*Book{}
+		return nil
+	}
+
+	for _, fpath := range fpaths {
+		if pending[fpath] {
+			continue
+		}
+		err := db.checkBookFile(fpath)
+		if err != nil {
+			continue
+		}
+		pending[fpath] = true
+
+		// look for moved book, index only built when there is new file
+		fstat, err := os.Stat(fpath)
+		if err != nil {
+			continue
+		}
+		if idx == nil {
+			db.mutex.RLock()
+			idx = newRelinkIndex(db.books)
+			db.mutex.RUnlock()
+		}
+		// zip is read before the lock, moved book takes the pages too
+		book := read[fpath]
+		if book == nil {
+			book, err = newBook(fpath)
+			if err != nil {
+				log.Println("failed to add book", fpath, err)
+				continue
+			}
+		}
+		// same file or same content as missing book
+		moved := pickMoved(idx.candidates(fpath, fstat), fpath, idx.claimed)
+		if moved == nil {
+			moved = pickMoved(idx.byHash[book.Hash], fpath, idx.claimed)
+		}
+		if moved != nil {
+			idx.claimed[moved] = true
+			moves = append(moves, move{book: moved, file: book})
+			continue
+		}
+		batch = append(batch, book)
+
+		if len(batch) >= FlatDBBatchSize {
+			err = commit()
+			if err != nil {
+				return added, err
+			}
+		}
+	}
+
+	err := commit()
+	if err != nil {
+		return added, err
+	}
+
+	if len(moves) == 0 {
+		return added, nil
+	}
+
+	err = func() error {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		for _, m := range moves {
+			if db.mapperPath[m.file.Fullpath] != nil {
+				continue
+			}
+			// index has copies, apply to the record. other call could have relinked the book since
+			book := db.mapperID[m.book.ID]
+			if !stillMissing(book, m.book) {
+				// book taken by other file, add as new book instead of dropping it
+				batch = append(batch, m.file)
+				continue
+			}
+			relinkBook(book, m.file)
+		}
+		return db.reindex()
+	}()
+	if err != nil {
+		return added, err
+	}
+
+	err = commit()
+	if err != nil {
+		return added, err
+	}
+
+	return added, nil
+}
+
+// listFiles gives visible files in dir, recursively if needed
+func listFiles(dir string, recursive bool) ([]string, error) {
+	fpaths := []string{}
+
+	if recursive {
+		err := filepath.Walk(dir, func(fpath string, f os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			// skip folder
+			if f.IsDir() {
+				return nil
+			}
+			if strings.HasPrefix(f.Name(), ".") {
+				return nil
+			}
+			fpaths = append(fpaths, fpath)
+			return nil
+		})
+		return fpaths, err
+	}
+
+	// filepath.Glob() dont work with unicode file name dir so using ioutil.ReadDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		fpaths = append(fpaths, filepath.Join(dir, f.Name()))
+	}
+
+	return fpaths, nil
+}
+
+// AddDirR recursively add books from directory
+func (db *FlatDB) AddDirR(dir string) error {
+	fpaths, err := listFiles(dir, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.AddFiles(fpaths)
+	return err
+}
+
+// AddDir add books from directory
+func (db *FlatDB) AddDir(dir string) error {
+	fpaths, err := listFiles(dir, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.AddFiles(fpaths)
+	return err
 }
 
 // cbzGetPages find out how many pages in cbz
 func cbzGetPages(fp string) (int64, error) {
+	pages, _, err := cbzInfo(fp)
+	return pages, err
+}
+
+// cbzInfo find out how many pages in cbz and the content fingerprint.
+// fingerprint is hash of the image entries name, crc and size from zip central directory,
+// so it is cheap to get and same content in different file name gives same fingerprint
+func cbzInfo(fp string) (int64, string, error) {
+	pages, hash, _, err := cbzRead(fp)
+	return pages, hash, err
+}
+
+// cbzRead gives pages, content fingerprint and ComicInfo of cbz in one go, blank ComicInfo if there is none
+func cbzRead(fp string) (int64, string, ComicInfo, error) {
 	zr, err := zip.OpenReader(fp)
 	if err != nil {
-		return -1, err
+		return -1, "", ComicInfo{}, err
 	}
 	defer zr.Close()
 
-	var i int64
+	entries := []string{}
 	for _, f := range zr.File {
 		if RegexSupportedImageExt.MatchString(f.Name) {
-			i++
+			entries = append(entries, fmt.Sprintf("%s:%08x:%d", f.Name, f.CRC32, f.UncompressedSize64))
 		}
 	}
+	info := zipComicInfo(&zr.Reader)
 
 	// force free memory with GC
 	zr = nil
 
-	if i == 0 {
-		return -1, ErrNotBook
+	if len(entries) == 0 {
+		return -1, "", ComicInfo{}, ErrNotBook
 	}
 
-	return i, nil
+	sort.Strings(entries)
+	sum := sha256.Sum256([]byte(strings.Join(entries, "\n")))
+
+	return int64(len(entries)), hex.EncodeToString(sum[:16]), info, nil
 }
 
-// GetBookByID get Book object by book id
+// GetBookByID get copy of Book object by book id, old id gives the book it was renamed to
 func (db *FlatDB) GetBookByID(bookID string) *Book {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	return db.mapperID[bookID]
+	return copyBook(db.mapperID[db.resolveID(bookID)])
 }
 
-// GetBookByPath get Book object by file path
+// GetBookByPath get copy of Book object by file path
 func (db *FlatDB) GetBookByPath(fpath string) *Book {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	return db.mapperPath[fpath]
+	return copyBook(db.mapperPath[fpath])
 }
 
 // GetPageCoverByID get book cover page
@@ -707,7 +1360,12 @@ func (db *FlatDB) GetPageCoverByID(bookID string) ([]byte, error) {
 		return nil, ErrNotBook
 	}
 
-	zr, err := zip.OpenReader(book.Fullpath)
+	return bookCover(book.Fullpath, book.Info.Cover)
+}
+
+// bookCover gives thumbnail of the cover page of book file, counted from 1. first page if cover is not in the book
+func bookCover(fpath string, cover int64) ([]byte, error) {
+	zr, err := zip.OpenReader(fpath)
 	if err != nil {
 		return nil, err
 	}
@@ -726,10 +1384,14 @@ func (db *FlatDB) GetPageCoverByID(bookID string) ([]byte, error) {
 	// do natural sort
 	files = sortNatural(files, RegexSupportedImageExt)
 
-	// get first image file
+	// get cover image file
+	name := files[0]
+	if cover > 1 && cover <= int64(len(files)) {
+		name = files[cover-1]
+	}
 	var rc io.ReadCloser
 	for _, f := range zr.File {
-		if f.Name != files[0] {
+		if f.Name != name {
 			continue
 		}
 
@@ -757,123 +1419,199 @@ func (db *FlatDB) GetPageCoverByID(bookID string) ([]byte, error) {
 
 // SearchBookByNameAndSize get Books object by filename and size
 func (db *FlatDB) SearchBookByNameAndSize(fname string, size int64) []*Book {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
 	var books []*Book
 
 	for _, book := range db.books {
 		if book.Size == size && path.Base(book.Fullpath) == fname {
-			books = append(books, book)
+			books = append(books, copyBook(book))
 		}
 	}
 
 	return books
 }
 
-// Search find Books base on title and author
-func (db *FlatDB) Search(search string) []*Book {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+// SearchBookByInode get Books object by file device and inode, none if either is not known
+func (db *FlatDB) SearchBookByInode(dev, inode int64) []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	books := filterBooksByAuthorTitle(db.books, search)
+	var books []*Book
+	if dev == 0 || inode == 0 {
+		return books
+	}
+
+	for _, book := range db.books {
+		if book.Dev == dev && book.Inode == inode {
+			books = append(books, copyBook(book))
+		}
+	}
 
 	return books
 }
 
-//
-// helper code ------------------------------------------------------------------------------------------------------
-//
+// SearchBookByHash get Books object by content fingerprint
+func (db *FlatDB) SearchBookByHash(hash string) []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-// csvToBook convert string to book
-func csvToBook(line string) (*Book, error) {
-	chrs := explode(line, -1)
+	var books []*Book
 
-	records := []string{}
-	innerC := false
-	innerStr := ""
-	for i, chr := range chrs {
-		// add quote
-		if chr == "\"" && i < len(chrs) && chrs[i-1] == "\"" {
-			continue
-		}
-		if chr == "\"" && i < len(chrs)-1 && chrs[i+1] == "\"" {
-			innerStr += "\""
-			continue
+	for _, book := range db.books {
+		if book.Hash == hash {
+			books = append(books, copyBook(book))
 		}
-		// flip between quotes
-		if chr == "\"" {
-			innerC = !innerC
+	}
+
+	return books
+}
+
+// Search find Books by search query, see parseQuery
+func (db *FlatDB) Search(search string) []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	books := []*Book{}
+	for _, book := range db.search.search(parseQuery(search)) {
+		// skip books known to be missing, waiting to be purged
+		if book.Cond == 2 {
 			continue
 		}
+		books = append(books, copyBook(book))
+	}
 
-		if !innerC {
-			if chr != "," {
-				innerStr += chr
-				continue
-			}
+	return books
+}
 
-			if chr == "," {
-				// seperator, record buffer and start next column
-				records = append(records, innerStr)
-				innerStr = ""
-				continue
-			}
-		}
+//
+// helper code ------------------------------------------------------------------------------------------------------
+//
 
-		innerStr += chr
+// lineToBook convert db file line in the given layout to book
+func lineToBook(schema *flatDBSchema, line string) (*Book, error) {
+	records := csvToRecords(line)
+	if len(records) != schema.Columns {
+		return nil, fmt.Errorf("%w, %d columns", ErrCSVIncomplete, len(records))
 	}
-	// add last column
-	records = append(records, innerStr)
+	// upgrade old layout
+	records, err := migrateRecords(schema.Version, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordsToBook(records)
+}
+
+// csvToBook convert string to book, line must be in current layout
+func csvToBook(line string) (*Book, error) {
+	records := csvToRecords(line)
 
 	// incomplete record
-	if len(records) != 15 {
+	if len(records) != flatDBSchemas[FlatDBSchemaVersion].Columns {
 		return nil, ErrCSVIncomplete
 	}
 
-	book := &Book{
-		ID:       records[0],
-		Title:    records[11],
-		Author:   records[12],
-		Number:   records[13],
-		Fullpath: records[14],
-		Cond:     bookCond(records[1]),
-		Pages:    mustInt64(records[2]),
-		Page:     mustInt64(records[3]),
-		Ranking:  mustInt64(records[4]),
-		Fav:      mustInt64(records[5]),
-		Size:     mustInt64(records[6]),
-		Inode:    mustInt64(records[7]),
-		Mtime:    mustInt64(records[8]),
-		Itime:    mustInt64(records[9]),
-		Rtime:    mustInt64(records[10]),
+	return recordsToBook(records)
+}
+
+// csvToRecords split csv line into columns. column in quotes can have comma, and "" for a quote, as written by stringToCSVSafe
+func csvToRecords(line string) []string {
+	records := []string{}
+	column := strings.Builder{}
+	quoted := false
+
+	rs := []rune(line)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+
+		if quoted {
+			switch {
+			case r == '"' && i+1 < len(rs) && rs[i+1] == '"':
+				// escaped quote
+				column.WriteRune('"')
+				i++
+			case r == '"':
+				quoted = false
+			default:
+				column.WriteRune(r)
+			}
+			continue
+		}
+
+		switch r {
+		case '"':
+			quoted = true
+		case ',':
+			// seperator, record buffer and start next column
+			records = append(records, column.String())
+			column.Reset()
+		default:
+			column.WriteRune(r)
+		}
 	}
+	// add last column
+	records = append(records, column.String())
 
-	return book, nil
+	return records
 }
 
-// copied from strings.explode
-// explode splits s into a slice of UTF-8 strings,
-// one string per Unicode character up to a maximum of n (n < 0 means no limit).
-// Invalid UTF-8 sequences become correct encodings of U+FFFD.
-func explode(s string, n int) []string {
-	l := utf8.RuneCountInString(s)
-	if n < 0 || n > l {
-		n = l
-	}
-	a := make([]string, n)
-	for i := 0; i < n-1; i++ {
-		ch, size := utf8.DecodeRuneInString(s)
-		a[i] = s[:size]
-		s = s[size:]
-		if ch == utf8.RuneError {
-			a[i] = string(utf8.RuneError)
+// recordsToBook convert csv columns in current layout to book
+func recordsToBook(records []string) (*Book, error) {
+	var err error
+	// convert string to int64, remember the first bad column
+	toInt64 := func(col int) int64 {
+		i, err2 := strconv.ParseInt(records[col], 10, 64)
+		if err2 != nil && err == nil {
+			err = fmt.Errorf("%w, column %d %q", ErrCSVColumn, col, records[col])
 		}
+		return i
 	}
-	if n > 0 {
-		a[n-1] = s
+
+	book := &Book{
+		ID:       records[flatDBColID],
+		Fullpath: records[flatDBColFullpath],
+		Cond:     toInt64(flatDBColCond),
+		Pages:    toInt64(flatDBColPages),
+		Page:     toInt64(flatDBColPage),
+		Ranking:  toInt64(flatDBColRanking),
+		Fav:      toInt64(flatDBColFav),
+		Size:     toInt64(flatDBColSize),
+		Inode:    toInt64(flatDBColInode),
+		Dev:      toInt64(flatDBColDev),
+		Mtime:    toInt64(flatDBColMtime),
+		Itime:    toInt64(flatDBColItime),
+		Rtime:    toInt64(flatDBColRtime),
+		Gtime:    toInt64(flatDBColGtime),
+		Hash:     records[flatDBColHash],
+		Meta: BookMeta{
+			Title:  records[flatDBColMetaTitle],
+			Author: records[flatDBColMetaAuthor],
+			Number: records[flatDBColMetaNumber],
+			Series: records[flatDBColMetaSeries],
+		},
+		Info: ComicInfo{
+			Title:   records[flatDBColInfoTitle],
+			Series:  records[flatDBColInfoSeries],
+			Number:  records[flatDBColInfoNumber],
+			Author:  records[flatDBColInfoAuthor],
+			Summary: records[flatDBColInfoSummary],
+			Genre:   records[flatDBColInfoGenre],
+			Manga:   records[flatDBColInfoManga],
+		},
+	}
+	book.Info.PageCount = toInt64(flatDBColInfoPageCount)
+	book.Info.Cover = toInt64(flatDBColInfoCover)
+	if err != nil {
+		return nil, err
+	}
+	book.setMetadata(records[flatDBColTitle], records[flatDBColAuthor], records[flatDBColNumber])
+	if book.ID == "" || book.Fullpath == "" {
+		return nil, ErrCSVIncomplete
 	}
-	return a
+
+	return book, nil
 }
 
 // bookToCSV convert Book to csv bytes
@@ -881,7 +1619,7 @@ func bookToCSV(book *Book) []byte {
 	// book file name
 	fname := path.Base(book.Fullpath)
 
-	// DO NOT change ordering, can only append in future
+	// DO NOT change ordering, can only append in future, and bump FlatDBSchemaVersion with a migration
 	// use this a reference, book.XX
 	records := []string{
 		book.ID,                                   //  0  ID
@@ -891,7 +1629,7 @@ func bookToCSV(book *Book) []byte {
 		fmt.Sprint(book.Ranking),                  //  4  Ranking
 		fmt.Sprint(book.Fav),                      //  5  Fav
 		fmt.Sprintf(FlatDBCharsFSize, book.Size),  //  6  Size
-		fmt.Sprintf(FlatDBCharsEpoch, book.Inode), //  7  Inode
+		fmt.Sprintf(FlatDBCharsInode, book.Inode), //  7  Inode
 		fmt.Sprintf(FlatDBCharsEpoch, book.Mtime), //  8  Mtime
 		fmt.Sprintf(FlatDBCharsEpoch, book.Itime), //  9  Itime
 		fmt.Sprintf(FlatDBCharsEpoch, book.Rtime), // 10  Rtime
@@ -899,6 +1637,24 @@ func bookToCSV(book *Book) []byte {
 		getAuthor(fname),                          // 12  Author
 		getNumber(fname),                          // 13  Number
 		book.Fullpath,                             // 14  Fullpath
+		fmt.Sprintf(FlatDBCharsEpoch, book.Gtime), // 15  Gtime
+		book.Hash,         // 16  Hash
+		book.Meta.Title,   // 17  Meta.Title
+		book.Meta.Author,  // 18  Meta.Author
+		book.Meta.Number,  // 19  Meta.Number
+		book.Meta.Series,  // 20  Meta.Series
+		book.Info.Title,   // 21  Info.Title
+		book.Info.Series,  // 22  Info.Series
+		book.Info.Number,  // 23  Info.Number
+		book.Info.Author,  // 24  Info.Author
+		book.Info.Summary, // 25  Info.Summary
+		book.Info.Genre,   // 26  Info.Genre
+		book.Info.Manga,   // 27  Info.Manga
+		// device of the inode, schema 6
+		fmt.Sprint(book.Dev), // 28  Dev
+		// ComicInfo page count and cover page, schema 7
+		fmt.Sprint(book.Info.PageCount), // 29  Info.PageCount
+		fmt.Sprint(book.Info.Cover),     // 30  Info.Cover
 	}
 
 	result := []string{}
@@ -926,78 +1682,33 @@ func stringToCSVSafe(str string) string {
 // debug / test code ------------------------------------------------------------------------------------------------------
 //
 
-// ConvJtoF makes old json db into flat db
-func ConvJtoF(in, out string) error {
-	dat, err := ioutil.ReadFile(in)
-	if err != nil {
-		return err
-	}
-
-	var result map[string]*Book
-	err = json.Unmarshal(dat, &result)
-	if err != nil {
-		return err
-	}
-
-	for id, book := range result {
-		book.ID = id
-	}
-
-	f, err := os.Create(out)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	for _, book := range result {
-		f.Write(bookToCSV(book))
-	}
-
-	return nil
-}
-
-// ConvFtoJ makes flat db to json
+// ConvFtoJ makes flat db to json in the original db.json layout, which can be read back by Migrate
 func ConvFtoJ(in, out string) error {
-	dat, err := ioutil.ReadFile(in)
+	// loaded as other db file, so older layout is upgraded in memory and the file is left as is
+	db := &FlatDB{}
+	db.New("")
+	err := db.Import(in)
 	if err != nil {
 		return err
 	}
-	strs := string(dat)
-	lines := strings.Split(strs, "\n")
-
-	books := []*Book{}
-	var prevLen uint64
-
-	for _, line := range lines {
-		// skip blank
-		if len(line) == 0 {
-			prevLen += uint64(len(line) + 1)
-			continue
-		}
-		// skip leading #
-		if line[0:1] == "#" {
-			prevLen += uint64(len(line) + 1)
-			continue
-		}
 
-		// parse csv line
-		book, err := csvToBook(line)
-		if err != nil {
-			prevLen += uint64(len(line) + 1)
-			continue
+	// keyed by book id
+	jbooks := make(map[string]*legacyBook)
+	for _, book := range db.Books() {
+		jbooks[book.ID] = &legacyBook{
+			Title:    book.Title,
+			Author:   book.Author,
+			Number:   book.Number,
+			Fullpath: book.Fullpath,
+			Ranking:  book.Ranking,
+			Fav:      legacyFlag(book.Fav),
+			Pages:    book.Pages,
+			Page:     book.Page,
+			Size:     book.Size,
+			Mtime:    book.Mtime,
+			Itime:    book.Itime,
+			Rtime:    book.Rtime,
 		}
-
-		books = append(books, book)
-
-		prevLen += uint64(len(line) + 1)
-	}
-
-	jbooks := make(map[string]*Book)
-	for _, book := range books {
-		book2 := *book // dereference, make clone
-		book2.Cond = 0
-		book2.ID = ""
-		jbooks[book2.ID] = &book2
 	}
 
 	jstr, err := json.MarshalIndent(jbooks, "", "  ")
@@ -1005,12 +1716,5 @@ func ConvFtoJ(in, out string) error {
 		return err
 	}
 
-	f, err := os.Create(out)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	f.Write(jstr)
-
-	return nil
+	return ioutil.WriteFile(out, jstr, 0644)
 }
@@ -0,0 +1,165 @@
+package main
+
+// book id aliases
+//
+// when book is given a new id, e.g. rekey to longer id, the old id is kept as alias
+// so bookmarks and cached thumbnails keep working. alias file line format
+//   {old id},{new id}
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// aliasPath gives alias file path of the db
+func aliasPath(dbPath string) string {
+	return dbPath + ".alias"
+}
+
+// loadAliases reads alias file of the db, missing file means no alias
+func loadAliases(dbPath string) (map[string]string, error) {
+	aliases := map[string]string{}
+
+	f, err := os.Open(aliasPath(dbPath))
+	if os.IsNotExist(err) {
+		return aliases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), ",")
+		if len(cols) != 2 || cols[0] == "" || cols[1] == "" {
+			continue
+		}
+		aliases[cols[0]] = cols[1]
+	}
+
+	return aliases, scanner.Err()
+}
+
+// saveAliases writes alias file, caller must hold the lock
+func (db *FlatDB) saveAliases() error {
+	olds := []string{}
+	for old := range db.aliases {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	buf := strings.Builder{}
+	for _, old := range olds {
+		fmt.Fprintf(&buf, "%s,%s\n", old, db.aliases[old])
+	}
+
+	fpath := aliasPath(db.Path)
+	tmpPath := fpath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(buf.String())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	err = os.Rename(tmpPath, fpath)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(fpath))
+
+	return nil
+}
+
+// resolveID gives current id of the book, old id is followed to the new id. caller must hold the lock
+func (db *FlatDB) resolveID(id string) string {
+	if db.mapperID[id] != nil {
+		return id
+	}
+	if newID := db.aliases[id]; newID != "" {
+		return newID
+	}
+	return id
+}
+
+// idTaken checks if id is used by a book or an alias, caller must hold the lock
+func (db *FlatDB) idTaken(id string) bool {
+	return db.mapperID[id] != nil || db.aliases[id] != ""
+}
+
+// Rekey gives new id to books with id shorter than IDLength, old id is kept as alias.
+// cached thumbnails in cacheDir are renamed to the new id. returns number of books rekeyed
+func (db *FlatDB) Rekey(cacheDir string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	renamed := map[string]string{}
+	used := map[string]bool{}
+	for _, book := range db.books {
+		if len(book.ID) >= db.IDLength {
+			continue
+		}
+
+		newID := genChar(db.IDLength)
+		for db.idTaken(newID) || used[newID] {
+			newID = genChar(db.IDLength)
+		}
+		used[newID] = true
+		renamed[book.ID] = newID
+	}
+	if len(renamed) == 0 {
+		return 0, nil
+	}
+
+	// alias of alias follows to the newest id
+	for old, cur := range db.aliases {
+		if newID, ok := renamed[cur]; ok {
+			db.aliases[old] = newID
+		}
+	}
+	for old, newID := range renamed {
+		db.aliases[old] = newID
+	}
+	// alias is saved first, so interrupted rekey still resolves
+	err := db.saveAliases()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, book := range db.books {
+		if newID, ok := renamed[book.ID]; ok {
+			book.ID = newID
+		}
+	}
+	err = db.reindex()
+	if err != nil {
+		return 0, err
+	}
+
+	if cacheDir != "" {
+		for old, newID := range renamed {
+			err := os.Rename(filepath.Join(cacheDir, old+".jpg"), filepath.Join(cacheDir, newID+".jpg"))
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("failed to rename thumbnail", old, err)
+			}
+		}
+	}
+	log.Println("rekeyed books", len(renamed))
+
+	return len(renamed), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+	cacheDir := filepath.Join(dir, "cache")
+	err := os.Mkdir(cacheDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// books from before longer id, with cached thumbnails
+	db.IDLength = FlatDBIDLengthMin
+	olds := []string{}
+	for _, name := range []string{"[Author] Title 01.cbz", "[Author] Title 02.cbz", "[Author] Title 03.cbz"} {
+		fpath := filepath.Join(dir, name)
+		writeTestBook(t, fpath, 5)
+		book, err := db.AddFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(book.ID) != FlatDBIDLengthMin {
+			t.Fatalf("id %s, want %d chars", book.ID, FlatDBIDLengthMin)
+		}
+		err = ioutil.WriteFile(filepath.Join(cacheDir, book.ID+".jpg"), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		olds = append(olds, book.ID)
+	}
+	_, err = db.UpdatePage(olds[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alias from earlier change follows to the newest id
+	err = ioutil.WriteFile(aliasPath(db.Path), []byte("legacy,"+olds[0]+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	n, err := db.Rekey(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(olds) {
+		t.Errorf("rekeyed %d, want %d", n, len(olds))
+	}
+
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	news := []string{}
+	for i, old := range olds {
+		book := db.GetBookByID(old)
+		if book == nil {
+			t.Fatalf("old id %s not found", old)
+		}
+		if len(book.ID) != FlatDBIDLength {
+			t.Errorf("old id %s gives %s, want %d chars", old, book.ID, FlatDBIDLength)
+		}
+		news = append(news, book.ID)
+
+		// thumbnail follows the id
+		thumb, err := ioutil.ReadFile(filepath.Join(cacheDir, book.ID+".jpg"))
+		if err != nil || string(thumb) != filepath.Base(book.Fullpath) {
+			t.Errorf("thumbnail of %s: %q %v", book.ID, thumb, err)
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, old+".jpg")); !os.IsNotExist(err) {
+			t.Errorf("old thumbnail %s still there, %v", old, err)
+		}
+
+		_, err = db.UpdatePage(old, 10+i)
+		if err != nil {
+			t.Fatalf("update by old id %s: %v", old, err)
+		}
+	}
+	if book := db.GetBookByID("legacy"); book == nil || book.ID != news[0] {
+		t.Errorf("alias of alias gives %+v, want %s", book, news[0])
+	}
+
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	for i, id := range news {
+		if book := db.GetBookByID(id); book.Page != int64(10+i) {
+			t.Errorf("%s: page %d, want %d", id, book.Page, 10+i)
+		}
+	}
+
+	// nothing left to rekey
+	n, err = db.Rekey(cacheDir)
+	if err != nil || n != 0 {
+		t.Errorf("rekeyed %d again, %v", n, err)
+	}
+}
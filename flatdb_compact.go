@@ -0,0 +1,112 @@
+package main
+
+// remove records of books that are gone from flat file db
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"time"
+)
+
+// CompactReport is the result of db compaction
+type CompactReport struct {
+	Checked int // records checked
+	Missing int // records with book file gone
+	Purged  int // records removed from db, and archived
+}
+
+// archivePath gives file path where purged records are kept
+func archivePath(dbPath string) string {
+	return dbPath + ".purged"
+}
+
+// Compact checks every book file, records missing longer than the grace period are moved to archive file,
+// then the db file is rewritten and index rebuilt
+func (db *FlatDB) Compact(grace time.Duration) (*CompactReport, error) {
+	report := &CompactReport{}
+
+	// check files without holding the lock, stat can be slow on network drive
+	db.mutex.RLock()
+	paths := make(map[string]string, len(db.books))
+	for _, book := range db.books {
+		paths[book.ID] = book.Fullpath
+	}
+	db.mutex.RUnlock()
+
+	conds := make(map[string]int64, len(paths))
+	for id, fpath := range paths {
+		conds[id] = bookCond(fpath)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now().Unix()
+	kept := []*Book{}
+	purged := []*Book{}
+	for _, book := range db.books {
+		report.Checked++
+
+		cond, ok := conds[book.ID]
+		if !ok {
+			// added while checking
+			kept = append(kept, book)
+			continue
+		}
+
+		book.Cond = cond
+		if cond != 2 {
+			book.Gtime = 0
+			kept = append(kept, book)
+			continue
+		}
+
+		report.Missing++
+		if book.Gtime == 0 {
+			book.Gtime = now
+		}
+		if now-book.Gtime < int64(grace.Seconds()) {
+			kept = append(kept, book)
+			continue
+		}
+
+		purged = append(purged, book)
+	}
+
+	// keep the purged records, in case file comes back
+	if len(purged) > 0 {
+		f, err := os.OpenFile(archivePath(db.Path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return report, err
+		}
+		defer f.Close()
+
+		buf := bytes.Buffer{}
+		// every batch gets the layout version, same as db file. records below a header are in its layout,
+		// earlier batches could be from older version
+		buf.WriteString(flatDBSchemas[FlatDBSchemaVersion].header())
+		for _, book := range purged {
+			buf.Write(bookToCSV(book))
+			log.Println("purged book", book.ID, book.Fullpath)
+		}
+		_, err = f.Write(buf.Bytes())
+		if err != nil {
+			return report, err
+		}
+		err = f.Sync()
+		if err != nil {
+			return report, err
+		}
+		report.Purged = len(purged)
+	}
+
+	// rebuild index then save, missing time is saved too
+	db.books = kept
+	err := db.reindex()
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompactArchiveHeaderPerBatch(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	for _, name := range []string{"[Author] Title 01.cbz", "[Author] Title 02.cbz"} {
+		fpath := filepath.Join(dir, name)
+		writeTestBook(t, fpath, 3)
+		_, err := db.AddFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Remove(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Compact(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dat, err := ioutil.ReadFile(archivePath(db.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each record is read in the layout of the header above it
+	var schema *flatDBSchema
+	headers, books := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(string(dat)), "\n") {
+		if strings.HasPrefix(line, FlatDBSchemaHeader) {
+			schema, err = parseSchemaHeader(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers++
+			continue
+		}
+		if schema == nil {
+			t.Fatalf("record before header %q", line)
+		}
+		_, err = lineToBook(schema, line)
+		if err != nil {
+			t.Errorf("%v %q", err, line)
+		}
+		books++
+	}
+	if headers != 2 || books != 2 {
+		t.Errorf("%d headers, %d books, want 2 each", headers, books)
+	}
+}
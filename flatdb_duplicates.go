@@ -0,0 +1,179 @@
+package main
+
+// find same book stored more than once in the library
+
+import (
+	"log"
+	"path"
+	"sort"
+	"sync"
+)
+
+// duplicate group kinds
+const (
+	duplicateByHash  = "content"
+	duplicateByTitle = "title"
+)
+
+// DuplicateGroup is books that look like the same book
+type DuplicateGroup struct {
+	By    string  // matched by content fingerprint or title and number
+	Key   string  // fingerprint, or title and number
+	Books []*Book // at least 2
+}
+
+// fillHashesLogEvery is how often progress of FillHashes is logged, in books read
+const fillHashesLogEvery = 500
+
+// FillHashes gives content fingerprint and ComicInfo to books that do not have fingerprint yet,
+// e.g. added before fingerprint existed or cleared by schema migration. book files are read by
+// the number of workers, same as scan. returns number of books filled
+func (db *FlatDB) FillHashes(workers int) (int, error) {
+	db.mutex.RLock()
+	paths := map[string]string{}
+	for _, book := range db.books {
+		if book.Hash == "" {
+			paths[book.ID] = book.Fullpath
+		}
+	}
+	db.mutex.RUnlock()
+
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	log.Println("fingerprinting books", len(paths))
+
+	// read zip without holding the lock
+	type result struct {
+		id   string
+		hash string
+		info ComicInfo
+		err  error
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan result)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				_, hash, info, err := cbzRead(paths[id])
+				results <- result{id: id, hash: hash, info: info, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for id := range paths {
+			jobs <- id
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	hashes := map[string]result{}
+	seen := 0
+	for r := range results {
+		seen++
+		if seen%fillHashesLogEvery == 0 {
+			log.Println("fingerprinted", seen, "of", len(paths))
+		}
+		if r.err != nil {
+			continue
+		}
+		hashes[r.id] = r
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for id, r := range hashes {
+		book := db.mapperID[id]
+		if book != nil {
+			book.Hash = r.hash
+			book.Info = r.info
+			fname := path.Base(book.Fullpath)
+			book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+		}
+	}
+	log.Println("fingerprinted books", len(hashes))
+
+	return len(hashes), db.reindex()
+}
+
+// Duplicates groups copies of books with same content fingerprint, and books with same title and number
+func (db *FlatDB) Duplicates() []*DuplicateGroup {
+	return findDuplicates(db.Books())
+}
+
+// findDuplicates groups the books by content fingerprint, then by title and number. works on books of any backend
+func findDuplicates(books []*Book) []*DuplicateGroup {
+	groups := []*DuplicateGroup{}
+
+	byHash := map[string][]*Book{}
+	byTitle := map[string][]*Book{}
+	for _, book := range books {
+		byTitle[book.Title] = append(byTitle[book.Title], book)
+		if book.Hash == "" {
+			continue
+		}
+		byHash[book.Hash] = append(byHash[book.Hash], book)
+	}
+	for hash, books := range byHash {
+		if len(books) < 2 {
+			continue
+		}
+		groups = append(groups, &DuplicateGroup{
+			By:    duplicateByHash,
+			Key:   hash,
+			Books: books,
+		})
+	}
+
+	for title, books := range byTitle {
+		if title == "" || len(books) < 2 {
+			continue
+		}
+
+		byNumber := map[string][]*Book{}
+		for _, book := range books {
+			byNumber[book.Number] = append(byNumber[book.Number], book)
+		}
+		for number, books2 := range byNumber {
+			if len(books2) < 2 {
+				continue
+			}
+			groups = append(groups, &DuplicateGroup{
+				By:    duplicateByTitle,
+				Key:   title + " " + number,
+				Books: books2,
+			})
+		}
+	}
+
+	// stable listing, content match first
+	keys := naturalKeys{}
+	for _, group := range groups {
+		books := group.Books
+		sort.Slice(books, func(i, j int) bool {
+			return keys.less(books[i].Fullpath, books[j].Fullpath)
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].By != groups[j].By {
+			return groups[i].By == duplicateByHash
+		}
+		return keys.less(groups[i].Key, groups[j].Key)
+	})
+
+	return groups
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			// same file in two dirs, same title and number with other content, and a book of its own
+			fpaths := []string{
+				filepath.Join(dir, "a", "[Oda] One Piece 01.cbz"),
+				filepath.Join(dir, "b", "[Oda] One Piece 01.cbz"),
+				filepath.Join(dir, "c", "[Oda] One Piece 01.cbz"),
+				filepath.Join(dir, "b", "[Oda] One Piece 02.cbz"),
+			}
+			for i, fpath := range fpaths {
+				err := os.MkdirAll(filepath.Dir(fpath), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages := 3
+				if i == 2 {
+					pages = 4
+				}
+				writeTestBook(t, fpath, pages)
+			}
+			_, err := db.AddFiles(fpaths)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			groups := findDuplicates(db.Books())
+			if len(groups) != 2 {
+				t.Fatalf("%d groups, want 2", len(groups))
+			}
+			if groups[0].By != duplicateByHash || len(groups[0].Books) != 2 || groups[0].Books[0].Fullpath != fpaths[0] {
+				t.Errorf("content group %+v", groups[0])
+			}
+			if groups[1].By != duplicateByTitle || len(groups[1].Books) != 3 {
+				t.Errorf("title group %s %s, %d books", groups[1].By, groups[1].Key, len(groups[1].Books))
+			}
+		})
+	}
+}
+
+func TestFillHashes(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	hashes := map[string]string{}
+	for i := 1; i <= 10; i++ {
+		fpath := filepath.Join(dir, fmt.Sprintf("[Oda] One Piece %02d.cbz", i))
+		writeTestBook(t, fpath, i)
+		book, err := db.AddFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[book.ID] = book.Hash
+	}
+	// cleared, as migration does
+	for _, book := range db.books {
+		book.Hash = ""
+	}
+
+	n, err := db.FillHashes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(hashes) {
+		t.Errorf("filled %d, want %d", n, len(hashes))
+	}
+	for _, db := range []Library{db, reopenTestLibrary(t, db)} {
+		for id, hash := range hashes {
+			if book := db.GetBookByID(id); book.Hash != hash {
+				t.Errorf("%s: hash %q, want %q", id, book.Hash, hash)
+			}
+		}
+	}
+
+	// nothing left to fill
+	n, err = db.FillHashes(3)
+	if err != nil || n != 0 {
+		t.Errorf("filled %d again, %v", n, err)
+	}
+}
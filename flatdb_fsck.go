@@ -0,0 +1,253 @@
+package main
+
+// check and repair flat file db
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsckBadSuffix is added to db file path for the file unreadable lines are moved to on fix
+const FsckBadSuffix = ".bad"
+
+// FsckReport is the result of db file check
+type FsckReport struct {
+	Records    int // record lines scanned
+	BadLines   int // lines that cannot be parsed
+	Misaligned int // records with column position drifted
+	DupIDs     int // records with id already used
+	DupPaths   int // records with file path already used
+	Missing    int // records with book file gone
+	Fixed      bool
+}
+
+// Problems gives number of problems that can be fixed by rewrite
+func (r *FsckReport) Problems() int {
+	return r.BadLines + r.Misaligned + r.DupIDs + r.DupPaths
+}
+
+// FsckFlatDB scans db file of the config and reports bad records to w.
+// with fix, db file is rewritten in canonical form, the original is kept as .fsck.bak and unreadable lines are moved to .bad.
+// id dropped or changed by the fix is kept as alias, same as rekey
+func FsckFlatDB(cfg *Config, fix bool, w io.Writer) (*FsckReport, error) {
+	report := &FsckReport{}
+	dbPath := cfg.PathDB
+
+	// for id and alias, books are only indexed on fix
+	db := &FlatDB{}
+	db.New(dbPath)
+	if cfg.IDLength >= FlatDBIDLengthMin {
+		db.IDLength = cfg.IDLength
+	}
+	aliases, err := loadAliases(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db.aliases = aliases
+
+	dat, err := ioutil.ReadFile(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(dat), "\n")
+
+	schema := flatDBSchemas[FlatDBSchemaVersion]
+	if len(dat) > 0 {
+		schema, err = parseSchemaHeader(lines[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// unfinished in-place changes
+	if isExist, _ := IsFileExists(journalPath(dbPath)); isExist {
+		if fix {
+			n, err := replayJournal(dbPath, schema)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(w, "journal replayed %d entries\n", n)
+
+			dat, err = ioutil.ReadFile(dbPath)
+			if err != nil {
+				return nil, err
+			}
+			lines = strings.Split(string(dat), "\n")
+		} else {
+			fmt.Fprintln(w, "journal exists, it will be replayed on next load or with --fix")
+		}
+	}
+
+	// ids of every record, new id must not take one of a later line
+	seenIDs := map[string]bool{}
+	for _, line := range lines {
+		if len(line) > 0 && line[0:1] != "#" {
+			seenIDs[strings.SplitN(line, ",", 2)[0]] = true
+		}
+	}
+
+	// books to keep on fix, and where they were first seen
+	books := []*Book{}
+	// old id to current id of the records dropped or given new id
+	renamed := map[string]string{}
+	lineByID := map[string]int{}
+	lineByPath := map[string]int{}
+	byID := map[string]*Book{}
+	byPath := map[string]*Book{}
+	// lines that cannot be read, moved out on fix
+	badLines := []string{}
+
+	for i, line := range lines {
+		lineNum := i + 1
+		if len(line) == 0 || line[0:1] == "#" {
+			continue
+		}
+		report.Records++
+
+		// same parsing as load, so line reported bad here is the one load skips
+		book, err := lineToBook(schema, line)
+		if err != nil {
+			report.BadLines++
+			badLines = append(badLines, line)
+			fmt.Fprintf(w, "line %d: %v\n", lineNum, err)
+			continue
+		}
+
+		if !schema.validCommaPos(line) {
+			report.Misaligned++
+			fmt.Fprintf(w, "line %d: %v, id %s\n", lineNum, ErrDBColumnChanged, book.ID)
+		}
+
+		if isExist, _ := IsFileExists(book.Fullpath); !isExist {
+			report.Missing++
+			fmt.Fprintf(w, "line %d: file missing, id %s %s\n", lineNum, book.ID, book.Fullpath)
+		}
+
+		// same file recorded twice, keep the one read most recently
+		if prev := byPath[book.Fullpath]; prev != nil {
+			report.DupPaths++
+			fmt.Fprintf(w, "line %d: duplicate path, id %s same as line %d %s\n", lineNum, book.ID, lineByPath[book.Fullpath], book.Fullpath)
+
+			// id of the dropped record follows to the kept one, unless other book has it
+			if book.ID != prev.ID && byID[book.ID] == nil {
+				renamed[book.ID] = prev.ID
+			}
+			if book.Rtime > prev.Rtime {
+				// take over the place of previous record
+				book.ID = prev.ID
+				*prev = *book
+			}
+			continue
+		}
+
+		// same id used by different file, new id will be given on fix
+		if byID[book.ID] != nil {
+			report.DupIDs++
+			fmt.Fprintf(w, "line %d: duplicate id %s, first used on line %d\n", lineNum, book.ID, lineByID[book.ID])
+
+			old := book.ID
+			for byID[book.ID] != nil || seenIDs[book.ID] || db.idTaken(book.ID) {
+				book.ID = genChar(db.IDLength)
+			}
+			seenIDs[book.ID] = true
+			// first record keeps the id, alias takes effect once that one is gone
+			renamed[old] = book.ID
+		}
+
+		byID[book.ID] = book
+		byPath[book.Fullpath] = book
+		lineByID[book.ID] = lineNum
+		lineByPath[book.Fullpath] = lineNum
+		books = append(books, book)
+	}
+
+	fmt.Fprintf(w, "%d records, %d bad, %d misaligned, %d duplicate id, %d duplicate path, %d missing file\n",
+		report.Records, report.BadLines, report.Misaligned, report.DupIDs, report.DupPaths, report.Missing)
+
+	if !fix {
+		return report, nil
+	}
+	if report.Problems() == 0 && schema.Version == FlatDBSchemaVersion {
+		fmt.Fprintln(w, "nothing to fix")
+		return report, nil
+	}
+
+	bakPath := dbPath + ".fsck.bak"
+	err = ioutil.WriteFile(bakPath, dat, 0644)
+	if err != nil {
+		return report, err
+	}
+
+	// keep unreadable lines for hand repair, appended so earlier ones stay
+	if len(badLines) > 0 {
+		err = appendLines(dbPath+FsckBadSuffix, badLines)
+		if err != nil {
+			return report, err
+		}
+		fmt.Fprintf(w, "%d bad lines moved to %s\n", len(badLines), dbPath+FsckBadSuffix)
+	}
+
+	// alias is saved first, same as rekey, so links keep working if rewrite is interrupted
+	if len(renamed) > 0 {
+		// alias of alias follows to the newest id
+		for old, cur := range db.aliases {
+			if newID, ok := renamed[cur]; ok {
+				db.aliases[old] = newID
+			}
+		}
+		for old, newID := range renamed {
+			db.aliases[old] = newID
+		}
+		err = db.saveAliases()
+		if err != nil {
+			return report, err
+		}
+		fmt.Fprintf(w, "%d changed ids kept in %s\n", len(renamed), aliasPath(dbPath))
+	}
+
+	// rewrite in canonical fixed width form
+	for _, book := range books {
+		db.indexBook(book, 0, 0)
+	}
+	err = db.Export(dbPath)
+	if err != nil {
+		return report, err
+	}
+	report.Fixed = true
+	fmt.Fprintf(w, "db rewritten with %d records, original kept as %s\n", len(books), bakPath)
+
+	// dropped record was the same file, its thumbnail is of the kept one
+	if cfg.PathCache != "" {
+		for old, newID := range renamed {
+			if byID[old] != nil {
+				continue
+			}
+			err := os.Rename(filepath.Join(cfg.PathCache, old+".jpg"), filepath.Join(cfg.PathCache, newID+".jpg"))
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("failed to rename thumbnail", old, err)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// appendLines adds lines to the end of file, file is created if not exist
+func appendLines(fpath string, lines []string) error {
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsckFix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamishibai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		PathDB:    filepath.Join(dir, "db.txt"),
+		PathCache: filepath.Join(dir, "cache"),
+		IDLength:  12,
+	}
+	err = os.Mkdir(cfg.PathCache, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := func(id, fpath string, page, rtime int64) string {
+		return strings.TrimSuffix(string(bookToCSV(&Book{ID: id, Fullpath: fpath, Pages: 9, Page: page, Rtime: rtime})), "\n")
+	}
+	misaligned := strings.Replace(line("ffffffffff", "/books/f.cbz", 0, 0), ",0009,0000,", ",0009,00000,", 1)
+	lines := []string{
+		strings.TrimSuffix(flatDBSchemas[FlatDBSchemaVersion].header(), "\n"),
+		line("aaaaaaaaaa", "/books/a.cbz", 1, 100),
+		line("bbbbbbbbbb", "/books/b.cbz", 2, 100),
+		"garbage",
+		line("aaaaaaaaaa", "/books/c.cbz", 3, 100), // duplicate id
+		line("dddddddddd", "/books/a.cbz", 5, 200), // duplicate path, newer
+		line("eeeeeeeeee", "/books/b.cbz", 7, 50),  // duplicate path, older
+		misaligned,
+	}
+	orig := strings.Join(lines, "\n") + "\n"
+	err = ioutil.WriteFile(cfg.PathDB, []byte(orig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(aliasPath(cfg.PathDB), []byte("old,dddddddddd\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"dddddddddd", "eeeeeeeeee"} {
+		err = ioutil.WriteFile(filepath.Join(cfg.PathCache, id+".jpg"), []byte(id), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// check only
+	out := &bytes.Buffer{}
+	report, err := FsckFlatDB(cfg, false, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 7 || report.BadLines != 1 || report.Misaligned != 1 || report.DupIDs != 1 || report.DupPaths != 2 || report.Fixed {
+		t.Errorf("report %+v", report)
+	}
+	if dat, _ := ioutil.ReadFile(cfg.PathDB); string(dat) != orig {
+		t.Error("db changed without fix")
+	}
+
+	out.Reset()
+	report, err = FsckFlatDB(cfg, true, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Fixed {
+		t.Fatalf("not fixed\n%s", out)
+	}
+	for _, s := range []string{"line 4:", "line 5: duplicate id aaaaaaaaaa", "line 6: duplicate path", "line 8: db column has changed", "1 bad lines moved", "3 changed ids kept", "db rewritten with 4 records"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output has no %q\n%s", s, out)
+		}
+	}
+	if dat, _ := ioutil.ReadFile(cfg.PathDB + ".fsck.bak"); string(dat) != orig {
+		t.Error("original not kept")
+	}
+	if dat, _ := ioutil.ReadFile(cfg.PathDB + FsckBadSuffix); string(dat) != "garbage\n" {
+		t.Errorf("bad lines %q", dat)
+	}
+	// thumbnail of dropped record is the same file
+	for id, want := range map[string]string{"aaaaaaaaaa": "dddddddddd", "bbbbbbbbbb": "eeeeeeeeee"} {
+		if dat, _ := ioutil.ReadFile(filepath.Join(cfg.PathCache, id+".jpg")); string(dat) != want {
+			t.Errorf("thumbnail %s is %q, want %q", id, dat, want)
+		}
+	}
+
+	db := &FlatDB{}
+	db.New(cfg.PathDB)
+	err = db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Count() != 4 {
+		t.Errorf("%d books, want 4", db.Count())
+	}
+	// newer duplicate kept under first id, dropped ids follow to the kept record
+	cases := map[string]struct {
+		id   string
+		page int64
+	}{
+		"aaaaaaaaaa": {"aaaaaaaaaa", 5},
+		"dddddddddd": {"aaaaaaaaaa", 5},
+		"old":        {"aaaaaaaaaa", 5},
+		"eeeeeeeeee": {"bbbbbbbbbb", 2},
+	}
+	for id, want := range cases {
+		book := db.GetBookByID(id)
+		if book == nil || book.ID != want.id || book.Page != want.page {
+			t.Errorf("%s: %+v, want %s page %d", id, book, want.id, want.page)
+		}
+	}
+	c := db.GetBookByPath("/books/c.cbz")
+	if c == nil || len(c.ID) != cfg.IDLength || c.Page != 3 {
+		t.Errorf("duplicate id given %+v", c)
+	}
+	// realigned record takes in-place update
+	_, err = db.UpdatePage("ffffffffff", 4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	out.Reset()
+	report, err = FsckFlatDB(cfg, true, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Problems() != 0 || report.Fixed {
+		t.Errorf("fixed db has problems %+v\n%s", report, out)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+// write-ahead journal for the in-place record patches of flat file db
+//
+// each patch is written to the journal and synced before the db file is touched,
+// so an unclean shutdown in the middle of patch can be redone on next load.
+// entry line format
+//   {book id},{byte address},{hex data},{crc32 of previous columns}
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FlatDBJournalMaxEntries is number of journal entries kept before db file is synced and journal is cleared
+const FlatDBJournalMaxEntries = 500
+
+// errors for journal
+var (
+	ErrJournalEntry = errors.New("invalid journal entry")
+)
+
+// journalPatch is one in-place change to the db file
+type journalPatch struct {
+	ID      string // book id of the record, use to verify record is still at the address
+	Address int64  // absolute byte position in db file
+	Data    []byte // bytes to write
+}
+
+// journalPath gives journal file path of the db
+func journalPath(dbPath string) string {
+	return dbPath + ".journal"
+}
+
+// encode journal entry line, with newline
+func (p journalPatch) encode() string {
+	s := fmt.Sprintf("%s,%d,%s", p.ID, p.Address, hex.EncodeToString(p.Data))
+	return fmt.Sprintf("%s,%08x\n", s, crc32.ChecksumIEEE([]byte(s)))
+}
+
+// decodeJournalPatch parse journal entry line, torn or garbled line gives error
+func decodeJournalPatch(line string) (journalPatch, error) {
+	p := journalPatch{}
+
+	i := strings.LastIndex(line, ",")
+	if i < 0 {
+		return p, ErrJournalEntry
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(line[:i]))) != line[i+1:] {
+		return p, ErrJournalEntry
+	}
+
+	cols := strings.Split(line[:i], ",")
+	if len(cols) != 3 {
+		return p, ErrJournalEntry
+	}
+
+	addr, err := strconv.ParseInt(cols[1], 10, 64)
+	if err != nil {
+		return p, ErrJournalEntry
+	}
+	dat, err := hex.DecodeString(cols[2])
+	if err != nil {
+		return p, ErrJournalEntry
+	}
+
+	p.ID = cols[0]
+	p.Address = addr
+	p.Data = dat
+
+	return p, nil
+}
+
+// patch writes the changes to journal first then to db file. caller must hold the lock
+func (db *FlatDB) patch(patches ...journalPatch) (writeSize int, err error) {
+	jf, err := os.OpenFile(journalPath(db.Path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer jf.Close()
+
+	buf := ""
+	for _, p := range patches {
+		buf += p.encode()
+	}
+	_, err = jf.WriteString(buf)
+	if err != nil {
+		return 0, err
+	}
+	// journal must be on disk before db file is modified
+	err = jf.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	for _, p := range patches {
+		n, err := f.WriteAt(p.Data, p.Address)
+		if err != nil {
+			return writeSize, err
+		}
+		writeSize += n
+	}
+
+	db.writes++
+	db.journalEntries += len(patches)
+	if db.journalEntries < FlatDBJournalMaxEntries {
+		return writeSize, nil
+	}
+
+	// checkpoint, db file is durable so journal is no longer needed
+	err = f.Sync()
+	if err != nil {
+		return writeSize, err
+	}
+	err = jf.Truncate(0)
+	if err != nil {
+		return writeSize, err
+	}
+	db.journalEntries = 0
+
+	return writeSize, nil
+}
+
+// replayJournal redo the journal entries on db file, then remove the journal.
+// entries that no longer match the record at the address are discarded, returns number of entries redone
+func replayJournal(dbPath string, schema *flatDBSchema) (int, error) {
+	jpath := journalPath(dbPath)
+
+	jf, err := os.Open(jpath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer jf.Close()
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fstat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	i := 0
+	scanner := bufio.NewScanner(jf)
+	for scanner.Scan() {
+		p, err := decodeJournalPatch(scanner.Text())
+		if err != nil {
+			// torn write at the end of journal, rest is not trustworthy
+			log.Println("journal, discard incomplete entry")
+			break
+		}
+
+		// make sure the record is still the same book, e.g. db file was exported after the entry
+		start, end := recordBounds(f, p.Address, fstat.Size())
+		if end-start < int64(len(p.ID))+1 {
+			continue
+		}
+		b := make([]byte, end-start)
+		_, err = f.ReadAt(b, start)
+		if err != nil {
+			return i, err
+		}
+		if !strings.HasPrefix(string(b), p.ID+",") || !schema.validCommaPos(string(b)) {
+			continue
+		}
+		if p.Address+int64(len(p.Data)) > end {
+			continue
+		}
+
+		_, err = f.WriteAt(p.Data, p.Address)
+		if err != nil {
+			return i, err
+		}
+		i++
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return i, err
+	}
+
+	jf.Close()
+	err = os.Remove(jpath)
+	if err != nil {
+		return i, err
+	}
+
+	return i, nil
+}
+
+// recordBoundsChunk is number of bytes read at a time when looking for the line ends
+const recordBoundsChunk = 4096
+
+// recordBounds finds the start and end byte position of the line that contains the address
+func recordBounds(f *os.File, address, size int64) (start, end int64) {
+	if address < 0 || address >= size {
+		return 0, 0
+	}
+
+	b := make([]byte, recordBoundsChunk)
+
+	// backward to newline before the address
+	start = 0
+	for pos := address; pos > 0; {
+		n := int64(len(b))
+		if n > pos {
+			n = pos
+		}
+		_, err := f.ReadAt(b[:n], pos-n)
+		if err != nil {
+			start = pos
+			break
+		}
+		if i := bytes.LastIndexByte(b[:n], '\n'); i >= 0 {
+			start = pos - n + int64(i) + 1
+			break
+		}
+		pos -= n
+	}
+
+	// forward to newline at or after the address
+	end = size
+	for pos := address; pos < size; {
+		n := int64(len(b))
+		if n > size-pos {
+			n = size - pos
+		}
+		_, err := f.ReadAt(b[:n], pos)
+		if err != nil {
+			end = pos
+			break
+		}
+		if i := bytes.IndexByte(b[:n], '\n'); i >= 0 {
+			end = pos + int64(i)
+			break
+		}
+		pos += n
+	}
+
+	return start, end
+}
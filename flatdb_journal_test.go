@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kamishibai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lines longer than a chunk
+	lines := []string{"a", strings.Repeat("b", recordBoundsChunk*2+5), "", strings.Repeat("c", recordBoundsChunk), "d"}
+	fpath := filepath.Join(dir, "db.txt")
+	err = ioutil.WriteFile(fpath, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fstat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos := int64(0)
+	for _, line := range lines {
+		start, end := pos, pos+int64(len(line))
+		for _, addr := range []int64{start, (start + end) / 2, end - 1} {
+			if addr < start {
+				continue
+			}
+			s, e := recordBounds(f, addr, fstat.Size())
+			if s != start || e != end {
+				t.Errorf("line %.5q at %d: %d-%d, want %d-%d", line, addr, s, e, start, end)
+			}
+		}
+		pos = end + 1
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	fpath := filepath.Join(dir, "[Author] Title 01.cbz")
+	writeTestBook(t, fpath, 9)
+	book, err := db.AddFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crashed after journal is written, before the db file is patched
+	ibook := db.mapperIID[book.ID]
+	p := journalPatch{
+		ID:      book.ID,
+		Address: int64(ibook.Address) + int64(db.schema.offset(len(book.ID), flatDBColPage)),
+		Data:    []byte(fmt.Sprintf(FlatDBCharsPage, 7)),
+	}
+	// torn entry at the end is discarded
+	journal := p.encode() + p.encode()[:10]
+	err = ioutil.WriteFile(journalPath(db.Path), []byte(journal), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	if got := db.GetBookByID(book.ID); got.Page != 7 {
+		t.Errorf("page %d, want 7", got.Page)
+	}
+	if _, err := os.Stat(journalPath(db.Path)); !os.IsNotExist(err) {
+		t.Errorf("journal not removed, %v", err)
+	}
+
+	// entry for a record no longer at the address is not applied
+	p.ID = "other"
+	p.Data = []byte(fmt.Sprintf(FlatDBCharsPage, 3))
+	err = ioutil.WriteFile(journalPath(db.Path), []byte(p.encode()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	if got := db.GetBookByID(book.ID); got.Page != 7 {
+		t.Errorf("page %d after stale entry, want 7", got.Page)
+	}
+}
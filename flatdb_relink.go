@@ -0,0 +1,192 @@
+package main
+
+// moved or renamed book detection
+//
+// new file that looks like a book that has gone missing takes over the old record,
+// so the id and reading progress (page, fav, ranking, read time) carry over.
+// matched by device and inode with same size or file name, then by file name and size, then by content fingerprint.
+// inode alone is not enough, deleted book's inode can be given to an unrelated new file
+
+import (
+	"log"
+	"os"
+	"path"
+	"strconv"
+)
+
+// relinkIndex groups books by the file attributes that survive a move
+type relinkIndex struct {
+	byInode    map[string][]*Book
+	byNameSize map[string][]*Book
+	byHash     map[string][]*Book
+	claimed    map[*Book]bool // books already relinked in this pass
+}
+
+// inodeKey key for finding book by device and inode, blank if either is not known
+func inodeKey(dev, inode int64) string {
+	if dev == 0 || inode == 0 {
+		return ""
+	}
+	return strconv.FormatInt(dev, 10) + ":" + strconv.FormatInt(inode, 10)
+}
+
+// inodeConfirmed tells if book found by inode is the file, size or file name must be the same too
+func inodeConfirmed(book *Book, fpath string, size int64) bool {
+	return book.Size == size || path.Base(book.Fullpath) == path.Base(fpath)
+}
+
+// nameSizeKey key for finding book by file name and size
+func nameSizeKey(fpath string, size int64) string {
+	return path.Base(fpath) + "\x00" + strconv.FormatInt(size, 10)
+}
+
+// newRelinkIndex builds index of copies of the books, caller must hold the lock of the db the books are from
+func newRelinkIndex(books []*Book) *relinkIndex {
+	idx := &relinkIndex{
+		byInode:    make(map[string][]*Book),
+		byNameSize: make(map[string][]*Book),
+		byHash:     make(map[string][]*Book),
+		claimed:    make(map[*Book]bool),
+	}
+
+	for _, book := range books {
+		book = copyBook(book)
+		if key := inodeKey(book.Dev, book.Inode); key != "" {
+			idx.byInode[key] = append(idx.byInode[key], book)
+		}
+		key := nameSizeKey(book.Fullpath, book.Size)
+		idx.byNameSize[key] = append(idx.byNameSize[key], book)
+		if book.Hash != "" {
+			idx.byHash[book.Hash] = append(idx.byHash[book.Hash], book)
+		}
+	}
+
+	return idx
+}
+
+// candidates gives books that could be the file, by device and inode first then by name and size
+func (idx *relinkIndex) candidates(fpath string, fstat os.FileInfo) []*Book {
+	books := []*Book{}
+
+	if key := inodeKey(fileDevice(fstat), fileInode(fstat)); key != "" {
+		for _, book := range idx.byInode[key] {
+			if inodeConfirmed(book, fpath, fstat.Size()) {
+				books = append(books, book)
+			}
+		}
+	}
+	books = append(books, idx.byNameSize[nameSizeKey(fpath, fstat.Size())]...)
+
+	return books
+}
+
+// pickMoved picks the first candidate which file is gone, existing file means it is a copy not a move
+func pickMoved(candidates []*Book, fpath string, claimed map[*Book]bool) *Book {
+	for _, book := range candidates {
+		if book.Fullpath == fpath || claimed[book] {
+			continue
+		}
+		if bookCond(book.Fullpath) != 2 {
+			continue
+		}
+		return book
+	}
+
+	return nil
+}
+
+// stillMissing tells if the record is still the missing book found earlier, cond is not checked as
+// it is only updated by rescan. moved is the copy the file was matched against
+func stillMissing(book, moved *Book) bool {
+	return book != nil && book.Fullpath == moved.Fullpath
+}
+
+// relinkBook points the book record to the new file read by newBook, caller must hold the lock and reindex after
+func relinkBook(book, file *Book) {
+	log.Println("Relinked book", book.ID, book.Fullpath, "->", file.Fullpath)
+
+	// file could have been changed as well as moved
+	book.Fullpath = file.Fullpath
+	book.Pages = file.Pages
+	book.Hash = file.Hash
+	book.Info = file.Info
+	fname := path.Base(file.Fullpath)
+	book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+	book.Cond = 1
+	book.Gtime = 0
+	book.Size = file.Size
+	book.Inode = file.Inode
+	book.Dev = file.Dev
+	book.Mtime = file.Mtime
+}
+
+// Relink finds missing book that is the same as the file and moves the record to the file, nil if no match
+func (db *FlatDB) Relink(fpath string) (*Book, error) {
+	// zip is read before the lock
+	file, err := newBook(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.relink(file)
+}
+
+// relink moves the record of missing book to the file read by newBook, nil if no match
+func (db *FlatDB) relink(file *Book) (*Book, error) {
+	fpath := file.Fullpath
+	candidates := []*Book{}
+	for _, book := range db.SearchBookByInode(file.Dev, file.Inode) {
+		if inodeConfirmed(book, fpath, file.Size) {
+			candidates = append(candidates, book)
+		}
+	}
+	candidates = append(candidates, db.SearchBookByNameAndSize(path.Base(fpath), file.Size)...)
+
+	book := pickMoved(candidates, fpath, nil)
+	if book == nil {
+		book = pickMoved(db.SearchBookByHash(file.Hash), fpath, nil)
+	}
+	if book == nil {
+		return nil, nil
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// path was checked before the lock, could be added by other call since
+	if db.mapperPath[fpath] != nil {
+		return nil, ErrDupBook
+	}
+	// candidates are copies, apply to the record. could be relinked by other call since
+	moved := book
+	book = db.mapperID[moved.ID]
+	if !stillMissing(book, moved) {
+		return nil, nil
+	}
+	relinkBook(book, file)
+	err := db.reindex()
+	if err != nil {
+		return nil, err
+	}
+
+	return copyBook(book), nil
+}
+
+// reindex rebuild the index from books and save, needed after record changed in length. caller must hold the lock
+func (db *FlatDB) reindex() error {
+	books := db.books
+
+	// search index is kept, only changed books are put again
+	search := db.search
+	db.clear()
+	db.search = search
+	for _, book := range books {
+		db.indexBook(book, 0, 0)
+	}
+	search.retain(func(id string) bool {
+		return db.mapperID[id] != nil
+	})
+
+	// record address is set on export
+	return db.export(db.Path)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelinkCandidates(t *testing.T) {
+	_, dir := newTestLibrary(t, LibraryBackendFlat)
+
+	fpath := filepath.Join(dir, "new.cbz")
+	writeTestBook(t, fpath, 3)
+	fstat, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, inode := fileDevice(fstat), fileInode(fstat)
+	if dev == 0 || inode == 0 {
+		t.Skip("no device and inode on this platform")
+	}
+
+	cases := []struct {
+		name string
+		book *Book
+		want bool
+	}{
+		{"inode only", &Book{Fullpath: "/old/other.cbz", Size: fstat.Size() + 1, Dev: dev, Inode: inode}, false},
+		{"inode on other device", &Book{Fullpath: "/old/other.cbz", Size: fstat.Size(), Dev: dev + 1, Inode: inode}, false},
+		{"inode without device", &Book{Fullpath: "/old/other.cbz", Size: fstat.Size(), Inode: inode}, false},
+		{"inode and size", &Book{Fullpath: "/old/other.cbz", Size: fstat.Size(), Dev: dev, Inode: inode}, true},
+		{"inode and name", &Book{Fullpath: "/old/new.cbz", Size: fstat.Size() + 1, Dev: dev, Inode: inode}, true},
+		{"name and size", &Book{Fullpath: "/old/new.cbz", Size: fstat.Size()}, true},
+	}
+
+	for _, c := range cases {
+		found := newRelinkIndex([]*Book{c.book}).candidates(fpath, fstat)
+		if (len(found) > 0) != c.want {
+			t.Errorf("%s: %d candidates, want %v", c.name, len(found), c.want)
+		}
+	}
+}
+
+func TestRelinkMovedOffline(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			for _, add := range []string{"AddFile", "AddFiles"} {
+				t.Run(add, func(t *testing.T) {
+					db, dir := newTestLibrary(t, backend)
+
+					fpath := filepath.Join(dir, "[Author] Title 01.cbz")
+					writeTestBook(t, fpath, 5)
+					book, err := db.AddFile(fpath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					_, err = db.UpdatePage(book.ID, 4)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					// moved while server is down, cond is still 1 on reload
+					moved := filepath.Join(dir, "[Author] Title 01 moved.cbz")
+					err = os.Rename(fpath, moved)
+					if err != nil {
+						t.Fatal(err)
+					}
+					db = reopenTestLibrary(t, db)
+
+					switch add {
+					case "AddFile":
+						_, err = db.AddFile(moved)
+					case "AddFiles":
+						_, err = db.AddFiles([]string{moved})
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if db.Count() != 1 {
+						t.Errorf("%d books, want 1", db.Count())
+					}
+					got := db.GetBookByPath(moved)
+					if got == nil {
+						t.Fatal("moved book not found")
+					}
+					if got.ID != book.ID || got.Page != 4 {
+						t.Errorf("id %s page %d, want %s page 4", got.ID, got.Page, book.ID)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRelinkMovedBatch(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			fpaths := []string{
+				filepath.Join(dir, "[Author] Title 01.cbz"),
+				filepath.Join(dir, "[Author] Title 02.cbz"),
+				filepath.Join(dir, "[Author] Title 03.cbz"),
+			}
+			books := []*Book{}
+			for _, fpath := range fpaths {
+				writeTestBook(t, fpath, 5)
+				book, err := db.AddFile(fpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				books = append(books, book)
+			}
+
+			// all moved, first one also got more pages
+			err := os.Mkdir(filepath.Join(dir, "sub"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			moved := []string{}
+			for _, fpath := range fpaths {
+				mpath := filepath.Join(dir, "sub", filepath.Base(fpath))
+				err = os.Rename(fpath, mpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				moved = append(moved, mpath)
+			}
+			writeTestBook(t, moved[0], 8)
+			db = reopenTestLibrary(t, db)
+
+			_, err = db.AddFiles(moved)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, db := range []Library{db, reopenTestLibrary(t, db)} {
+				if db.Count() != len(fpaths) {
+					t.Errorf("%d books, want %d", db.Count(), len(fpaths))
+				}
+				for i, mpath := range moved {
+					got := db.GetBookByPath(mpath)
+					if got == nil {
+						t.Fatalf("%s not found", mpath)
+					}
+					if got.ID != books[i].ID {
+						t.Errorf("%s: id %s, want %s", mpath, got.ID, books[i].ID)
+					}
+				}
+				if got := db.GetBookByPath(moved[0]); got.Pages != 8 {
+					t.Errorf("changed book has %d pages, want 8", got.Pages)
+				}
+			}
+		})
+	}
+}
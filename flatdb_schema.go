@@ -0,0 +1,238 @@
+package main
+
+// flat file db layout versioning
+//
+// first line of db file tells the layout, e.g.
+//   #schema:1
+// file without the header is the original layout, version 0.
+// older layout is upgraded by the migrations on load, one version at a time
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FlatDBSchemaVersion is the db file layout written by this program
+const FlatDBSchemaVersion = 8
+
+// FlatDBSchemaHeader prefix of the first line that holds the layout version
+const FlatDBSchemaHeader = "#schema:"
+
+// errors for schema
+var (
+	ErrSchemaUnknown = errors.New("unknown db schema version")
+	ErrSchemaNewer   = errors.New("db schema is newer than supported")
+)
+
+// column index of the csv record
+const (
+	flatDBColID = iota
+	flatDBColCond
+	flatDBColPages
+	flatDBColPage
+	flatDBColRanking
+	flatDBColFav
+	flatDBColSize
+	flatDBColInode
+	flatDBColMtime
+	flatDBColItime
+	flatDBColRtime
+	flatDBColTitle
+	flatDBColAuthor
+	flatDBColNumber
+	flatDBColFullpath
+	flatDBColGtime
+	flatDBColHash
+	flatDBColMetaTitle
+	flatDBColMetaAuthor
+	flatDBColMetaNumber
+	flatDBColMetaSeries
+	flatDBColInfoTitle
+	flatDBColInfoSeries
+	flatDBColInfoNumber
+	flatDBColInfoAuthor
+	flatDBColInfoSummary
+	flatDBColInfoGenre
+	flatDBColInfoManga
+	flatDBColDev
+	flatDBColInfoPageCount
+	flatDBColInfoCover
+)
+
+// flatDBSchema describe the layout of a db file version
+type flatDBSchema struct {
+	Version int
+	Columns int   // number of columns in a record
+	Widths  []int // fixed width columns that follow the id column, in order
+}
+
+// flatDBSchemas known layouts, by version
+var flatDBSchemas = map[int]*flatDBSchema{
+	0: {
+		Version: 0,
+		Columns: 15,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	1: {
+		Version: 1,
+		Columns: 15,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	2: {
+		Version: 2,
+		Columns: 16,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	3: {
+		Version: 3,
+		Columns: 17,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	4: {
+		Version: 4,
+		Columns: 21,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	5: {
+		Version: 5,
+		Columns: 28,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	6: {
+		Version: 6,
+		Columns: 29,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	7: {
+		Version: 7,
+		Columns: 31,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 10, 10, 10, 10},
+	},
+	8: {
+		Version: 8,
+		Columns: 31,
+		Widths:  []int{1, 4, 4, 1, 1, 10, 20, 10, 10, 10},
+	},
+}
+
+// flatDBMigration upgrade the csv columns of a record to the next version
+type flatDBMigration func(records []string) ([]string, error)
+
+// flatDBMigrations upgrade a record from the version (key) to the next version
+var flatDBMigrations = map[int]flatDBMigration{
+	// 0 -> 1, same columns, only the header line is introduced
+	0: func(records []string) ([]string, error) {
+		return records, nil
+	},
+	// 1 -> 2, add Gtime, missing file time.
+	// Cond was not reliably stored before, mark as unknown until checked again
+	1: func(records []string) ([]string, error) {
+		records[flatDBColCond] = "0"
+		return append(records, fmt.Sprintf(FlatDBCharsEpoch, 0)), nil
+	},
+	// 2 -> 3, add Hash, content fingerprint. filled in later by FillHashes
+	2: func(records []string) ([]string, error) {
+		return append(records, ""), nil
+	},
+	// 3 -> 4, add user edited title, author, number, series
+	3: func(records []string) ([]string, error) {
+		return append(records, "", "", "", ""), nil
+	},
+	// 4 -> 5, add ComicInfo title, series, number, author, summary, genre, manga.
+	// Hash is cleared so FillHashes reads the book file again, ComicInfo is filled in at the same time
+	4: func(records []string) ([]string, error) {
+		records[flatDBColHash] = ""
+		return append(records, "", "", "", "", "", "", ""), nil
+	},
+	// 5 -> 6, add Dev, device of the inode. filled in by rescan, until then inode is not used to find moved book
+	5: func(records []string) ([]string, error) {
+		return append(records, "0"), nil
+	},
+	// 6 -> 7, add ComicInfo page count and cover page.
+	// Hash is cleared so FillHashes reads ComicInfo again
+	6: func(records []string) ([]string, error) {
+		records[flatDBColHash] = ""
+		return append(records, "0", "0"), nil
+	},
+	// 7 -> 8, Inode widened to 20 characters, 64 bit inode did not fit in 10.
+	// same columns, width is set when the record is written again
+	7: func(records []string) ([]string, error) {
+		return records, nil
+	},
+}
+
+// schemaHeader gives header line of the schema, with newline
+func (s *flatDBSchema) header() string {
+	return FlatDBSchemaHeader + strconv.Itoa(s.Version) + "\n"
+}
+
+// offset gives byte position of the fixed width column within the record, id length is needed because id comes first
+func (s *flatDBSchema) offset(idLen, col int) int {
+	pos := idLen + 1
+	for i := flatDBColCond; i < col; i++ {
+		pos += s.Widths[i-1] + 1
+	}
+	return pos
+}
+
+// validCommaPos check if csv line commas are still at the fixed column position
+func (s *flatDBSchema) validCommaPos(line string) bool {
+	idLen := strings.Index(line, ",")
+	if idLen <= 0 {
+		return false
+	}
+
+	for col := flatDBColCond; col <= len(s.Widths); col++ {
+		// comma after the column
+		pos := s.offset(idLen, col) + s.Widths[col-1]
+		if pos >= len(line) {
+			return false
+		}
+		// ascii 44 is comma
+		if line[pos] != 44 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSchemaHeader gives schema of db file from the first line
+func parseSchemaHeader(line string) (*flatDBSchema, error) {
+	if !strings.HasPrefix(line, FlatDBSchemaHeader) {
+		// no header, original layout
+		return flatDBSchemas[0], nil
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(line[len(FlatDBSchemaHeader):]))
+	if err != nil {
+		return nil, ErrSchemaUnknown
+	}
+	if v > FlatDBSchemaVersion {
+		return nil, ErrSchemaNewer
+	}
+	schema := flatDBSchemas[v]
+	if schema == nil {
+		return nil, ErrSchemaUnknown
+	}
+
+	return schema, nil
+}
+
+// migrateRecords upgrade the record columns from the version to current version
+func migrateRecords(version int, records []string) ([]string, error) {
+	var err error
+	for v := version; v < FlatDBSchemaVersion; v++ {
+		migrate := flatDBMigrations[v]
+		if migrate == nil {
+			return nil, fmt.Errorf("no migration from db schema %d", v)
+		}
+		records, err = migrate(records)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
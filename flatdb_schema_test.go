@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSchemaMigration loads a record written in each old layout, checks the upgraded book and that in-place update still works
+func TestSchemaMigration(t *testing.T) {
+	// columns of the original layout, fixed width ones with the 10 character inode
+	base := "abc,1,0012,0003,4,1,0000012345,0000000099,1500000000,1500000001,1500000002,Title,Author,01,/books/[Author] Title 01.cbz"
+	fixtures := []struct {
+		version int
+		line    string
+	}{
+		{0, base},
+		{1, base},
+		{2, base + ",0000000000"},
+		{3, base + ",0000000000,cafe"},
+		{4, base + ",0000000000,cafe,MTitle,MAuthor,MNumber,MSeries"},
+		{5, base + ",0000000000,cafe,MTitle,MAuthor,MNumber,MSeries,ITitle,ISeries,INumber,IAuthor,Summary,Genre,Yes"},
+		{6, base + ",0000000000,cafe,MTitle,MAuthor,MNumber,MSeries,ITitle,ISeries,INumber,IAuthor,Summary,Genre,Yes,77"},
+		{7, base + ",0000000000,cafe,MTitle,MAuthor,MNumber,MSeries,ITitle,ISeries,INumber,IAuthor,Summary,Genre,Yes,77,12,2"},
+		{8, "abc,1,0012,0003,4,1,0000012345,00000000000000000099,1500000000,1500000001,1500000002,Title,Author,01,/books/[Author] Title 01.cbz" +
+			",0000000000,cafe,MTitle,MAuthor,MNumber,MSeries,ITitle,ISeries,INumber,IAuthor,Summary,Genre,Yes,77,12,2"},
+	}
+	if fixtures[len(fixtures)-1].version != FlatDBSchemaVersion {
+		t.Fatalf("no fixture for schema %d", FlatDBSchemaVersion)
+	}
+
+	for _, fx := range fixtures {
+		dir, err := ioutil.TempDir("", "kamishibai")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		dbPath := filepath.Join(dir, "db.txt")
+		dat := fx.line + "\n"
+		if fx.version > 0 {
+			dat = flatDBSchemas[fx.version].header() + dat
+		}
+		err = ioutil.WriteFile(dbPath, []byte(dat), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db := &FlatDB{}
+		db.New(dbPath)
+		err = db.Load()
+		if err != nil {
+			t.Errorf("schema %d: %v", fx.version, err)
+			continue
+		}
+		book := db.GetBookByID("abc")
+		if book == nil {
+			t.Errorf("schema %d: book not loaded", fx.version)
+			continue
+		}
+
+		if book.Pages != 12 || book.Page != 3 || book.Ranking != 4 || book.Fav != 1 || book.Size != 12345 || book.Inode != 99 || book.Rtime != 1500000002 {
+			t.Errorf("schema %d: progress %+v", fx.version, book)
+		}
+		// cond was not reliable before schema 2
+		if wantCond := fx.version >= 2; (book.Cond == 1) != wantCond {
+			t.Errorf("schema %d: cond %d", fx.version, book.Cond)
+		}
+		// fingerprint is read again for the ComicInfo added in 5 and 7
+		if wantHash := fx.version >= 7; (book.Hash == "cafe") != wantHash {
+			t.Errorf("schema %d: hash %q", fx.version, book.Hash)
+		}
+		if wantMeta := fx.version >= 4; (book.Meta.Series == "MSeries") != wantMeta {
+			t.Errorf("schema %d: meta %+v", fx.version, book.Meta)
+		}
+		if wantInfo := fx.version >= 5; (book.Info.Summary == "Summary") != wantInfo {
+			t.Errorf("schema %d: info %+v", fx.version, book.Info)
+		}
+		if wantDev := fx.version >= 6; (book.Dev == 77) != wantDev {
+			t.Errorf("schema %d: dev %d", fx.version, book.Dev)
+		}
+		if wantCount := fx.version >= 7; (book.Info.PageCount == 12 && book.Info.Cover == 2) != wantCount {
+			t.Errorf("schema %d: page count %d cover %d", fx.version, book.Info.PageCount, book.Info.Cover)
+		}
+
+		// old layout is kept, file is rewritten in current layout
+		_, err = os.Stat(fmt.Sprintf("%s.schema%d.bak", dbPath, fx.version))
+		if (err == nil) != (fx.version < FlatDBSchemaVersion) {
+			t.Errorf("schema %d: backup %v", fx.version, err)
+		}
+
+		_, err = db.UpdatePage("abc", 9)
+		if err != nil {
+			t.Errorf("schema %d: update page %v", fx.version, err)
+			continue
+		}
+		db = reopenTestLibrary(t, db).(*FlatDB)
+		if book := db.GetBookByID("abc"); book.Page != 9 || book.Pages != 12 {
+			t.Errorf("schema %d: reloaded page %d pages %d", fx.version, book.Page, book.Pages)
+		}
+	}
+}
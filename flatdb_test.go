@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	fields := []string{
+		``,
+		`plain`,
+		`Say "hi"`,
+		`"leading`,
+		`trailing"`,
+		`"both"`,
+		`"`,
+		`""`,
+		`a,b`,
+		`,`,
+		`"a,",b"`,
+		`,"`,
+		`漫画 "第1巻", 上`,
+	}
+
+	for _, field := range fields {
+		book := &Book{
+			ID:       "abc",
+			Fullpath: "/books/" + field + ".cbz",
+			Meta: BookMeta{
+				Title:  field,
+				Author: field,
+				Number: field,
+				Series: field,
+			},
+			Info: ComicInfo{
+				Summary:   field,
+				Genre:     field,
+				PageCount: 180,
+				Cover:     3,
+			},
+		}
+
+		line := string(bookToCSV(book))
+		line = line[:len(line)-1]
+
+		records := csvToRecords(line)
+		if len(records) != flatDBSchemas[FlatDBSchemaVersion].Columns {
+			t.Errorf("%q: %d columns, want %d", field, len(records), flatDBSchemas[FlatDBSchemaVersion].Columns)
+			continue
+		}
+
+		got, err := csvToBook(line)
+		if err != nil {
+			t.Errorf("%q: %v", field, err)
+			continue
+		}
+		if got.Fullpath != book.Fullpath {
+			t.Errorf("%q: fullpath %q", field, got.Fullpath)
+		}
+		if got.Meta != book.Meta {
+			t.Errorf("%q: meta %+v", field, got.Meta)
+		}
+		if got.Info != book.Info {
+			t.Errorf("%q: info %+v", field, got.Info)
+		}
+	}
+}
+
+func TestCSVFixedWidth(t *testing.T) {
+	schema := flatDBSchemas[FlatDBSchemaVersion]
+	inodes := []int64{0, 34359738496, 1<<63 - 1, -1, -1 << 63}
+
+	for _, inode := range inodes {
+		book := &Book{
+			ID:       "abc",
+			Fullpath: "/books/title.cbz",
+			Page:     12,
+			Inode:    inode,
+		}
+		line := string(bookToCSV(book))
+		if !schema.validCommaPos(line) {
+			t.Errorf("inode %d: commas moved %q", inode, line)
+			continue
+		}
+		pos := schema.offset(len(book.ID), flatDBColPage)
+		if got := line[pos : pos+4]; got != "0012" {
+			t.Errorf("inode %d: page at offset is %q", inode, got)
+		}
+	}
+}
+
+func TestFlatDBBatchAppendPatch(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	// one book before the batch, so batch is appended to existing records
+	fpaths := []string{}
+	for i := 0; i < 6; i++ {
+		fpath := filepath.Join(dir, fmt.Sprintf("[Author] Title %02d.cbz", i))
+		writeTestBook(t, fpath, 10+i)
+		fpaths = append(fpaths, fpath)
+	}
+	_, err := db.AddFile(fpaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err := db.AddFiles(fpaths[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != len(fpaths)-1 {
+		t.Fatalf("added %d, want %d", len(books), len(fpaths)-1)
+	}
+
+	readDB := func() []byte {
+		dat, err := ioutil.ReadFile(db.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dat
+	}
+
+	// records are where the index says
+	dat := readDB()
+	for _, book := range books {
+		ibook := db.mapperIID[book.ID]
+		record := string(dat[ibook.Address : ibook.Address+ibook.Length])
+		if want := string(bookToCSV(book)); record+"\n" != want {
+			t.Errorf("%s at %d: %q, want %q", book.ID, ibook.Address, record, want)
+		}
+	}
+
+	// each patch changes only its own columns
+	for i, book := range books {
+		ibook := db.mapperIID[book.ID]
+		posPage := int(ibook.Address) + db.schema.offset(len(book.ID), flatDBColPage)
+		posFav := int(ibook.Address) + db.schema.offset(len(book.ID), flatDBColFav)
+		posRtime := int(ibook.Address) + db.schema.offset(len(book.ID), flatDBColRtime)
+
+		before := readDB()
+		_, err = db.UpdatePage(book.ID, i+2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateFav(book.ID, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := readDB()
+		if len(after) != len(before) {
+			t.Fatalf("%s: db file size %d, want %d", book.ID, len(after), len(before))
+		}
+
+		changed := map[int]bool{}
+		epochLen := len(fmt.Sprintf(FlatDBCharsEpoch, 0))
+		for j := 0; j < len(FlatDBCharsPage); j++ {
+			changed[posPage+j] = true
+		}
+		for j := 0; j < epochLen; j++ {
+			changed[posRtime+j] = true
+		}
+		changed[posFav] = true
+		for j := range after {
+			if after[j] != before[j] && !changed[j] {
+				t.Errorf("%s: byte %d changed, not page, fav or read time", book.ID, j)
+				break
+			}
+		}
+
+		fav := "0"
+		if i%2 == 0 {
+			fav = "1"
+		}
+		got := db.GetBookByID(book.ID)
+		if s := string(after[posPage : posPage+4]); s != fmt.Sprintf(FlatDBCharsPage, i+2) {
+			t.Errorf("%s: page %q on disk", book.ID, s)
+		}
+		if s := string(after[posFav : posFav+1]); s != fav {
+			t.Errorf("%s: fav %q on disk, want %s", book.ID, s, fav)
+		}
+		if s := string(after[posRtime : posRtime+epochLen]); s != fmt.Sprintf(FlatDBCharsEpoch, got.Rtime) {
+			t.Errorf("%s: read time %q on disk, want %d", book.ID, s, got.Rtime)
+		}
+	}
+
+	db = reopenTestLibrary(t, db).(*FlatDB)
+	if db.Count() != len(fpaths) {
+		t.Errorf("%d books, want %d", db.Count(), len(fpaths))
+	}
+	for i, book := range books {
+		got := db.GetBookByID(book.ID)
+		if got == nil {
+			t.Fatalf("%s not found", book.ID)
+		}
+		if got.Page != int64(i+2) || got.Fav != int64((i+1)%2) || got.Pages != int64(11+i) {
+			t.Errorf("%s: page %d fav %d pages %d, want %d %d %d", book.ID, got.Page, got.Fav, got.Pages, i+2, (i+1)%2, 11+i)
+		}
+	}
+}
@@ -55,6 +55,10 @@ var funcMapBrowse = template.FuncMap{
 		// browse, current dir name
 		return filepath.Base(fullpath)
 	},
+	"dirName": func(fullpath string) string {
+		// dir of the book file
+		return filepath.Dir(fullpath)
+	},
 	"readpc": func(fi *FileInfoBasic) string {
 		// browse, book read percentage tag
 		pg := fi.Page
@@ -77,6 +81,32 @@ var funcMapBrowse = template.FuncMap{
 		}
 		return c
 	},
+	"bookName": func(fi *FileInfoBasic) string {
+		// browse, book label, edited title is shown over file name
+		meta := fi.Meta
+		if meta.Title == "" && meta.Author == "" && meta.Number == "" {
+			return fi.Name
+		}
+		name := fi.Title
+		if fi.Number != "" {
+			name += " " + fi.Number
+		}
+		if fi.Author != "" {
+			name = "[" + fi.Author + "] " + name
+		}
+		return name
+	},
+	"authorNames": func(author string) []string {
+		return splitAuthors(author)
+	},
+	"seriesKey": func(book *Book) string {
+		// read, link to the series of the book
+		return seriesKey(book)
+	},
+	"rankStars": func() []int64 {
+		// browse, read, ranking choices
+		return []int64{1, 2, 3, 4, 5}
+	},
 	"readPageN": func(bk Book, a int) int {
 		// readin, for jumping pages
 		b := int(bk.Page) + a
@@ -97,6 +127,11 @@ var (
 	tmplBrowseLegacy = template.Must(gtmpl.New("browseLegacy").Parse(string(mustRead("ssp/legacy.html"))))
 	tmplLogin        = template.Must(gtmpl.New("login").Parse(string(mustRead("ssp/login.html"))))
 	tmplRead         = template.Must(gtmpl.New("read").Parse(string(mustRead("ssp/read.html"))))
+	tmplAdmin        = template.Must(gtmpl.New("admin").Parse(string(mustRead("ssp/admin.html"))))
+	tmplDuplicates   = template.Must(gtmpl.New("duplicates").Parse(string(mustRead("ssp/duplicates.html"))))
+	tmplEdit         = template.Must(gtmpl.New("edit").Parse(string(mustRead("ssp/edit.html"))))
+	tmplAuthors      = template.Must(gtmpl.New("authors").Parse(string(mustRead("ssp/authors.html"))))
+	tmplStats        = template.Must(gtmpl.New("stats").Parse(string(mustRead("ssp/stats.html"))))
 )
 
 func mustRead(filepath string) []byte {
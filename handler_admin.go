@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// adminGet http GET admin page, library maintenance
+func adminGet(cfg *Config, db Library, scanner *Scanner, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+
+		// compaction is only on flat file db
+		_, flat := db.(*FlatDB)
+
+		// admin template
+		data := struct {
+			Message    string
+			Books      int
+			PurgeDays  int
+			CanCompact bool
+			Scan       ScanProgress
+		}{
+			Message:    query.Get("msg"),
+			Books:      db.Count(),
+			PurgeDays:  cfg.PurgeDays,
+			CanCompact: flat,
+			Scan:       scanner.Progress(),
+		}
+
+		// exec template
+		buf := bytes.Buffer{}
+		err := tmpl.Execute(&buf, data)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(buf.String()))
+	}
+}
+
+// adminCompactPost http POST removes missing books from db, then back to admin page
+func adminCompactPost(cfg *Config, db *FlatDB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		report, err := db.Compact(cfg.PurgeGrace())
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		msg := fmt.Sprintf("compacted, %d records checked, %d missing, %d purged", report.Checked, report.Missing, report.Purged)
+		http.Redirect(w, r, "/admin.html?msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+// adminScanPost http POST starts scan of allowed dirs in background, then back to admin page
+func adminScanPost(cfg *Config, scanner *Scanner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		msg := "scan started"
+		err := scanner.Start(cfg.AllowedDirs)
+		if err != nil {
+			msg = err.Error()
+		}
+
+		http.Redirect(w, r, "/admin.html?msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+// adminScanCancelPost http POST stops running scan, then back to admin page
+func adminScanCancelPost(scanner *Scanner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		msg := "scan cancelled"
+		if !scanner.Cancel() {
+			msg = "no scan is running"
+		}
+
+		http.Redirect(w, r, "/admin.html?msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+// adminScanProgressGet http GET scan progress in json
+func adminScanProgressGet(scanner *Scanner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		dat, err := json.Marshal(scanner.Progress())
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(dat)
+	}
+}
+
+// adminProgressExportGet http GET reading progress backup, as json file download
+func adminProgressExportGet(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		buf := bytes.Buffer{}
+		err := writeProgress(db, &buf)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		fname := "kamishibai-progress-" + time.Now().Format("20060102") + ".json"
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+fname+"\"")
+		w.Write(buf.Bytes())
+	}
+}
+
+// adminProgressRestorePost http POST merges uploaded reading progress backup, then back to admin page
+func adminProgressRestorePost(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		f, _, err := r.FormFile("backup")
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+		defer f.Close()
+
+		backup, err := readProgress(f)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+		report, err := restoreProgress(db, backup)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		msg := fmt.Sprintf("progress restored, %d records, %d matched, %d books updated, %d without book", report.Records, report.Matched, report.Updated, report.Unmatched)
+		http.Redirect(w, r, "/admin.html?msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+// adminReparsePost http POST guess title, author and number of books from file name again, then back to admin page
+func adminReparsePost(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		n, err := db.Reparse()
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		msg := fmt.Sprintf("file names parsed again, %d books changed", n)
+		http.Redirect(w, r, "/admin.html?msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// authorsGet http GET author index, with book count of each author
+func authorsGet(cfg *Config, db Library, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		keyword := strings.TrimSpace(r.URL.Query().Get("keyword"))
+
+		authors := []*Author{}
+		for _, author := range db.Authors() {
+			if keyword != "" && !strings.Contains(authorKey(author.Name), authorKey(keyword)) {
+				continue
+			}
+			authors = append(authors, author)
+		}
+
+		// authors template
+		data := struct {
+			Keyword string
+			Authors []*Author
+		}{
+			Keyword: keyword,
+			Authors: authors,
+		}
+
+		// exec template
+		buf := bytes.Buffer{}
+		err := tmpl.Execute(&buf, data)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(buf.String()))
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -24,6 +25,7 @@ type FileInfoBasic struct {
 	Name    string    `json:"name,omitempty"`     // name of file or dir
 	ModTime time.Time `json:"mod_time,omitempty"` // file modified time
 	More    bool      `json:"more,omitempty"`     // listing, more files next page
+	Group   *Series   `json:"group,omitempty"`    // listing, is it series?
 	Book              // not using pointer so can manipulate if necessary
 }
 
@@ -41,6 +43,8 @@ const (
 	specialPathHistory           specialPath = "__history__"
 	specialPathHistoryFinished   specialPath = "__history_finished__"
 	specialPathHistoryUnfinished specialPath = "__history_unfinished__"
+	specialPathSeries            specialPath = "__series__"
+	specialPathAuthors           specialPath = "__authors__"
 )
 
 func isSpecialPath(dirPath string) bool {
@@ -48,7 +52,9 @@ func isSpecialPath(dirPath string) bool {
 	case specialPathEveryWhere,
 		specialPathHistory,
 		specialPathHistoryFinished,
-		specialPathHistoryUnfinished:
+		specialPathHistoryUnfinished,
+		specialPathSeries,
+		specialPathAuthors:
 		return true
 	}
 	return false
@@ -59,10 +65,11 @@ const (
 	sortOrderByFileModTime = "time"
 	sortOrderByReadTime    = "read"
 	sortOrderByAuthor      = "author"
+	sortOrderByRanking     = "rank"
 )
 
 // browseGet http GET lists the folder content, only the folder and the manga will be shown
-func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+func browseGet(cfg *Config, db Library, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusNotFound)
@@ -87,12 +94,14 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 		}
 
 		dir := query.Get("dir")
-		keyword := strings.ToLower(query.Get("keyword"))
+		keyword := query.Get("keyword")
 		// TODO implement sortBy
 		sortBy := strings.ToLower(query.Get("sortby"))
 		if sortBy == "" {
 			sortBy = "name"
 		}
+		// minimum ranking for everywhere search, 0 is any
+		minRank, _ := strconv.Atoi(query.Get("rank"))
 		spage := query.Get("page")
 		page, err := strconv.Atoi(spage)
 		if err != nil {
@@ -136,7 +145,10 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 			UpDir       string
 			Page        int
 			Keyword     string
+			Rank        int
 			SortBy      string
+			Series      *Series
+			Author      *Author
 			FileList    FileList
 			DirIsMore   bool
 			DirIsEmpty  bool
@@ -147,6 +159,7 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 			UpDir:       filepath.Dir(dir),
 			Page:        page,
 			Keyword:     keyword,
+			Rank:        minRank,
 			SortBy:      sortBy,
 			FileList:    FileList{},
 		}
@@ -185,7 +198,7 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 				})
 
 				// build library list
-				lstat, lists, err = search(db, keyword, page)
+				lstat, lists, err = search(db, keyword, page, minRank)
 				if err != nil {
 					responseError(w, err)
 					return
@@ -215,6 +228,45 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 					responseError(w, err)
 					return
 				}
+
+			case specialPathSeries:
+				// add first one as the dir info to save space
+				fileList = append(fileList, &FileInfoBasic{
+					IsDir: true,
+					Path:  "My Series",
+				})
+
+				// list of series, or volumes of the chosen series
+				key := query.Get("series")
+				if key == "" {
+					lstat, lists = listSeries(db, keyword, page)
+				} else {
+					data.Series, lstat, lists = listSeriesBooks(db, key, page)
+					if data.Series == nil {
+						responseBadRequest(w, errors.New("series not found"))
+						return
+					}
+				}
+
+			case specialPathAuthors:
+				// no author chosen, pick from the author index
+				name := query.Get("author")
+				if name == "" {
+					http.Redirect(w, r, "/authors.html", http.StatusFound)
+					return
+				}
+
+				// add first one as the dir info to save space
+				fileList = append(fileList, &FileInfoBasic{
+					IsDir: true,
+					Path:  "My Authors",
+				})
+
+				data.Author, lstat, lists = listAuthorBooks(db, name, page)
+				if data.Author == nil {
+					responseBadRequest(w, errors.New("author not found"))
+					return
+				}
 			}
 
 		} else {
@@ -265,7 +317,7 @@ func browseGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respo
 	}
 }
 
-func listDir(db *FlatDB, dir, search string, page int, sortOrderBy string) (status int, fileList FileList, err error) {
+func listDir(db Library, dir, search string, page int, sortOrderBy string) (status int, fileList FileList, err error) {
 	/* status
 	-1 error
 	 0 no any particular state
@@ -280,32 +332,21 @@ func listDir(db *FlatDB, dir, search string, page int, sortOrderBy string) (stat
 		return status, nil, err
 	}
 
-	search = strings.ToLower(search)
-	keywords := strings.Split(search, " ")
-	keywords = StringSliceFlatten(keywords)
+	// words match file name, filters match book record
+	q := parseQuery(search)
 
-OUTER:
 	for _, file := range files {
 		// no dot file/folder
 		if strings.HasPrefix(file.Name(), ".") {
 			continue
 		}
 
-		// case insensitive keyword search
-		fulltext := strings.ToLower(file.Name())
-		if len(keywords) > 0 {
-			found := 0
-			for _, keyword := range keywords {
-				if !strings.Contains(fulltext, keyword) {
-					// no match, next
-					continue OUTER
-				}
-				found++
-			}
-			if found < len(keywords) {
-				// if not all keywords found, skip (doing AND match)
-				continue OUTER
-			}
+		var book *Book
+		if q.NeedsBook() && !file.IsDir() {
+			book = db.GetBookByPath(filepath.Join(dir, file.Name()))
+		}
+		if !q.MatchName(book, file.Name()) {
+			continue
 		}
 
 		if file.IsDir() {
@@ -316,7 +357,7 @@ OUTER:
 				ModTime: file.ModTime(),
 			})
 
-		} else if strings.HasSuffix(fulltext, ".cbz") {
+		} else if strings.HasSuffix(strings.ToLower(file.Name()), ".cbz") {
 			// a book
 
 			// create and store blank book entry
@@ -342,6 +383,8 @@ OUTER:
 			fileList = sortByReadTime(fileList)
 		case sortOrderByAuthor:
 			fileList = sortByAuthorTitle(fileList)
+		case sortOrderByRanking:
+			fileList = sortByRanking(fileList)
 		default:
 			fileList = sortByFileName(fileList)
 		}
@@ -375,6 +418,8 @@ OUTER:
 		fileList = sortByReadTime(fileList)
 	case sortOrderByAuthor:
 		fileList = sortByAuthorTitle(fileList)
+	case sortOrderByRanking:
+		fileList = sortByRanking(fileList)
 	default:
 		fileList = sortByFileName(fileList)
 	}
@@ -396,7 +441,11 @@ OUTER:
 		} else {
 			// book not found, add now
 			nbook, err := db.AddFile(fileFullPath)
-			if err != nil {
+			if err == ErrDupBook {
+				// added by scan meanwhile
+				nbook = db.GetBookByPath(fileFullPath)
+			}
+			if nbook == nil {
 				return status, nil, err
 			}
 			fib.Book = *nbook
@@ -414,7 +463,7 @@ OUTER:
 	return status, fileList, nil
 }
 
-func search(db *FlatDB, search string, page int) (status int, fileList FileList, err error) {
+func search(db Library, search string, page int, minRank int) (status int, fileList FileList, err error) {
 	/* status
 	-1 error
 	 0 no any particular state
@@ -425,12 +474,8 @@ func search(db *FlatDB, search string, page int) (status int, fileList FileList,
 
 	books := db.Search(search)
 	for _, book := range books {
-		// skip if book not exist
-		isExist, err := IsFileExists(book.Fullpath)
-		if err != nil {
-			continue
-		}
-		if !isExist {
+		// skip if ranked lower than wanted
+		if int(book.Ranking) < minRank {
 			continue
 		}
 
@@ -455,31 +500,37 @@ func search(db *FlatDB, search string, page int) (status int, fileList FileList,
 		fileList = sortByFileName(fileList)
 	}
 
-	// pagination
+	// pagination, skip if book not exist. only files up to the page shown are checked as library could be big,
+	// files on earlier pages are checked too so the page starts after the books shown before
 	head := (page - 1) * ItemsPerPage
-	if head > len(fileList) {
-		head = len(fileList)
+	tail := page * ItemsPerPage
+	live := 0
+	pageList := FileList{}
+	// reached the end, no more files
+	status = 1
+	for _, fib := range fileList {
+		isExist, err := IsFileExists(fib.Book.Fullpath)
+		if err != nil || !isExist {
+			continue
+		}
+		if live >= tail {
+			// indicate more files
+			status = 2
+			break
+		}
+		if live >= head {
+			pageList = append(pageList, fib)
+		}
+		live++
 	}
-	tail := (page) * ItemsPerPage
-	if tail > len(fileList) {
-		tail = len(fileList)
-
-		// reached the end, no more files
-		status = 1
-	} else {
-		// indicate more files
-		status = 2
-	}
-	// chopped file list
-	fileList = fileList[head:tail]
 
 	// sort again, because earlier sort could be big and skipped
-	fileList = sortByFileName(fileList)
+	fileList = sortByFileName(pageList)
 
 	return status, fileList, nil
 }
 
-func listByReadHistory(db *FlatDB, search string, page int, readState int, sortOrderBy string) (status int, fileList FileList, err error) {
+func listByReadHistory(db Library, search string, page int, readState int, sortOrderBy string) (status int, fileList FileList, err error) {
 	/* status
 	-1 error
 	 0 no any particular state
@@ -539,6 +590,8 @@ func listByReadHistory(db *FlatDB, search string, page int, readState int, sortO
 			fileList = sortByReadTime(fileList)
 		case sortOrderByAuthor:
 			fileList = sortByAuthorTitle(fileList)
+		case sortOrderByRanking:
+			fileList = sortByRanking(fileList)
 		default:
 			fileList = sortByReadTime(fileList)
 		}
@@ -572,9 +625,102 @@ func listByReadHistory(db *FlatDB, search string, page int, readState int, sortO
 		fileList = sortByReadTime(fileList)
 	case sortOrderByAuthor:
 		fileList = sortByAuthorTitle(fileList)
+	case sortOrderByRanking:
+		fileList = sortByRanking(fileList)
 	default:
 		fileList = sortByReadTime(fileList)
 	}
 
 	return status, fileList, nil
 }
+
+// listSeries gives series that matches the search, ordered by title
+func listSeries(db Library, search string, page int) (status int, fileList FileList) {
+	for _, series := range buildSeries(db.Search(search)) {
+		fileList = append(fileList, &FileInfoBasic{
+			Name:  series.Title,
+			Group: series,
+		})
+	}
+
+	return paginate(fileList, page)
+}
+
+// listSeriesBooks gives volumes of the series in order, nil series if not found
+func listSeriesBooks(db Library, key string, page int) (series *Series, status int, fileList FileList) {
+	for _, s := range buildSeries(db.Search("")) {
+		if s.Key == key {
+			series = s
+			break
+		}
+	}
+	if series == nil {
+		return nil, 1, nil
+	}
+
+	for _, book := range series.Books {
+		fileList = append(fileList, bookFileInfo(book))
+	}
+
+	status, fileList = paginate(fileList, page)
+	return series, status, fileList
+}
+
+// listAuthorBooks gives series of the author, one shot is listed as book. nil author if not found
+func listAuthorBooks(db Library, name string, page int) (author *Author, status int, fileList FileList) {
+	author = db.GetAuthor(name)
+	if author == nil {
+		return nil, 1, nil
+	}
+
+	for _, series := range buildSeries(author.Books) {
+		if len(series.Books) == 1 {
+			fileList = append(fileList, bookFileInfo(series.Cover()))
+			continue
+		}
+		fileList = append(fileList, &FileInfoBasic{
+			Name:  series.Title,
+			Group: series,
+		})
+	}
+
+	status, fileList = paginate(fileList, page)
+	return author, status, fileList
+}
+
+// bookFileInfo gives listing item of the book
+func bookFileInfo(book *Book) *FileInfoBasic {
+	fib := &FileInfoBasic{
+		IsBook:  true,
+		Name:    filepath.Base(book.Fullpath),
+		ModTime: time.Unix(int64(book.Mtime), 0),
+		Book:    *book,
+	}
+
+	// make page 0 to 1 so wont crash on reading
+	if fib.Book.Page <= 0 {
+		fib.Book.Page = 1
+	}
+
+	return fib
+}
+
+// paginate chops the list to the page, status 1 is no more list to follow, 2 is more list to follow
+func paginate(fileList FileList, page int) (status int, chopped FileList) {
+	head := (page - 1) * ItemsPerPage
+	if head > len(fileList) {
+		head = len(fileList)
+	}
+	tail := (page) * ItemsPerPage
+	if tail > len(fileList) {
+		tail = len(fileList)
+
+		// reached the end, no more files
+		status = 1
+	} else {
+		// indicate more files
+		status = 2
+	}
+
+	return status, fileList[head:tail]
+}
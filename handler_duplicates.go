@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// duplicatesGet http GET lists books that are stored more than once
+func duplicatesGet(cfg *Config, db Library, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// duplicates template
+		data := struct {
+			Groups []*DuplicateGroup
+		}{
+			Groups: findDuplicates(db.Books()),
+		}
+
+		// exec template
+		buf := bytes.Buffer{}
+		err := tmpl.Execute(&buf, data)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(buf.String()))
+	}
+}
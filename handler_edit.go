@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// editGet http GET book metadata edit page
+func editGet(cfg *Config, db Library, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+
+		book := db.GetBookByID(query.Get("book"))
+		if book == nil {
+			responseBadRequest(w, errors.New("book not found"))
+			return
+		}
+
+		// guess from ComicInfo and file name, shown when field is blank
+		fname := path.Base(book.Fullpath)
+		guess := copyBook(book)
+		guess.Meta = BookMeta{}
+		guess.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+
+		// edit template
+		data := struct {
+			Message     string
+			Book        *Book
+			GuessTitle  string
+			GuessAuthor string
+			GuessNumber string
+			GuessSeries string
+		}{
+			Message:     query.Get("msg"),
+			Book:        book,
+			GuessTitle:  guess.Title,
+			GuessAuthor: guess.Author,
+			GuessNumber: guess.Number,
+			GuessSeries: guess.Series,
+		}
+
+		// exec template
+		buf := bytes.Buffer{}
+		err := tmpl.Execute(&buf, data)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(buf.String()))
+	}
+}
+
+// editPost http POST saves book metadata, then back to the read page
+func editPost(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			responseBadRequest(w, err)
+			return
+		}
+
+		book, err := db.UpdateMeta(r.PostForm.Get("book"), BookMeta{
+			Title:  r.PostForm.Get("title"),
+			Author: r.PostForm.Get("author"),
+			Number: r.PostForm.Get("number"),
+			Series: r.PostForm.Get("series"),
+		})
+		if err != nil {
+			responseBadRequest(w, err)
+			return
+		}
+
+		page := book.Page
+		if page < 1 {
+			page = 1
+		}
+		http.Redirect(w, r, "/read.html?book="+url.QueryEscape(book.ID)+"&page="+fmt.Sprint(page), http.StatusFound)
+	}
+}
+
+// editWritePost http POST writes book metadata into ComicInfo.xml of the book file, then back to the edit page
+func editWritePost(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			responseBadRequest(w, err)
+			return
+		}
+
+		book := db.GetBookByID(r.PostForm.Get("book"))
+		if book == nil {
+			responseBadRequest(w, errors.New("book not found"))
+			return
+		}
+
+		msg := "written to book file"
+		err = writeBookFile(db, book)
+		if err != nil {
+			msg = "failed to write book file, " + err.Error()
+		}
+
+		http.Redirect(w, r, "/edit.html?book="+url.QueryEscape(book.ID)+"&msg="+url.QueryEscape(msg), http.StatusFound)
+	}
+}
+
+// writeBookFile writes ComicInfo.xml into the book file, then saves the new file state so rescan does not see it as changed
+func writeBookFile(db Library, book *Book) error {
+	err := writeComicInfo(book.Fullpath, book)
+	if err != nil {
+		return err
+	}
+
+	fstat, err := os.Stat(book.Fullpath)
+	if err != nil {
+		return err
+	}
+	pages, hash, info, err := cbzRead(book.Fullpath)
+	if err != nil {
+		return err
+	}
+	book.Size = fstat.Size()
+	book.Mtime = fstat.ModTime().Unix()
+	book.Inode = fileInode(fstat)
+	book.Dev = fileDevice(fstat)
+	book.Pages = pages
+	book.Hash = hash
+	book.Info = info
+	log.Println("wrote ComicInfo", book.ID, book.Fullpath)
+
+	return db.UpdateFileState([]*Book{book})
+}
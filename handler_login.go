@@ -68,7 +68,7 @@ func loginPOST(httpSession *SessionStore, cfg *Config) func(http.ResponseWriter,
 }
 
 // loginGet login Get page
-func loginGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+func loginGet(cfg *Config, db Library, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusNotFound)
@@ -23,7 +23,7 @@ type BooksResponse []*Book
 type MapBooksResponse map[string]*Book
 
 // readGet http Get read page
-func readGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+func readGet(cfg *Config, db Library, readLog *ReadLog, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusNotFound)
@@ -35,6 +35,7 @@ func readGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respons
 		bookID := query.Get("book")
 		spage := query.Get("page")
 		fav := query.Get("fav")
+		rank, rankErr := strconv.Atoi(query.Get("rank"))
 		page, err := strconv.Atoi(spage)
 		if err != nil {
 			page = 1
@@ -49,6 +50,7 @@ func readGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respons
 			responseBadRequest(w, errors.New("invalid page number"))
 			return
 		}
+		// book is a copy, changes below only reflect the html
 		// set page temporary so reflect the html
 		book.Page = int64(page)
 		// set fav temporary so reflect the html
@@ -57,6 +59,10 @@ func readGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respons
 		} else if fav == "0" {
 			book.Fav = 0
 		}
+		// set ranking temporary so reflect the html
+		if rankErr == nil && rank >= 0 && rank <= 5 {
+			book.Ranking = int64(rank)
+		}
 
 		// read template
 		data := struct {
@@ -88,14 +94,52 @@ func readGet(cfg *Config, db *FlatDB, tmpl *template.Template) func(http.Respons
 			db.UpdateFav(bookID, false)
 		}
 
+		// set ranking permanently
+		if rankErr == nil {
+			db.UpdateRanking(bookID, rank)
+		}
+
 		// set page read permanently
 		db.UpdatePage(bookID, page)
+		// reading history
+		err = readLog.Add(book.ID, page)
+		if err != nil {
+			fmt.Printf("error: failed to log page read %+v\n", err)
+		}
 
 	}
 }
 
+// rankBook set book ranking then go back to the page it came from, so it works without javascript
+func rankBook(db Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		bookID, rank, err := parseURIBookIDandPage(r.URL.Path, "/api/ranking/")
+		if err != nil {
+			responseBadRequest(w, err)
+			return
+		}
+
+		_, err = db.UpdateRanking(bookID, rank)
+		if err != nil {
+			responseBadRequest(w, err)
+			return
+		}
+
+		referer := r.Referer()
+		if referer == "" {
+			referer = "/browse.html"
+		}
+		http.Redirect(w, r, referer, http.StatusFound)
+	}
+}
+
 // renderThumbnail gives thumbnail on the book
-func renderThumbnail(db *FlatDB, cfg *Config) func(http.ResponseWriter, *http.Request) {
+func renderThumbnail(db Library, cfg *Config) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusNotFound)
@@ -116,7 +160,7 @@ func renderThumbnail(db *FlatDB, cfg *Config) func(http.ResponseWriter, *http.Re
 		}
 
 		// locally stored thumbnail file
-		outFile := filepath.Join(cfg.PathCache, bookID+".jpg")
+		outFile := filepath.Join(cfg.PathCache, book.ID+".jpg")
 
 		// load existing thumbnail
 		isExist, _ := IsFileExists(outFile)
@@ -136,7 +180,7 @@ func renderThumbnail(db *FlatDB, cfg *Config) func(http.ResponseWriter, *http.Re
 		}
 
 		// generate thumb
-		imgDat, err = db.GetPageCoverByID(book.ID)
+		imgDat, err = bookCover(book.Fullpath, book.Info.Cover)
 		if err != nil {
 			responseError(w, err)
 			return
@@ -157,8 +201,8 @@ func renderThumbnail(db *FlatDB, cfg *Config) func(http.ResponseWriter, *http.Re
 	}
 }
 
-// readPage returns image of the page from the book with option to update bookmark
-func readPage(db *FlatDB, updateBookmark bool) func(http.ResponseWriter, *http.Request) {
+// readPage returns image of the page from the book with option to update bookmark, page read is logged with bookmark
+func readPage(db Library, readLog *ReadLog, updateBookmark bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			w.WriteHeader(http.StatusNotFound)
@@ -199,6 +243,10 @@ func readPage(db *FlatDB, updateBookmark bool) func(http.ResponseWriter, *http.R
 			if err != nil {
 				fmt.Printf("error: failed to update page %+v\n", err)
 			}
+			err = readLog.Add(book.ID, page)
+			if err != nil {
+				fmt.Printf("error: failed to log page read %+v\n", err)
+			}
 		}
 
 		ctype := http.DetectContentType(imgDat)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// StatsDays is number of recent days shown on stats page
+const StatsDays = 30
+
+// StatsBarWidth is pixel width of the longest pages per day bar
+const StatsBarWidth = 200
+
+// statsGet http GET reading statistics page
+func statsGet(cfg *Config, db Library, readLog *ReadLog, tmpl *template.Template) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		events, err := readLog.Events()
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+		stats := readStats(db, events, time.Now(), StatsDays)
+
+		// bar width of pages per day, relative to the most pages in a day
+		maxPages := 1
+		for _, day := range stats.Days {
+			if day.Pages > maxPages {
+				maxPages = day.Pages
+			}
+		}
+		bars := map[string]int{}
+		for _, day := range stats.Days {
+			bars[day.Day] = day.Pages * StatsBarWidth / maxPages
+		}
+
+		// stats template
+		data := struct {
+			Stats *ReadStats
+			Bars  map[string]int
+		}{
+			Stats: stats,
+			Bars:  bars,
+		}
+
+		// exec template
+		buf := bytes.Buffer{}
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			responseError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(buf.String()))
+	}
+}
@@ -141,12 +141,46 @@ func chunkifyX(line string) []string {
 	return strings.Split(buf.String(), "\n")
 }
 
-// AlphaNumCaseCompare returns true if the first string precedes the second one according to natural order
+// normaliseWidth changes full width ascii and space to half width, e.g. ＡＢＣ１２３ to ABC123
+func normaliseWidth(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u3000':
+			return ' '
+		case r >= '！' && r <= '～':
+			return r - 0xFEE0
+		}
+		return r
+	}, s)
+}
+
+// AlphaNumCaseCompare returns true if the first string precedes the second one according to natural order,
+// text is compared normalised so kana sort together and kanji numerals sort as number, e.g. 二巻 before 十巻
 // https://github.com/facette/natsort/blob/master/natsort.go
 func AlphaNumCaseCompare(a, b string) bool {
-	a = strings.ToLower(a)
-	b = strings.ToLower(b)
+	return naturalLess(normaliseText(a), normaliseText(b))
+}
+
+// naturalKeys keeps normalised text of strings compared during a sort, so each is normalised once not on every comparison
+type naturalKeys map[string]string
+
+// key gives normalised text of s
+func (k naturalKeys) key(s string) string {
+	n, ok := k[s]
+	if !ok {
+		n = normaliseText(s)
+		k[s] = n
+	}
+	return n
+}
+
+// less is AlphaNumCaseCompare with the normalised text kept
+func (k naturalKeys) less(a, b string) bool {
+	return naturalLess(k.key(a), k.key(b))
+}
 
+// naturalLess is natural order compare of already normalised text
+func naturalLess(a, b string) bool {
 	chunksA := chunkifyX(a)
 	chunksB := chunkifyX(b)
 
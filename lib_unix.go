@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode gives file inode, 0 if not available
+func fileInode(fi os.FileInfo) int64 {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return int64(stat.Ino)
+}
+
+// fileDevice gives device the file is on, inode is only unique within a device. 0 if not available
+func fileDevice(fi os.FileInfo) int64 {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return int64(stat.Dev)
+}
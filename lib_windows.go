@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// fileInode gives file inode, windows FileInfo does not have it so always 0
+func fileInode(fi os.FileInfo) int64 {
+	return 0
+}
+
+// fileDevice gives device the file is on, always 0 as there is no inode
+func fileDevice(fi os.FileInfo) int64 {
+	return 0
+}
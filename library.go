@@ -0,0 +1,76 @@
+package main
+
+// storage backend of the books
+//
+// http handlers work on Library, so the storage can be switched by config.
+// flat is the csv text file db (db.txt), log is the append-only binary log (db.binlog) for very large library
+
+import (
+	"fmt"
+)
+
+// storage backends, config value
+const (
+	LibraryBackendFlat = "flat"
+	LibraryBackendLog  = "log"
+)
+
+// Library is storage of the books, safe for concurrent use.
+// books given out are copies, changing them does not change the stored book
+type Library interface {
+	// Load reads the stored books
+	Load() error
+	// Count gives number of books
+	Count() int
+	// GetBookByID get book by book id, nil if not found
+	GetBookByID(bookID string) *Book
+	// GetBookByPath get book by file path, nil if not found
+	GetBookByPath(fpath string) *Book
+	// Books gives all books, missing ones too
+	Books() []*Book
+	// Search gives books that matches search query, see parseQuery. blank gives all
+	Search(search string) []*Book
+	// Authors gives all authors ordered by name
+	Authors() []*Author
+	// GetAuthor get author by name, nil if not found
+	GetAuthor(name string) *Author
+	// UpdatePage saves page read, also the read time
+	UpdatePage(id string, page int) (int, error)
+	// UpdateFav saves favourite
+	UpdateFav(id string, fav bool) (int, error)
+	// UpdateRanking saves ranking, 1-5 or 0 to unrank
+	UpdateRanking(id string, ranking int) (int, error)
+	// UpdateMeta saves user edited metadata
+	UpdateMeta(id string, meta BookMeta) (*Book, error)
+	// AddFile adds book file, moved book keeps the old record
+	AddFile(fpath string) (*Book, error)
+	// AddFiles adds many book files, unusable files are skipped
+	AddFiles(fpaths []string) ([]*Book, error)
+	// AddBooks adds books already read from the files, moved book keeps the old record
+	AddBooks(books []*Book) ([]*Book, error)
+	// UpdateFileState saves state read from the book files, e.g. cond, size, pages
+	UpdateFileState(books []*Book) error
+	// UpdateProgress saves page, read time, favourite and ranking of the books, e.g. restored from backup
+	UpdateProgress(books []*Book) error
+	// Reparse guess title, author and number from file name again with the rules in use, gives number of books changed
+	Reparse() (int, error)
+}
+
+// openLibrary gives storage chosen by config, not loaded yet
+func openLibrary(cfg *Config) (Library, error) {
+	switch cfg.Backend {
+	case LibraryBackendFlat:
+		db := &FlatDB{}
+		db.New(cfg.PathDB)
+		db.IDLength = cfg.IDLength
+		return db, nil
+
+	case LibraryBackendLog:
+		db := &LogDB{}
+		db.New(cfg.PathDBLog)
+		db.IDLength = cfg.IDLength
+		return db, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
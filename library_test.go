@@ -0,0 +1,596 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// testBackends are the storage backends every Library test is run against
+var testBackends = []string{LibraryBackendFlat, LibraryBackendLog}
+
+// newTestLibrary gives blank library of the backend in a temporary dir, with dir for book files
+func newTestLibrary(t *testing.T, backend string) (Library, string) {
+	dir, err := ioutil.TempDir("", "kamishibai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	cfg := &Config{
+		Backend:   backend,
+		PathDB:    filepath.Join(dir, "db.txt"),
+		PathDBLog: filepath.Join(dir, "db.binlog"),
+		IDLength:  FlatDBIDLength,
+	}
+	db, err := openLibrary(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books := filepath.Join(dir, "books")
+	err = os.Mkdir(books, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, books
+}
+
+// reopenTestLibrary gives the library loaded again from its file
+func reopenTestLibrary(t *testing.T, db Library) Library {
+	var next Library
+	switch db := db.(type) {
+	case *FlatDB:
+		n := &FlatDB{}
+		n.New(db.Path)
+		next = n
+	case *LogDB:
+		n := &LogDB{}
+		n.New(db.Path)
+		next = n
+	}
+
+	err := next.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return next
+}
+
+// writeTestBook writes cbz file with the number of pages, content differs by name
+func writeTestBook(t *testing.T, fpath string, pages int) {
+	writeTestBookInfo(t, fpath, pages, "")
+}
+
+// writeTestBookInfo writes cbz file with the number of pages and ComicInfo.xml, none if blank
+func writeTestBookInfo(t *testing.T, fpath string, pages int, comicInfo string) {
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i := 1; i <= pages; i++ {
+		w, err := zw.Create(fmt.Sprintf("%03d.jpg", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "%s page %d", filepath.Base(fpath), i)
+	}
+	if comicInfo != "" {
+		w, err := zw.Create(ComicInfoName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, comicInfo)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countPath gives number of books with the path
+func countPath(db Library, fpath string) int {
+	n := 0
+	for _, book := range db.Books() {
+		if book.Fullpath == fpath {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAddFileConcurrent(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			fpaths := []string{}
+			for i := 0; i < 5; i++ {
+				fpath := filepath.Join(dir, fmt.Sprintf("[Author] Title %02d.cbz", i))
+				writeTestBook(t, fpath, 3)
+				fpaths = append(fpaths, fpath)
+			}
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 8; i++ {
+				wg.Add(3)
+				go func() {
+					defer wg.Done()
+					db.AddFile(fpaths[0])
+				}()
+				go func() {
+					defer wg.Done()
+					db.AddFiles(fpaths)
+				}()
+				go func() {
+					defer wg.Done()
+					db.Search("title")
+					db.Books()
+				}()
+			}
+			wg.Wait()
+
+			if db.Count() != len(fpaths) {
+				t.Errorf("%d books, want %d", db.Count(), len(fpaths))
+			}
+			for _, fpath := range fpaths {
+				if n := countPath(db, fpath); n != 1 {
+					t.Errorf("%s: %d books", filepath.Base(fpath), n)
+				}
+			}
+
+			db = reopenTestLibrary(t, db)
+			if db.Count() != len(fpaths) {
+				t.Errorf("reloaded %d books, want %d", db.Count(), len(fpaths))
+			}
+		})
+	}
+}
+
+// TestFlatDBReloadConcurrent books added and pages read while reloading are not lost from memory
+func TestFlatDBReloadConcurrent(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	fpath := filepath.Join(dir, "[Author] Read 01.cbz")
+	writeTestBook(t, fpath, 1000)
+	read, err := db.AddFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpaths := []string{}
+	for i := 0; i < 200; i++ {
+		fpath := filepath.Join(dir, fmt.Sprintf("[Author] Title %03d.cbz", i))
+		writeTestBook(t, fpath, 1)
+		fpaths = append(fpaths, fpath)
+	}
+
+	// writes go on until reload is done, so last reload runs alongside them too
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, fpath := range fpaths {
+			_, err := db.AddFile(fpath)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	page := 0
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			page = page%1000 + 1
+			_, err := db.UpdatePage(read.ID, page)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		err := db.Reload()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// memory agrees with the file
+	for _, fpath := range fpaths {
+		_, err := db.AddFile(fpath)
+		if err != ErrDupBook {
+			t.Errorf("%s: add again gives %v", filepath.Base(fpath), err)
+		}
+	}
+	for _, db := range []Library{db, reopenTestLibrary(t, db)} {
+		if db.Count() != len(fpaths)+1 {
+			t.Errorf("%d books, want %d", db.Count(), len(fpaths)+1)
+		}
+		if book := db.GetBookByID(read.ID); book.Page != int64(page) {
+			t.Errorf("page %d, want %d", book.Page, page)
+		}
+	}
+}
+
+// TestBrowseReadScanConcurrent pages are read and dirs browsed while scanner adds books, run with -race
+func TestBrowseReadScanConcurrent(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+			cfg := &Config{AllowedDirs: []string{dir}}
+			readLog := &ReadLog{}
+			readLog.New(filepath.Join(filepath.Dir(dir), "read.log"))
+
+			// books being read, already in db
+			const pages = 20
+			read := []*Book{}
+			for i := 0; i < 4; i++ {
+				fpath := filepath.Join(dir, fmt.Sprintf("[Author] Read %02d.cbz", i))
+				writeTestBook(t, fpath, pages)
+				book, err := db.AddFile(fpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				read = append(read, book)
+			}
+			// books found by scanner
+			for i := 0; i < 30; i++ {
+				writeTestBook(t, filepath.Join(dir, fmt.Sprintf("[Author] Scan %02d.cbz", i)), 2)
+			}
+
+			browse := browseGet(cfg, db, tmplBrowse)
+			readPage := readGet(cfg, db, readLog, tmplRead)
+			get := func(handler http.HandlerFunc, query url.Values) {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest("GET", "/?"+query.Encode(), nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: status %d %s", query.Encode(), w.Code, w.Body.String())
+				}
+			}
+
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scanner := newScanner(db, 4)
+				for i := 0; i < 3; i++ {
+					_, err := scanner.Scan([]string{dir})
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			for _, book := range read {
+				wg.Add(2)
+				go func(id string) {
+					defer wg.Done()
+					for page := 1; page <= pages; page++ {
+						get(readPage, url.Values{"book": {id}, "page": {fmt.Sprint(page)}})
+					}
+				}(book.ID)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 5; i++ {
+						get(browse, url.Values{"dir": {dir}})
+						get(browse, url.Values{"dir": {string(specialPathEveryWhere)}, "keyword": {"author"}})
+					}
+				}()
+			}
+			wg.Wait()
+
+			check := func(db Library) {
+				if db.Count() != 34 {
+					t.Errorf("%d books, want 34", db.Count())
+				}
+				for _, book := range read {
+					if got := db.GetBookByID(book.ID); got == nil || got.Page != pages {
+						t.Errorf("%s: progress lost %+v", book.ID, got)
+					}
+				}
+			}
+			check(db)
+			check(reopenTestLibrary(t, db))
+		})
+	}
+}
+
+// libraryPath gives file the library is stored in
+func libraryPath(db Library) string {
+	switch db := db.(type) {
+	case *FlatDB:
+		return db.Path
+	case *LogDB:
+		return db.Path
+	}
+	return ""
+}
+
+// TestLibraryConformance runs the same steps on each backend, state carries over from step to step
+func TestLibraryConformance(t *testing.T) {
+	type state struct {
+		db     Library
+		dir    string
+		one    string // book id of one piece
+		naruto string // book id of naruto
+	}
+
+	steps := []struct {
+		name string
+		run  func(t *testing.T, s *state)
+	}{
+		{"AddFile", func(t *testing.T, s *state) {
+			fpath := filepath.Join(s.dir, "[Oda] One Piece 第01巻.cbz")
+			writeTestBook(t, fpath, 3)
+			book, err := s.db.AddFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(book.ID) != FlatDBIDLength || book.Pages != 3 || book.Title != "One Piece" || book.Author != "Oda" || book.Number != "第01巻" {
+				t.Errorf("added %+v", book)
+			}
+			s.one = book.ID
+
+			fpath = filepath.Join(s.dir, "[Kishimoto] ナルト 第02巻.cbz")
+			writeTestBook(t, fpath, 5)
+			book, err = s.db.AddFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.naruto = book.ID
+
+			_, err = s.db.AddFile(fpath)
+			if err != ErrDupBook {
+				t.Errorf("add again gives %v, want %v", err, ErrDupBook)
+			}
+			_, err = s.db.AddFile(filepath.Join(s.dir, "none.cbz"))
+			if err == nil {
+				t.Error("add missing file gives no error")
+			}
+
+			if s.db.Count() != 2 {
+				t.Errorf("%d books, want 2", s.db.Count())
+			}
+			if book := s.db.GetBookByPath(fpath); book == nil || book.ID != s.naruto {
+				t.Errorf("by path %+v", book)
+			}
+		}},
+		{"UpdatePage", func(t *testing.T, s *state) {
+			_, err := s.db.UpdatePage(s.one, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			book := s.db.GetBookByID(s.one)
+			if book.Page != 2 || book.Rtime == 0 {
+				t.Errorf("page %d rtime %d", book.Page, book.Rtime)
+			}
+			_, err = s.db.UpdatePage("none", 1)
+			if err == nil {
+				t.Error("unknown id gives no error")
+			}
+		}},
+		{"UpdateFav", func(t *testing.T, s *state) {
+			_, err := s.db.UpdateFav(s.one, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book := s.db.GetBookByID(s.one); book.Fav != 1 {
+				t.Errorf("fav %d", book.Fav)
+			}
+		}},
+		{"UpdateRanking", func(t *testing.T, s *state) {
+			_, err := s.db.UpdateRanking(s.one, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book := s.db.GetBookByID(s.one); book.Ranking != 4 {
+				t.Errorf("ranking %d", book.Ranking)
+			}
+			_, err = s.db.UpdateRanking(s.one, 6)
+			if err != ErrRankingRange {
+				t.Errorf("ranking 6 gives %v, want %v", err, ErrRankingRange)
+			}
+
+			s.db = reopenTestLibrary(t, s.db)
+			if book := s.db.GetBookByID(s.one); book.Ranking != 4 {
+				t.Errorf("ranking %d after reload, want 4", book.Ranking)
+			}
+		}},
+		{"UpdateMeta", func(t *testing.T, s *state) {
+			book, err := s.db.UpdateMeta(s.naruto, BookMeta{Title: `Naruto "Say hi"`, Series: "Naruto"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.Title != `Naruto "Say hi"` || book.Series != "Naruto" || book.Author != "Kishimoto" {
+				t.Errorf("meta %+v", book)
+			}
+			// progress is kept
+			if book := s.db.GetBookByID(s.one); book.Page != 2 || book.Fav != 1 || book.Ranking != 4 {
+				t.Errorf("progress lost %+v", book)
+			}
+		}},
+		{"MetaKept", func(t *testing.T, s *state) {
+			// whole db written out again
+			switch db := s.db.(type) {
+			case *FlatDB:
+				err := db.Export(db.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			case *LogDB:
+				db.mutex.Lock()
+				err := db.rewrite()
+				db.mutex.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.db = reopenTestLibrary(t, s.db)
+			book := s.db.GetBookByID(s.naruto)
+			if book.Title != `Naruto "Say hi"` || book.Series != "Naruto" || book.Meta.Title != `Naruto "Say hi"` {
+				t.Errorf("meta after reload %+v", book)
+			}
+
+			// guess changes, edited title stays
+			err := setNameRules(&NameRules{Number: []*NameRule{{Pattern: ` 第(\d+)巻`}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// built-in rules back for later steps
+			defer func() {
+				setNameRules(nil)
+				_, err := s.db.Reparse()
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+			n, err := s.db.Reparse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("reparsed %d, want 2", n)
+			}
+			s.db = reopenTestLibrary(t, s.db)
+			book = s.db.GetBookByID(s.naruto)
+			if book.Title != `Naruto "Say hi"` || book.Series != "Naruto" || book.Number != "02" || book.Author != "Kishimoto" {
+				t.Errorf("meta after reparse %+v", book)
+			}
+		}},
+		{"Search", func(t *testing.T, s *state) {
+			cases := []struct {
+				query string
+				ids   []string
+			}{
+				{"", []string{s.one, s.naruto}},
+				{"piece", []string{s.one}},
+				{"ＯＮＥ", []string{s.one}},
+				{`"say hi"`, []string{s.naruto}},
+				{"author:kishimoto", []string{s.naruto}},
+				{"rank>=4 fav:yes", []string{s.one}},
+				{"-piece", []string{s.naruto}},
+				{"piece OR naruto", []string{s.one, s.naruto}},
+				{"nothing", []string{}},
+			}
+			for _, c := range cases {
+				books := s.db.Search(c.query)
+				ids := map[string]bool{}
+				for _, book := range books {
+					ids[book.ID] = true
+				}
+				if len(books) != len(c.ids) {
+					t.Errorf("%q: %d books, want %d", c.query, len(books), len(c.ids))
+					continue
+				}
+				for _, id := range c.ids {
+					if !ids[id] {
+						t.Errorf("%q: %s not found", c.query, id)
+					}
+				}
+			}
+		}},
+		{"Reload", func(t *testing.T, s *state) {
+			s.db = reopenTestLibrary(t, s.db)
+			if s.db.Count() != 2 {
+				t.Fatalf("%d books, want 2", s.db.Count())
+			}
+			if book := s.db.GetBookByID(s.one); book.Page != 2 || book.Fav != 1 || book.Ranking != 4 || book.Pages != 3 {
+				t.Errorf("reloaded %+v", book)
+			}
+			if book := s.db.GetBookByID(s.naruto); book.Title != `Naruto "Say hi"` || book.Series != "Naruto" {
+				t.Errorf("reloaded %+v", book)
+			}
+			if books := s.db.Search(`"say hi"`); len(books) != 1 {
+				t.Errorf("search after reload %d books", len(books))
+			}
+		}},
+		{"Alias", func(t *testing.T, s *state) {
+			err := ioutil.WriteFile(aliasPath(libraryPath(s.db)), []byte("old,"+s.one+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.db = reopenTestLibrary(t, s.db)
+
+			if book := s.db.GetBookByID("old"); book == nil || book.ID != s.one {
+				t.Fatalf("old id gives %+v", book)
+			}
+			_, err = s.db.UpdatePage("old", 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.db.UpdateFav("old", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.db.UpdateMeta("old", BookMeta{Number: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// batch updates by old id, e.g. progress import and rescan
+			update := s.db.GetBookByID(s.one)
+			update.ID = "old"
+			update.Ranking = 4
+			update.Rtime = 1234
+			err = s.db.UpdateProgress([]*Book{update})
+			if err != nil {
+				t.Fatal(err)
+			}
+			update.Gtime = 5678
+			err = s.db.UpdateFileState([]*Book{update})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.db = reopenTestLibrary(t, s.db)
+			book := s.db.GetBookByID(s.one)
+			if book.Page != 3 || book.Fav != 0 || book.Number != "1" || book.Ranking != 4 || book.Rtime != 1234 || book.Gtime != 5678 {
+				t.Errorf("update by old id %+v", book)
+			}
+		}},
+	}
+
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := &state{}
+			s.db, s.dir = newTestLibrary(t, backend)
+
+			for _, step := range steps {
+				if !t.Run(step.name, func(t *testing.T) { step.run(t, s) }) {
+					// later steps depend on this one
+					return
+				}
+			}
+		})
+	}
+}
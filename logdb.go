@@ -0,0 +1,861 @@
+package main
+
+// append-only binary log store, for very large library
+//
+// every change is appended to the log, nothing is written in place. on load the entries are
+// replayed in order, later entry wins. the log is rewritten with one entry per book
+// when it has grown much larger than the library.
+// entry format
+//   {op, 1 byte}{payload length, uvarint}{payload}{crc32 of op and payload, 4 bytes big endian}
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// log entry operations
+const (
+	logOpPut     = 1 // whole book
+	logOpPage    = 2 // id, page, read time
+	logOpFav     = 3 // id, fav
+	logOpRanking = 4 // id, ranking
+)
+
+// LogDBCompactRatio is how many entries per book the log can have before it is rewritten on load
+const LogDBCompactRatio = 4
+
+// errors for log db
+var (
+	ErrLogEntry = errors.New("invalid log entry")
+)
+
+// LogDB is append-only binary log database
+type LogDB struct {
+	mutex      *sync.RWMutex
+	books      []*Book
+	mapperID   map[string]*Book // map books by id (unique)
+	mapperPath map[string]*Book // map books by file path (unique)
+	search     *searchIndex     // bigram index of author, title and series
+	Path       string           // where the log is stored
+	IDLength   int              // length of new book id
+
+	entries int               // number of entries in the log file
+	aliases map[string]string // old book id to current id, same alias file as flat db
+}
+
+// New initialize new log database
+func (db *LogDB) New(dbPath string) {
+	db.mutex = &sync.RWMutex{}
+	db.Path = dbPath
+	db.IDLength = FlatDBIDLength
+	db.clear()
+}
+
+// clear all data, caller must hold the lock
+func (db *LogDB) clear() {
+	db.books = nil
+	db.mapperID = make(map[string]*Book)
+	db.mapperPath = make(map[string]*Book)
+	db.search = newSearchIndex()
+	db.aliases = make(map[string]string)
+	db.entries = 0
+}
+
+// Load replays the log
+func (db *LogDB) Load() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.clear()
+
+	aliases, err := loadAliases(db.Path)
+	if err != nil {
+		return err
+	}
+	db.aliases = aliases
+
+	dat, err := ioutil.ReadFile(db.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pos := 0
+	for pos < len(dat) {
+		op, payload, n, err := decodeLogEntry(dat[pos:])
+		if err != nil {
+			// torn write at the end of log, rest is not trustworthy
+			log.Println("log, discard incomplete entry at", pos)
+			break
+		}
+		err = db.apply(op, payload)
+		if err != nil {
+			log.Printf("log entry at %d skipped, %v\n", pos, err)
+		}
+		pos += n
+		db.entries++
+	}
+
+	// cut off the torn end, so new entries follow a good one
+	if pos < len(dat) {
+		err = os.Truncate(db.Path, int64(pos))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(db.books) > 0 && db.entries > len(db.books)*LogDBCompactRatio {
+		return db.rewrite()
+	}
+
+	return nil
+}
+
+// apply log entry to the books, caller must hold the lock
+func (db *LogDB) apply(op byte, payload []byte) error {
+	if op == logOpPut {
+		book, err := decodeLogBook(payload)
+		if err != nil {
+			return err
+		}
+		db.index(book)
+		return nil
+	}
+
+	d := &logDecoder{buf: payload}
+	book := db.mapperID[d.str()]
+	switch op {
+	case logOpPage:
+		page, rtime := d.int(), d.int()
+		if d.err == nil && book != nil {
+			book.Page = page
+			book.Rtime = rtime
+		}
+	case logOpFav:
+		fav := d.int()
+		if d.err == nil && book != nil {
+			book.Fav = fav
+		}
+	case logOpRanking:
+		ranking := d.int()
+		if d.err == nil && book != nil {
+			book.Ranking = ranking
+		}
+	default:
+		return ErrLogEntry
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if book == nil {
+		return ErrNoBookID
+	}
+
+	return nil
+}
+
+// index adds the book or replaces the book with same id, caller must hold the lock
+func (db *LogDB) index(book *Book) {
+	prev := db.mapperID[book.ID]
+	if prev == nil {
+		db.books = append(db.books, book)
+		db.mapperID[book.ID] = book
+		db.mapperPath[book.Fullpath] = book
+		db.search.put(book)
+		return
+	}
+
+	// books slice holds the same pointer
+	delete(db.mapperPath, prev.Fullpath)
+	*prev = *book
+	db.mapperPath[prev.Fullpath] = prev
+	db.search.put(prev)
+}
+
+// append writes the entries to the end of log, caller must hold the lock
+func (db *LogDB) append(entries ...[]byte) (int, error) {
+	f, err := os.OpenFile(db.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := []byte{}
+	for _, entry := range entries {
+		buf = append(buf, entry...)
+	}
+	n, err := f.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return n, err
+	}
+	db.entries += len(entries)
+
+	return n, nil
+}
+
+// rewrite the log with one entry per book, caller must hold the lock
+func (db *LogDB) rewrite() error {
+	buf := []byte{}
+	for _, book := range db.books {
+		buf = append(buf, encodeLogEntry(logOpPut, encodeLogBook(book))...)
+	}
+
+	tmpPath := db.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	err = os.Rename(tmpPath, db.Path)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(db.Path))
+
+	log.Println("log rewritten", db.entries, "->", len(db.books), "entries")
+	db.entries = len(db.books)
+
+	return nil
+}
+
+// Count gives number of books in the db
+func (db *LogDB) Count() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return len(db.books)
+}
+
+// GetBookByID get copy of Book object by book id
+func (db *LogDB) GetBookByID(bookID string) *Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return copyBook(db.mapperID[db.resolveID(bookID)])
+}
+
+// resolveID gives current id of the book, old id is followed to the new id. caller must hold the lock
+func (db *LogDB) resolveID(id string) string {
+	if db.mapperID[id] != nil {
+		return id
+	}
+	if newID := db.aliases[id]; newID != "" {
+		return newID
+	}
+	return id
+}
+
+// GetBookByPath get copy of Book object by file path
+func (db *LogDB) GetBookByPath(fpath string) *Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return copyBook(db.mapperPath[fpath])
+}
+
+// Search gives books that matches search query, see parseQuery. missing books are left out
+func (db *LogDB) Search(search string) []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	books := []*Book{}
+	for _, book := range db.search.search(parseQuery(search)) {
+		// skip books known to be missing
+		if book.Cond == 2 {
+			continue
+		}
+		books = append(books, copyBook(book))
+	}
+
+	return books
+}
+
+// UpdatePage saves page read, returns written byte size
+func (db *LogDB) UpdatePage(id string, page int) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	book := db.mapperID[db.resolveID(id)]
+	if book == nil {
+		return 0, ErrNoBookID
+	}
+	book.Page = int64(page)
+	book.Rtime = time.Now().Unix()
+
+	e := &logEncoder{}
+	e.str(book.ID)
+	e.int(book.Page)
+	e.int(book.Rtime)
+
+	return db.append(encodeLogEntry(logOpPage, e.buf))
+}
+
+// UpdateFav saves favourite, returns written byte size
+func (db *LogDB) UpdateFav(id string, fav bool) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	book := db.mapperID[db.resolveID(id)]
+	if book == nil {
+		return 0, ErrNoBookID
+	}
+	book.Fav = 0
+	if fav {
+		book.Fav = 1
+	}
+
+	e := &logEncoder{}
+	e.str(book.ID)
+	e.int(book.Fav)
+
+	return db.append(encodeLogEntry(logOpFav, e.buf))
+}
+
+// UpdateRanking saves ranking, 1-5 or 0 to unrank, returns written byte size
+func (db *LogDB) UpdateRanking(id string, ranking int) (int, error) {
+	if ranking < 0 || ranking > 5 {
+		return 0, ErrRankingRange
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	book := db.mapperID[db.resolveID(id)]
+	if book == nil {
+		return 0, ErrNoBookID
+	}
+	book.Ranking = int64(ranking)
+
+	e := &logEncoder{}
+	e.str(book.ID)
+	e.int(book.Ranking)
+
+	return db.append(encodeLogEntry(logOpRanking, e.buf))
+}
+
+// UpdateMeta saves user edited metadata, blank field goes back to the guess from file name
+func (db *LogDB) UpdateMeta(id string, meta BookMeta) (*Book, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	book := db.mapperID[db.resolveID(id)]
+	if book == nil {
+		return nil, ErrNoBookID
+	}
+	book.Meta = meta.clean()
+	fname := path.Base(book.Fullpath)
+	book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+	db.search.put(book)
+
+	_, err := db.append(encodeLogEntry(logOpPut, encodeLogBook(book)))
+	if err != nil {
+		return nil, err
+	}
+
+	return copyBook(book), nil
+}
+
+// Books gives copies of all books, missing ones too
+func (db *LogDB) Books() []*Book {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	books := make([]*Book, len(db.books))
+	for i, book := range db.books {
+		books[i] = copyBook(book)
+	}
+
+	return books
+}
+
+// UpdateFileState saves state read from the book files, books are matched by id
+func (db *LogDB) UpdateFileState(books []*Book) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entries := [][]byte{}
+	for _, b := range books {
+		book := db.mapperID[db.resolveID(b.ID)]
+		if book == nil {
+			continue
+		}
+		book.setFileState(b)
+		db.search.put(book)
+		entries = append(entries, encodeLogEntry(logOpPut, encodeLogBook(book)))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	_, err := db.append(entries...)
+	return err
+}
+
+// UpdateProgress saves page, read time, favourite and ranking of the books, books are matched by id
+func (db *LogDB) UpdateProgress(books []*Book) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entries := [][]byte{}
+	for _, b := range books {
+		book := db.mapperID[db.resolveID(b.ID)]
+		if book == nil {
+			continue
+		}
+		book.setProgress(b)
+		entries = append(entries, encodeLogEntry(logOpPut, encodeLogBook(book)))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	_, err := db.append(entries...)
+	return err
+}
+
+// Reparse guess title, author and number from file name again with the rules in use, gives number of books changed
+func (db *LogDB) Reparse() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entries := [][]byte{}
+	for _, book := range db.books {
+		if book.reparse() {
+			db.search.put(book)
+			entries = append(entries, encodeLogEntry(logOpPut, encodeLogBook(book)))
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	_, err := db.append(entries...)
+	return len(entries), err
+}
+
+// checkBookFile do sanity checks on file before adding as a book
+func (db *LogDB) checkBookFile(fpath string) error {
+	err := checkBookFileType(fpath)
+	if err != nil {
+		return err
+	}
+
+	// make sure books are unique so no duplicate record
+	if db.GetBookByPath(fpath) != nil {
+		return ErrDupBook
+	}
+
+	return nil
+}
+
+// AddFile adds book to db, moved book keeps the old record
+func (db *LogDB) AddFile(fpath string) (*Book, error) {
+	err := db.checkBookFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.AddFiles([]string{fpath})
+	if err != nil {
+		return nil, err
+	}
+
+	// skipped if unreadable
+	book := db.GetBookByPath(fpath)
+	if book == nil {
+		return nil, ErrNotBook
+	}
+
+	return book, nil
+}
+
+// AddFiles adds many books to db in batches, files that failed sanity checks or unreadable are skipped.
+// file that is a moved book takes over the old record. returns the added books
+func (db *LogDB) AddFiles(fpaths []string) ([]*Book, error) {
+	return db.addFiles(fpaths, nil)
+}
+
+// AddBooks adds books already read by newBook, e.g. by scanner workers, same as AddFiles otherwise
+func (db *LogDB) AddBooks(books []*Book) ([]*Book, error) {
+	fpaths := make([]string, len(books))
+	read := make(map[string]*Book, len(books))
+	for i, book := range books {
+		fpaths[i] = book.Fullpath
+		read[book.Fullpath] = book
+	}
+
+	return db.addFiles(fpaths, read)
+}
+
+// addFiles adds the files, book file is only read when not found in read
+func (db *LogDB) addFiles(fpaths []string, read map[string]*Book) ([]*Book, error) {
+	added := []*Book{}
+	batch := []*Book{}
+	// books in this call not yet commited, prevent same path twice
+	pending := map[string]bool{}
+
+	// moved books found, applied at the end in one append
+	type move struct {
+		book *Book // copy of missing book
+		file *Book // file read by newBook
+	}
+	moves := []move{}
+	var idx *relinkIndex
+
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		// path was checked before the lock, could be added by other call since
+		fresh := []*Book{}
+		for _, book := range batch {
+			if db.mapperPath[book.Fullpath] == nil {
+				fresh = append(fresh, book)
+			}
+		}
+		batch = fresh
+		if len(batch) == 0 {
+			return nil
+		}
+
+		entries := [][]byte{}
+		for _, book := range batch {
+			// make sure book id is unique, within db and the batch
+			book.ID = genChar(db.IDLength)
+			for db.mapperID[book.ID] != nil || db.aliases[book.ID] != "" || bookIDInSlice(batch, book) {
+				book.ID = genChar(db.IDLength)
+			}
+			entries = append(entries, encodeLogEntry(logOpPut, encodeLogBook(book)))
+		}
+		_, err := db.append(entries...)
+		if err != nil {
+			return err
+		}
+		// books given stay with the caller
+		for _, book := range batch {
+			db.index(copyBook(book))
+			log.Println("Added book", book.Fullpath)
+		}
+
+		added = append(added, batch...)
+		batch = []*Book{}
+		return nil
+	}
+
+	for _, fpath := range fpaths {
+		if pending[fpath] {
+			continue
+		}
+		err := db.checkBookFile(fpath)
+		if err != nil {
+			continue
+		}
+		pending[fpath] = true
+
+		// look for moved book, index only built when there is new file
+		fstat, err := os.Stat(fpath)
+		if err != nil {
+			continue
+		}
+		if idx == nil {
+			db.mutex.RLock()
+			idx = newRelinkIndex(db.books)
+			db.mutex.RUnlock()
+		}
+		// zip is read before the lock, moved book takes the pages too
+		book := read[fpath]
+		if book == nil {
+			book, err = newBook(fpath)
+			if err != nil {
+				log.Println("failed to add book", fpath, err)
+				continue
+			}
+		}
+		// same file or same content as missing book
+		moved := pickMoved(idx.candidates(fpath, fstat), fpath, idx.claimed)
+		if moved == nil {
+			moved = pickMoved(idx.byHash[book.Hash], fpath, idx.claimed)
+		}
+		if moved != nil {
+			idx.claimed[moved] = true
+			moves = append(moves, move{book: moved, file: book})
+			continue
+		}
+		batch = append(batch, book)
+
+		if len(batch) >= FlatDBBatchSize {
+			err = commit()
+			if err != nil {
+				return added, err
+			}
+		}
+	}
+
+	err := commit()
+	if err != nil {
+		return added, err
+	}
+
+	if len(moves) == 0 {
+		return added, nil
+	}
+
+	err = func() error {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		entries := [][]byte{}
+		relinked := []*Book{}
+		for _, m := range moves {
+			// other call could have added the file since
+			if db.mapperPath[m.file.Fullpath] != nil {
+				continue
+			}
+			// index has copies, apply to the record. other call could have relinked the book since
+			book := db.mapperID[m.book.ID]
+			if !stillMissing(book, m.book) {
+				// book taken by other file, add as new book instead of dropping it
+				batch = append(batch, m.file)
+				continue
+			}
+			// record is changed after the write, so failed write leaves it as it was
+			book = copyBook(book)
+			relinkBook(book, m.file)
+			entries = append(entries, encodeLogEntry(logOpPut, encodeLogBook(book)))
+			relinked = append(relinked, book)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		_, err := db.append(entries...)
+		if err != nil {
+			return err
+		}
+		for _, book := range relinked {
+			db.index(book)
+		}
+		return nil
+	}()
+	if err != nil {
+		return added, err
+	}
+
+	return added, commit()
+}
+
+//
+// helper code ------------------------------------------------------------------------------------------------------
+//
+
+// logEncoder builds entry payload
+type logEncoder struct {
+	buf []byte
+}
+
+func (e *logEncoder) int(i int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.buf = append(e.buf, b[:binary.PutVarint(b, i)]...)
+}
+
+func (e *logEncoder) str(s string) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.buf = append(e.buf, b[:binary.PutUvarint(b, uint64(len(s)))]...)
+	e.buf = append(e.buf, s...)
+}
+
+// logDecoder reads entry payload, first error is kept and the rest gives zero value
+type logDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *logDecoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	i, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrLogEntry
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return i
+}
+
+func (d *logDecoder) str() string {
+	if d.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(d.buf)
+	if n <= 0 || uint64(len(d.buf)-n) < l {
+		d.err = ErrLogEntry
+		return ""
+	}
+	s := string(d.buf[n : n+int(l)])
+	d.buf = d.buf[n+int(l):]
+	return s
+}
+
+// more tells if payload has fields left, entry written by older version has less fields
+func (d *logDecoder) more() bool {
+	return d.err == nil && len(d.buf) > 0
+}
+
+// encodeLogEntry gives framed entry with checksum
+func encodeLogEntry(op byte, payload []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	entry := []byte{op}
+	entry = append(entry, b[:binary.PutUvarint(b, uint64(len(payload)))]...)
+	entry = append(entry, payload...)
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(append([]byte{op}, payload...)))
+
+	return append(entry, sum...)
+}
+
+// decodeLogEntry reads the first entry of dat, n is the entry size
+func decodeLogEntry(dat []byte) (op byte, payload []byte, n int, err error) {
+	if len(dat) < 1 {
+		return 0, nil, 0, ErrLogEntry
+	}
+	op = dat[0]
+
+	l, m := binary.Uvarint(dat[1:])
+	if m <= 0 {
+		return 0, nil, 0, ErrLogEntry
+	}
+	start := 1 + m
+	if uint64(len(dat)-start) < l+4 {
+		return 0, nil, 0, ErrLogEntry
+	}
+	end := start + int(l)
+	payload = dat[start:end]
+
+	if binary.BigEndian.Uint32(dat[end:end+4]) != crc32.ChecksumIEEE(append([]byte{op}, payload...)) {
+		return 0, nil, 0, ErrLogEntry
+	}
+
+	return op, payload, end + 4, nil
+}
+
+// encodeLogBook gives book as entry payload
+func encodeLogBook(book *Book) []byte {
+	e := &logEncoder{}
+	e.str(book.ID)
+	e.str(book.Fullpath)
+	e.str(book.Title)
+	e.str(book.Author)
+	e.str(book.Number)
+	e.str(book.Series)
+	e.str(book.Hash)
+	e.str(book.Meta.Title)
+	e.str(book.Meta.Author)
+	e.str(book.Meta.Number)
+	e.str(book.Meta.Series)
+	e.int(book.Ranking)
+	e.int(book.Fav)
+	e.int(book.Cond)
+	e.int(book.Pages)
+	e.int(book.Page)
+	e.int(book.Size)
+	e.int(book.Inode)
+	e.int(book.Mtime)
+	e.int(book.Itime)
+	e.int(book.Rtime)
+	e.int(book.Gtime)
+	// added later, older entry ends before these
+	e.str(book.Info.Title)
+	e.str(book.Info.Series)
+	e.str(book.Info.Number)
+	e.str(book.Info.Author)
+	e.str(book.Info.Summary)
+	e.str(book.Info.Genre)
+	e.str(book.Info.Manga)
+	e.int(book.Dev)
+	e.int(book.Info.PageCount)
+	e.int(book.Info.Cover)
+
+	return e.buf
+}
+
+// decodeLogBook reads book from entry payload
+func decodeLogBook(payload []byte) (*Book, error) {
+	d := &logDecoder{buf: payload}
+	book := &Book{}
+	book.ID = d.str()
+	book.Fullpath = d.str()
+	book.Title = d.str()
+	book.Author = d.str()
+	book.Number = d.str()
+	book.Series = d.str()
+	book.Hash = d.str()
+	book.Meta.Title = d.str()
+	book.Meta.Author = d.str()
+	book.Meta.Number = d.str()
+	book.Meta.Series = d.str()
+	book.Ranking = d.int()
+	book.Fav = d.int()
+	book.Cond = d.int()
+	book.Pages = d.int()
+	book.Page = d.int()
+	book.Size = d.int()
+	book.Inode = d.int()
+	book.Mtime = d.int()
+	book.Itime = d.int()
+	book.Rtime = d.int()
+	book.Gtime = d.int()
+	if d.more() {
+		book.Info.Title = d.str()
+		book.Info.Series = d.str()
+		book.Info.Number = d.str()
+		book.Info.Author = d.str()
+		book.Info.Summary = d.str()
+		book.Info.Genre = d.str()
+		book.Info.Manga = d.str()
+	}
+	if d.more() {
+		book.Dev = d.int()
+	}
+	if d.more() {
+		book.Info.PageCount = d.int()
+		book.Info.Cover = d.int()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if book.ID == "" || book.Fullpath == "" {
+		return nil, ErrLogEntry
+	}
+
+	return book, nil
+}
@@ -3,19 +3,27 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
-func loadDirs(db *FlatDB, allowedDirs []string) {
-	for _, dir := range allowedDirs {
-		err := db.AddDirR(dir)
+func loadDirs(db Library, scanner *Scanner, allowedDirs []string) {
+	// book files are read in parallel, added in batches so db file is not reloaded per book
+	_, err := scanner.Scan(allowedDirs)
+	if err != nil {
+		fmt.Println("failed to add books -", err)
+	}
+
+	// books added before fingerprint existed, read by scan workers after scan so new books show up first
+	if fdb, ok := db.(*FlatDB); ok {
+		_, err = fdb.FillHashes(scanner.workers)
 		if err != nil {
-			fmt.Println("failed to add dir -", err)
+			fmt.Println("failed to fingerprint books -", err)
 		}
 	}
 	fmt.Println("dirs loaded")
-	fmt.Println("books", len(db.books))
+	fmt.Println("books", db.Count())
 }
 
 func main() {
@@ -37,16 +45,47 @@ func main() {
 		panic(err)
 	}
 
+	// sub command given, e.g. db fsck
+	if flag.NArg() > 0 {
+		err = runCommand(config, flag.Args())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// new db
-	db := &FlatDB{}
-	db.New(config.PathDB)
-	db.Load()
-	// load all books recursively
-	go loadDirs(db, config.AllowedDirs)
+	db, err := openLibrary(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = db.Load()
+	if err != nil {
+		fmt.Println("failed to load db -", err)
+		os.Exit(1)
+	}
+	// load all books recursively, then keep checking for changes
+	scanner := newScanner(db, config.ScanWorkers)
+	go func() {
+		loadDirs(db, scanner, config.AllowedDirs)
+
+		interval := config.RescanInterval()
+		if interval > 0 {
+			newRescanner(db, scanner, config.AllowedDirs).Run(interval)
+		}
+	}()
+
+	// reading history
+	readLog := &ReadLog{}
+	readLog.New(config.PathReadLog)
 
 	svr := Server{
 		Database: db,
 		Config:   config,
+		Scanner:  scanner,
+		ReadLog:  readLog,
 	}
 	svr.Start()
 }
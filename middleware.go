@@ -32,6 +32,21 @@ func CheckAuthHandler(h http.Handler, httpSession *SessionStore, cfg *Config) ht
 		case "/legacy.html":
 			getPage(httpSession, cfg, h)(w, r)
 			return
+		case "/admin.html":
+			getPage(httpSession, cfg, h)(w, r)
+			return
+		case "/duplicates.html":
+			getPage(httpSession, cfg, h)(w, r)
+			return
+		case "/edit.html":
+			getPage(httpSession, cfg, h)(w, r)
+			return
+		case "/authors.html":
+			getPage(httpSession, cfg, h)(w, r)
+			return
+		case "/stats.html":
+			getPage(httpSession, cfg, h)(w, r)
+			return
 		}
 
 		// private
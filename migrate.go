@@ -0,0 +1,307 @@
+package main
+
+// migration from the original kamishibai db.json, books keyed by id
+//
+// e.g.
+//   {
+//     "7IL": {"title": "Some Title", "author": "Bob", "number": "1", "fullpath": "/mnt/old/abc.cbz",
+//             "ranking": 4, "fav": 1, "pages": 180, "page": 12, "size": 1234, "mtime": 1500000000, "itime": 1500000000, "rtime": 1500000000}
+//   }
+// book paths can be moved to another disk by prefix rewrite, e.g. /mnt/old=/mnt/books
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrRewriteRule rewrite rule is not old=new
+var ErrRewriteRule = errors.New("rewrite rule must be old=new")
+
+// regexLegacyID is id that can be kept, anything else is given a new id
+var regexLegacyID = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+
+// legacyBook is a book of the original db.json
+type legacyBook struct {
+	Title    string     `json:"title"`
+	Author   string     `json:"author"`
+	Number   string     `json:"number"`
+	Fullpath string     `json:"fullpath"`
+	Ranking  int64      `json:"ranking"`
+	Fav      legacyFlag `json:"fav"`
+	Pages    int64      `json:"pages"`
+	Page     int64      `json:"page"`
+	Size     int64      `json:"size"`
+	Mtime    int64      `json:"mtime"`
+	Itime    int64      `json:"itime"`
+	Rtime    int64      `json:"rtime"`
+}
+
+// legacyFlag is 0 or 1, written as number or true/false depending on version
+type legacyFlag int64
+
+// UnmarshalJSON reads number or bool
+func (f *legacyFlag) UnmarshalJSON(dat []byte) error {
+	switch string(dat) {
+	case "true":
+		*f = 1
+		return nil
+	case "false", "null":
+		*f = 0
+		return nil
+	}
+
+	var n int64
+	err := json.Unmarshal(dat, &n)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		n = 1
+	}
+	*f = legacyFlag(n)
+	return nil
+}
+
+// PathRewrite changes path prefix From to To, for library that moved disk
+type PathRewrite struct {
+	From string
+	To   string
+}
+
+// PathRewrites is list of rewrite rules, can be given as repeated command line flag
+type PathRewrites []PathRewrite
+
+// String gives the rules as old=new, seperated by comma
+func (rs *PathRewrites) String() string {
+	strs := []string{}
+	for _, r := range *rs {
+		strs = append(strs, r.From+"="+r.To)
+	}
+	return strings.Join(strs, ",")
+}
+
+// Set adds rule from old=new
+func (rs *PathRewrites) Set(rule string) error {
+	i := strings.Index(rule, "=")
+	if i <= 0 {
+		return ErrRewriteRule
+	}
+	*rs = append(*rs, PathRewrite{
+		From: strings.TrimSuffix(rule[:i], "/"),
+		To:   strings.TrimSuffix(rule[i+1:], "/"),
+	})
+	return nil
+}
+
+// Rewrite gives path with the longest matching prefix rewritten, as is if none matches
+func (rs PathRewrites) Rewrite(fpath string) (string, bool) {
+	var best *PathRewrite
+	for i, r := range rs {
+		// whole dir name only, /mnt/a does not match /mnt/ab
+		if fpath != r.From && !strings.HasPrefix(fpath, r.From+"/") {
+			continue
+		}
+		if best == nil || len(r.From) > len(best.From) {
+			best = &rs[i]
+		}
+	}
+	if best == nil {
+		return fpath, false
+	}
+
+	return best.To + fpath[len(best.From):], true
+}
+
+// MigrateReport is outcome of migration
+type MigrateReport struct {
+	Books     int      // books in legacy db
+	Added     int      // books to be added, or added
+	Rewritten int      // paths rewritten
+	NewID     int      // books given new id, old one is unusable or taken by other book
+	Existing  int      // books already in db or listed again, by path
+	Skipped   int      // books without path
+	Missing   []string // paths not found, added as missing
+}
+
+// String gives summary of the report
+func (r *MigrateReport) String() string {
+	return fmt.Sprintf("%d books, %d to add, %d paths rewritten, %d new ids, %d already in db, %d without path, %d not found",
+		r.Books, r.Added, r.Rewritten, r.NewID, r.Existing, r.Skipped, len(r.Missing))
+}
+
+// readLegacyDB reads the original db.json
+func readLegacyDB(fpath string) (map[string]*legacyBook, error) {
+	dat, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	books := map[string]*legacyBook{}
+	err = json.Unmarshal(dat, &books)
+	if err != nil {
+		return nil, err
+	}
+
+	return books, nil
+}
+
+// migrateBook makes book from the legacy one, title, author and number that differ from the file name guess are kept as edited metadata
+func migrateBook(id string, lb *legacyBook, fpath string) *Book {
+	book := &Book{
+		ID:       id,
+		Fullpath: fpath,
+		Ranking:  lb.Ranking,
+		Fav:      int64(lb.Fav),
+		Pages:    lb.Pages,
+		Page:     lb.Page,
+		Size:     lb.Size,
+		Mtime:    lb.Mtime,
+		Itime:    lb.Itime,
+		Rtime:    lb.Rtime,
+		Cond:     bookCond(fpath),
+	}
+	if book.Ranking < 0 || book.Ranking > 5 {
+		book.Ranking = 0
+	}
+	if book.Itime == 0 {
+		book.Itime = time.Now().Unix()
+	}
+
+	fstat, err := os.Stat(fpath)
+	if err == nil {
+		book.Size = fstat.Size()
+		book.Mtime = fstat.ModTime().Unix()
+		book.Inode = fileInode(fstat)
+		book.Dev = fileDevice(fstat)
+	}
+	if book.Cond == 2 {
+		book.Gtime = time.Now().Unix()
+	}
+
+	fname := path.Base(fpath)
+	if lb.Title != "" && lb.Title != getTitle(fname) {
+		book.Meta.Title = lb.Title
+	}
+	if lb.Author != "" && lb.Author != getAuthor(fname) {
+		book.Meta.Author = lb.Author
+	}
+	if lb.Number != "" && lb.Number != getNumber(fname) {
+		book.Meta.Number = lb.Number
+	}
+	book.Meta = book.Meta.clean()
+	book.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+
+	return book
+}
+
+// Migrate adds books of the original db.json, keeping id and reading progress. books already in db by path are left as is.
+// report is given without change to db when write is false, content fingerprint is filled in on next server start
+func (db *FlatDB) Migrate(legacyPath string, rewrites PathRewrites, write bool) (*MigrateReport, error) {
+	legacy, err := readLegacyDB(legacyPath)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrateReport{Books: len(legacy)}
+
+	// same order every run
+	ids := make([]string, 0, len(legacy))
+	for id := range legacy {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// same book listed more than once, the most recently read one is kept
+	fpaths := map[string]string{}
+	byPath := map[string]string{}
+	for _, id := range ids {
+		lb := legacy[id]
+		if lb == nil || lb.Fullpath == "" {
+			report.Skipped++
+			continue
+		}
+
+		fpath, ok := rewrites.Rewrite(lb.Fullpath)
+		if ok {
+			report.Rewritten++
+		}
+		fpaths[id] = fpath
+
+		other, ok := byPath[fpath]
+		if !ok {
+			byPath[fpath] = id
+			continue
+		}
+		report.Existing++
+		if lb.Rtime > legacy[other].Rtime {
+			byPath[fpath] = id
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	books := []*Book{}
+	taken := map[string]bool{}
+	for _, id := range ids {
+		fpath, ok := fpaths[id]
+		if !ok || byPath[fpath] != id {
+			continue
+		}
+		if db.mapperPath[fpath] != nil {
+			report.Existing++
+			continue
+		}
+
+		lb := legacy[id]
+		if !regexLegacyID.MatchString(id) || db.idTaken(id) {
+			id = ""
+		}
+		book := migrateBook(id, lb, fpath)
+		if book.Cond == 2 {
+			report.Missing = append(report.Missing, fpath)
+		}
+		if book.ID != "" {
+			taken[book.ID] = true
+		}
+		books = append(books, book)
+	}
+
+	// old id not usable
+	for _, book := range books {
+		if book.ID != "" {
+			continue
+		}
+		report.NewID++
+		book.ID = genChar(db.IDLength)
+		for db.idTaken(book.ID) || taken[book.ID] {
+			book.ID = genChar(db.IDLength)
+		}
+		taken[book.ID] = true
+	}
+	report.Added = len(books)
+
+	if !write || len(books) == 0 {
+		return report, nil
+	}
+
+	db.books = append(db.books, books...)
+
+	return report, db.reindex()
+}
+
+// printMigrateReport writes the report with each path not found
+func printMigrateReport(w io.Writer, report *MigrateReport) {
+	for _, fpath := range report.Missing {
+		fmt.Fprintln(w, "not found:", fpath)
+	}
+	fmt.Fprintln(w, report)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathRewrites(t *testing.T) {
+	rewrites := PathRewrites{}
+	for _, rule := range []string{"/mnt/old=/mnt/books", "/mnt/old/manga/=/srv/manga/", "/mnt/a=/mnt/b"} {
+		err := rewrites.Set(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rewrites.Set("=/mnt/books"); err != ErrRewriteRule {
+		t.Errorf("rule without old gives %v", err)
+	}
+	if err := rewrites.Set("/mnt/old"); err != ErrRewriteRule {
+		t.Errorf("rule without = gives %v", err)
+	}
+
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"/mnt/old/a.cbz", "/mnt/books/a.cbz", true},
+		{"/mnt/old/manga/a.cbz", "/srv/manga/a.cbz", true}, // longest prefix
+		{"/mnt/old", "/mnt/books", true},
+		{"/mnt/ab/a.cbz", "/mnt/ab/a.cbz", false}, // whole dir name only
+		{"/home/a.cbz", "/home/a.cbz", false},
+	}
+	for _, c := range cases {
+		got, ok := rewrites.Rewrite(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%s: %s %v, want %s %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// 7IL and 8XY are the same file, 7IL read last. bad id gets new id, gone is not found
+	legacy := `{
+  "7IL": {"title": "One Piece", "author": "Oda", "number": "01", "fullpath": "/mnt/old/[Oda] One Piece 01.cbz",
+          "ranking": 4, "fav": 1, "pages": 3, "page": 2, "rtime": 1500000200},
+  "8XY": {"fullpath": "/mnt/old/[Oda] One Piece 01.cbz", "page": 1, "rtime": 1500000100},
+  "a-b": {"title": "Naruto", "fullpath": "/mnt/old/[Kishimoto] ナルト 02.cbz", "fav": true, "page": 3, "rtime": 1500000300},
+  "GON": {"fullpath": "/mnt/gone/[Author] Gone 01.cbz", "page": 5},
+  "NOP": {"title": "no path"}
+}`
+
+	cases := []struct {
+		name      string
+		rewrite   bool
+		write     bool
+		added     int
+		rewritten int
+		missing   int
+	}{
+		{"dry run", true, false, 3, 3, 1},
+		{"write", true, true, 3, 3, 1},
+		{"write without rewrite", false, true, 3, 0, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lib, dir := newTestLibrary(t, LibraryBackendFlat)
+			db := lib.(*FlatDB)
+			writeTestBook(t, filepath.Join(dir, "[Oda] One Piece 01.cbz"), 3)
+			writeTestBook(t, filepath.Join(dir, "[Kishimoto] ナルト 02.cbz"), 4)
+			legacyPath := filepath.Join(filepath.Dir(db.Path), "db.json")
+			err := ioutil.WriteFile(legacyPath, []byte(legacy), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rewrites := PathRewrites{}
+			if c.rewrite {
+				err = rewrites.Set("/mnt/old=" + dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			report, err := db.Migrate(legacyPath, rewrites, c.write)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Books != 5 || report.Added != c.added || report.Rewritten != c.rewritten ||
+				report.NewID != 1 || report.Existing != 1 || report.Skipped != 1 || len(report.Missing) != c.missing {
+				t.Errorf("report %s", report)
+			}
+
+			db = reopenTestLibrary(t, db).(*FlatDB)
+			if !c.write {
+				if db.Count() != 0 {
+					t.Errorf("dry run added %d books", db.Count())
+				}
+				return
+			}
+			if db.Count() != c.added {
+				t.Fatalf("%d books, want %d", db.Count(), c.added)
+			}
+
+			// id and progress carry over
+			onePiece := "/mnt/old/[Oda] One Piece 01.cbz"
+			naruto := "/mnt/old/[Kishimoto] ナルト 02.cbz"
+			if c.rewrite {
+				onePiece = filepath.Join(dir, "[Oda] One Piece 01.cbz")
+				naruto = filepath.Join(dir, "[Kishimoto] ナルト 02.cbz")
+			}
+			book := db.GetBookByID("7IL")
+			if book == nil {
+				t.Fatal("7IL not found")
+			}
+			if book.Fullpath != onePiece || book.Page != 2 || book.Fav != 1 || book.Ranking != 4 || book.Rtime != 1500000200 {
+				t.Errorf("7IL %+v", book)
+			}
+			book = db.GetBookByPath(naruto)
+			if book == nil {
+				t.Fatal("book with bad id not found")
+			}
+			if book.ID == "a-b" || len(book.ID) != db.IDLength || book.Page != 3 || book.Fav != 1 || book.Rtime != 1500000300 {
+				t.Errorf("bad id %+v", book)
+			}
+			// title differs from file name guess, kept as edited
+			if book.Meta.Title != "Naruto" || book.Title != "Naruto" {
+				t.Errorf("title %q meta %q, want Naruto", book.Title, book.Meta.Title)
+			}
+			wantCond := int64(1)
+			if !c.rewrite {
+				wantCond = 2
+			}
+			if book.Cond != wantCond {
+				t.Errorf("cond %d, want %d", book.Cond, wantCond)
+			}
+
+			// already in db by path, nothing more added
+			report, err = db.Migrate(legacyPath, rewrites, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Added != 0 || db.Count() != c.added {
+				t.Errorf("migrate again added %d, %d books", report.Added, db.Count())
+			}
+		})
+	}
+}
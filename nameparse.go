@@ -0,0 +1,212 @@
+package main
+
+// book file name parsing, guess of title, author and number from the file name
+//
+// rules are regexp, tried in order, and can be changed by name_rules in config. e.g. for
+// [Group] Title v01 (2019).cbz and Title #001.cbz
+//   "name_rules": {
+//     "number": [{"pattern": " (v\\d+)(?: \\(\\d{4}\\))?$"}, {"pattern": " (#\\d+)$"}]
+//   }
+// field given replaces the built-in rules of the field, field not given keeps them.
+//
+// author rules run on the file name, first match wins, capture groups are joined.
+// number rules run on the file name without .cbz and with wide space made narrow, first match wins, capture groups are joined.
+// title rules rewrite the file name, all of them in order, replace can use $1 for capture group. number is taken out after
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// NameRule is a regexp rule for parsing book file name
+type NameRule struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace,omitempty"` // title rule only, text the match is replaced with
+
+	regex *regexp.Regexp
+}
+
+// NameRules are rules for each field, in order
+type NameRules struct {
+	Author []*NameRule `json:"author,omitempty"`
+	Number []*NameRule `json:"number,omitempty"`
+	Title  []*NameRule `json:"title,omitempty"`
+}
+
+// defaultNameRules are the built-in rules
+var defaultNameRules = NameRules{
+	Author: []*NameRule{
+		// get first [...]
+		{Pattern: `\[(.+?)\]`},
+	},
+	Number: []*NameRule{
+		// e.g.  第01巻   第1-3話     巻(まき)  卷(かん)
+		{Pattern: `(?i) (第[\d\-\~]+)(巻|卷|部|話)`},
+		// e.g.  1巻   1-3話
+		{Pattern: `(?i) ([\d\-\~\,]+)(巻|卷|部|話)`},
+		// e.g.  上巻
+		{Pattern: `(?i) (上|中|下)(巻|卷|部|話)`},
+		// e.g.  vol.01.cbz
+		{Pattern: `(?i) (vol.{0,2}\d+)$`},
+		// e.g.  ch.01.cbz
+		{Pattern: `(?i) (ch.{0,2}\d+)$`},
+		// e.g.  上.cbz
+		{Pattern: `(?i) (上|中|下)$`},
+		// e.g.  v01.cbz
+		{Pattern: `(?i) (v\d+)$`},
+		// e.g.  c01.cbz
+		{Pattern: `(?i) (c\d+\.)$`},
+		// 2018年10月号
+		{Pattern: `(?i) (\d{4}年\d{2}月号)`},
+		// not e.g.  01.cbz, because some book title could have number
+	},
+	Title: []*NameRule{
+		// get rid of extension, case insensitive
+		{Pattern: `(?i).cbz`},
+		// get rid of english
+		{Pattern: ` - [ \?\!\-\+\.\,\~\(\)\[\]A-Za-z0-9]+`},
+		// underline to space
+		{Pattern: `_`, Replace: ` `},
+		// change unicode wide space to narrow(ascii) space
+		{Pattern: `　`, Replace: ` `},
+		// get rid of (...)
+		{Pattern: `\(.+?\)`},
+		// get rid of [...]
+		{Pattern: `\[.+?\]`},
+	},
+}
+
+// nameRules in use, set from config on start
+var nameRules = mustNameRules(&NameRules{})
+
+// regexNameSpaces is run of spaces, made single after title rules
+var regexNameSpaces = regexp.MustCompile(` +`)
+
+// compile gives rules ready for use, field not given gets the built-in rules
+func (nr *NameRules) compile() (*NameRules, error) {
+	compiled := &NameRules{}
+	fields := []struct {
+		name  string
+		rules []*NameRule
+		def   []*NameRule
+		out   *[]*NameRule
+	}{
+		{"author", nr.Author, defaultNameRules.Author, &compiled.Author},
+		{"number", nr.Number, defaultNameRules.Number, &compiled.Number},
+		{"title", nr.Title, defaultNameRules.Title, &compiled.Title},
+	}
+	for _, field := range fields {
+		rules := field.rules
+		if len(rules) == 0 {
+			rules = field.def
+		}
+		for i, rule := range rules {
+			regex, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("name rule %s %d: %w", field.name, i+1, err)
+			}
+			*field.out = append(*field.out, &NameRule{
+				Pattern: rule.Pattern,
+				Replace: rule.Replace,
+				regex:   regex,
+			})
+		}
+	}
+
+	return compiled, nil
+}
+
+// mustNameRules gives compiled rules, panics on bad pattern
+func mustNameRules(nr *NameRules) *NameRules {
+	compiled, err := nr.compile()
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// setNameRules makes the rules in use, nil is the built-in rules
+func setNameRules(nr *NameRules) error {
+	if nr == nil {
+		nr = &NameRules{}
+	}
+	compiled, err := nr.compile()
+	if err != nil {
+		return err
+	}
+	nameRules = compiled
+	return nil
+}
+
+// extractName gives capture groups of the first matching rule joined, whole match if rule has no group
+func extractName(rules []*NameRule, s string) string {
+	for _, rule := range rules {
+		result := rule.regex.FindStringSubmatch(s)
+		if result == nil {
+			continue
+		}
+		if len(result) == 1 {
+			return result[0]
+		}
+		return strings.Join(result[1:], "")
+	}
+	return ""
+}
+
+// parseAuthor guess author from file name
+func (nr *NameRules) parseAuthor(fname string) string {
+	return extractName(nr.Author, fname)
+}
+
+// parseNumber guess volume or chapter from file name
+func (nr *NameRules) parseNumber(fname string) string {
+	s := strings.Replace(fname, ".cbz", "", -1)
+	s = strings.Replace(s, "　", " ", -1)
+
+	return extractName(nr.Number, s)
+}
+
+// parseTitle guess title from file name
+func (nr *NameRules) parseTitle(fname string) string {
+	s := fname
+	for _, rule := range nr.Title {
+		s = rule.regex.ReplaceAllString(s, rule.Replace)
+	}
+
+	// get rid of vol or chapter, after the title rules as it always has been
+	if number := nr.parseNumber(fname); number != "" {
+		s = strings.Replace(s, number, ``, -1)
+	}
+
+	// change multi-spaces to single space
+	s = regexNameSpaces.ReplaceAllString(s, ` `)
+	// trim leading and trailing space
+	return strings.TrimSpace(s)
+}
+
+// getAuthor guess author from file name, with the rules in use
+func getAuthor(str string) string {
+	return nameRules.parseAuthor(str)
+}
+
+// getTitle guess title from file name, with the rules in use
+func getTitle(str string) string {
+	return nameRules.parseTitle(str)
+}
+
+// getNumber guess volume or chapter from file name, with the rules in use
+func getNumber(str string) string {
+	return nameRules.parseNumber(str)
+}
+
+// reparse guess title, author and number from file name again, true if any changed
+func (b *Book) reparse() bool {
+	title, author, number, series := b.Title, b.Author, b.Number, b.Series
+
+	fname := path.Base(b.Fullpath)
+	b.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+
+	return b.Title != title || b.Author != author || b.Number != number || b.Series != series
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+// nameCases are file name shapes with title, author and number guessed before rules could be configured
+var nameCases = []struct {
+	fname  string
+	title  string
+	author string
+	number string
+}{
+	{"[Oda] One Piece 第01巻.cbz", "One Piece", "Oda", "第01巻"},
+	{"[尾田栄一郎] ワンピース 第1-3話.cbz", "ワンピース", "尾田栄一郎", "第1-3話"},
+	{"[Author] Title 12巻 (2019).cbz", "Title", "Author", "12巻"},
+	{"[Author] タイトル 上巻.cbz", "タイトル", "Author", "上巻"},
+	{"[Author] Title vol.03.cbz", "Title", "Author", "vol.03"},
+	{"[Author] Title Ch.12.cbz", "Title", "Author", "Ch.12"},
+	{"[Author] タイトル　下.cbz", "タイトル", "Author", "下"},
+	{"[Author] Title v05.cbz", "Title", "Author", "v05"},
+	{"[Author] Title c07..cbz", "Title", "Author", "c07."},
+	{"[Author] 雑誌 2018年10月号.cbz", "雑誌", "Author", "2018年10月号"},
+	{"[Author] タイトル - English Title 02巻.CBZ", "タイトル巻", "Author", "02巻"},
+	{"[A] [B] Some_Title (Extra) 01.cbz", "Some Title 01", "A", ""},
+	{"Title Without Author.cbz", "Title Without Author", "", ""},
+}
+
+func TestNameRulesBuiltIn(t *testing.T) {
+	err := setNameRules(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range nameCases {
+		title, author, number := getTitle(c.fname), getAuthor(c.fname), getNumber(c.fname)
+		if title != c.title || author != c.author || number != c.number {
+			t.Errorf("%s: %q %q %q, want %q %q %q", c.fname, title, author, number, c.title, c.author, c.number)
+		}
+	}
+}
+
+func TestNameRulesConfigured(t *testing.T) {
+	defer setNameRules(nil)
+
+	// only number is given, author and title keep the built-in rules
+	err := setNameRules(&NameRules{
+		Number: []*NameRule{{Pattern: ` (#\d+)$`}, {Pattern: ` (\d+)$`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		fname  string
+		title  string
+		author string
+		number string
+	}{
+		{"[Author] Title #012.cbz", "Title", "Author", "#012"},
+		{"[A] [B] Some_Title (Extra) 01.cbz", "Some Title", "A", "01"},
+		// built-in number rules are gone
+		{"[Oda] One Piece 第01巻.cbz", "One Piece 第01巻", "Oda", ""},
+	}
+	for _, c := range cases {
+		title, author, number := getTitle(c.fname), getAuthor(c.fname), getNumber(c.fname)
+		if title != c.title || author != c.author || number != c.number {
+			t.Errorf("%s: %q %q %q, want %q %q %q", c.fname, title, author, number, c.title, c.author, c.number)
+		}
+	}
+
+	// only author is given
+	err = setNameRules(&NameRules{
+		Author: []*NameRule{{Pattern: `\((.+?)\)`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := "[Group] Title (Someone) 第02巻.cbz"
+	if title, author, number := getTitle(fname), getAuthor(fname), getNumber(fname); title != "Title" || author != "Someone" || number != "第02巻" {
+		t.Errorf("%s: %q %q %q", fname, title, author, number)
+	}
+}
+
+func TestNameRulesBadPattern(t *testing.T) {
+	defer setNameRules(nil)
+
+	err := setNameRules(&NameRules{
+		Title: []*NameRule{{Pattern: `_`, Replace: ` `}, {Pattern: `(unclosed`}},
+	})
+	if err == nil {
+		t.Fatal("bad pattern gives no error")
+	}
+
+	// rules in use are left as they were
+	for _, c := range nameCases {
+		if title := getTitle(c.fname); title != c.title {
+			t.Errorf("%s: %q after bad rules, want %q", c.fname, title, c.title)
+		}
+	}
+}
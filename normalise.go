@@ -0,0 +1,232 @@
+package main
+
+// japanese aware text normalisation for search and sort, both sides are normalised the same way so they can be compared
+//
+// e.g.
+//   ｶﾀｶﾅ, カタカナ, かたかな   -> かたかな    width and kana folding
+//   コンピューター, コンピュータ -> こんぴゅた   long vowel mark dropped
+//   いすゞ, いすず            -> いすず      iteration mark repeats the kana before
+//   第十二巻, 第１２巻         -> 第12巻      kanji numeral and full width digit to number
+//
+// only the part of NFKC that matters for book names is done, full width ascii and half width kana.
+// other compatibility characters, e.g. ①, ㍻ and compatibility ideographs, are left as is
+
+import (
+	"strconv"
+	"strings"
+)
+
+// halfWidthKana is full width form of half width katakana U+FF61 to U+FF9D
+var halfWidthKana = []rune("。「」、・ヲァィゥェォャュョッーアイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワン")
+
+// voicedKana is hiragana that takes the voiced mark, voiced one is next code point, e.g. か to が
+const voicedKana = "かきくけこさしすせそたちつてとはひふへほ"
+
+// semiVoicedKana is hiragana that takes the semi-voiced mark, semi-voiced one is 2 code points after, e.g. は to ぱ
+const semiVoicedKana = "はひふへほ"
+
+// kanjiDigits are kanji numerals with their value
+var kanjiDigits = map[rune]int64{
+	'〇': 0, '零': 0, '一': 1, '二': 2, '三': 3, '四': 4, '五': 5, '六': 6, '七': 7, '八': 8, '九': 9,
+}
+
+// kanjiUnits are kanji numerals that multiply the digit before, 1 if there is none
+var kanjiUnits = map[rune]int64{
+	'十': 10, '百': 100, '千': 1000,
+}
+
+// kanjiBigUnits are kanji numerals that multiply everything before, never the start of a number
+var kanjiBigUnits = map[rune]int64{
+	'万': 10000, '億': 100000000,
+}
+
+// kanjiNumberMaxLen is longest kanji numeral run converted, longer one is left as is
+const kanjiNumberMaxLen = 16
+
+// normaliseText gives text for search and sort. width, case and kana are folded, long vowel and iteration marks are
+// handled and kanji numerals are changed to number. width folding is a subset of NFKC, see above
+func normaliseText(s string) string {
+	s = strings.ToLower(normaliseWidth(s))
+
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		// half width katakana to full width
+		if r >= 0xFF61 && r <= 0xFF9D {
+			r = halfWidthKana[r-0xFF61]
+		}
+		// katakana to hiragana, iteration marks too
+		if (r >= 'ァ' && r <= 'ヶ') || r == 'ヽ' || r == 'ヾ' {
+			r -= 0x60
+		}
+
+		prev := rune(0)
+		if len(out) > 0 {
+			prev = out[len(out)-1]
+		}
+
+		switch r {
+		// voiced mark, half width, combining (file name on mac) and spacing
+		case 0xFF9E, 0x3099, 0x309B:
+			if strings.ContainsRune(voicedKana, prev) {
+				out[len(out)-1] = prev + 1
+				continue
+			}
+			if prev == 'う' {
+				out[len(out)-1] = 'ゔ'
+				continue
+			}
+			if r == 0x3099 {
+				continue
+			}
+			r = 0x309B
+
+		// semi-voiced mark
+		case 0xFF9F, 0x309A, 0x309C:
+			if strings.ContainsRune(semiVoicedKana, prev) {
+				out[len(out)-1] = prev + 2
+				continue
+			}
+			if r == 0x309A {
+				continue
+			}
+			r = 0x309C
+
+		// long vowel, コンピュータ and コンピューター are the same
+		case 'ー':
+			if isHiragana(prev) {
+				continue
+			}
+
+		// kana iteration, e.g. いすゞ is いすず
+		case 'ゝ':
+			if isHiragana(prev) {
+				r = unvoiceKana(prev)
+			}
+		case 'ゞ':
+			if isHiragana(prev) {
+				r = unvoiceKana(prev)
+				if strings.ContainsRune(voicedKana, r) {
+					r++
+				}
+			}
+
+		// kanji iteration, e.g. 時々 is 時時
+		case '々':
+			if isKanji(prev) {
+				r = prev
+			}
+		}
+
+		out = append(out, r)
+	}
+
+	return replaceKanjiNumbers(out)
+}
+
+// isHiragana tells if r is hiragana
+func isHiragana(r rune) bool {
+	return r >= 'ぁ' && r <= 'ゖ'
+}
+
+// isKanji tells if r is cjk ideograph
+func isKanji(r rune) bool {
+	return (r >= 0x4E00 && r <= 0x9FFF) || (r >= 0x3400 && r <= 0x4DBF)
+}
+
+// unvoiceKana gives hiragana without voiced or semi-voiced mark, e.g. が to か
+func unvoiceKana(r rune) rune {
+	if strings.ContainsRune(voicedKana, r-1) {
+		return r - 1
+	}
+	if strings.ContainsRune(semiVoicedKana, r-2) {
+		return r - 2
+	}
+	if r == 'ゔ' {
+		return 'う'
+	}
+	return r
+}
+
+// replaceKanjiNumbers changes runs of kanji numerals to number, e.g. 二十三 to 23, 二〇一九 to 2019
+func replaceKanjiNumbers(rs []rune) string {
+	buf := strings.Builder{}
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		_, digit := kanjiDigits[r]
+		_, unit := kanjiUnits[r]
+		if !digit && !unit {
+			buf.WriteRune(r)
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(rs) {
+			_, digit = kanjiDigits[rs[j]]
+			_, unit = kanjiUnits[rs[j]]
+			_, big := kanjiBigUnits[rs[j]]
+			if !digit && !unit && !big {
+				break
+			}
+			j++
+		}
+
+		n, ok := parseKanjiNumber(rs[i:j])
+		if ok {
+			buf.WriteString(strconv.FormatInt(n, 10))
+		} else {
+			buf.WriteString(string(rs[i:j]))
+		}
+		i = j
+	}
+
+	return buf.String()
+}
+
+// parseKanjiNumber gives value of kanji numerals, digits only is read digit by digit, e.g. 二〇一九
+func parseKanjiNumber(rs []rune) (int64, bool) {
+	if len(rs) > kanjiNumberMaxLen {
+		return 0, false
+	}
+
+	hasUnit := false
+	for _, r := range rs {
+		_, unit := kanjiUnits[r]
+		_, big := kanjiBigUnits[r]
+		if unit || big {
+			hasUnit = true
+			break
+		}
+	}
+
+	var total, section, cur int64
+	for _, r := range rs {
+		if d, ok := kanjiDigits[r]; ok {
+			cur = cur*10 + d
+			continue
+		}
+		if !hasUnit {
+			continue
+		}
+		if u, ok := kanjiUnits[r]; ok {
+			if cur == 0 {
+				cur = 1
+			}
+			section += cur * u
+			cur = 0
+			continue
+		}
+		if u, ok := kanjiBigUnits[r]; ok {
+			section += cur
+			if section == 0 {
+				section = 1
+			}
+			total += section * u
+			section = 0
+			cur = 0
+		}
+	}
+
+	return total + section + cur, true
+}
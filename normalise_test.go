@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormaliseText(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		// width and case
+		{"ＯＮＥ　Ｐｉｅｃｅ", "one piece"},
+		{"ｶﾀｶﾅ", "かたかな"},
+		{"カタカナ", "かたかな"},
+		{"ｶﾞｷﾞﾊﾟ", "がぎぱ"},
+		{"ｳﾞｧ", "ゔぁ"},
+		// combining voiced mark, file name from mac
+		{"か\u3099", "が"},
+		{"は\u309a", "ぱ"},
+		// long vowel
+		{"コンピューター", "こんぴゅた"},
+		{"ｺﾝﾋﾟｭｰﾀｰ", "こんぴゅた"},
+		{"ー", "ー"},
+		{"A-ー", "a-ー"},
+		// iteration marks
+		{"いすゞ", "いすず"},
+		{"こゝろ", "こころ"},
+		{"時々", "時時"},
+		{"々", "々"},
+		// kanji numerals
+		{"第十二巻", "第12巻"},
+		{"第１２巻", "第12巻"},
+		{"二十一", "21"},
+		{"二〇一九年", "2019年"},
+		{"百", "100"},
+		{"三千五百", "3500"},
+		{"一万二千", "12000"},
+		{"十", "10"},
+		// not folded, outside the NFKC subset
+		{"①", "①"},
+		{"㍻", "㍻"},
+	}
+
+	for _, c := range cases {
+		if got := normaliseText(c.in); got != c.want {
+			t.Errorf("%q: %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNaturalKeysOrder(t *testing.T) {
+	cases := []struct {
+		a, b string
+		less bool
+	}{
+		{"第二巻", "第十巻", true},
+		{"第十巻", "第二巻", false},
+		{"Title 2", "Title 10", true},
+		{"ｶﾀｶﾅ 2", "かたかな 10", true},
+		{"あ", "い", true},
+	}
+
+	keys := naturalKeys{}
+	for _, c := range cases {
+		if got := keys.less(c.a, c.b); got != c.less {
+			t.Errorf("%q < %q: %v, want %v", c.a, c.b, got, c.less)
+		}
+		if got := AlphaNumCaseCompare(c.a, c.b); got != c.less {
+			t.Errorf("AlphaNumCaseCompare %q < %q: %v, want %v", c.a, c.b, got, c.less)
+		}
+	}
+	if len(keys) == 0 || keys["第十巻"] != "第10巻" {
+		t.Errorf("keys not kept %v", keys)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+// reading progress backup, portable json so progress can be carried to another machine or library
+//
+// e.g.
+//   {
+//     "version": 1,
+//     "exported": 1792315752,
+//     "books": [
+//       {"id": "A6tz9rCQ1u", "path": "/mnt/books/abc.cbz", "hash": "...", "page": 12, "fav": 1, "ranking": 4, "rtime": 1792315700}
+//     ]
+//   }
+// books are matched by id, then path, then content fingerprint, as id and path differ between machines
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// ProgressBackupVersion is the backup layout written by this program
+const ProgressBackupVersion = 1
+
+// ErrProgressBackupNewer backup is written by newer program
+var ErrProgressBackupNewer = errors.New("progress backup version is newer than supported")
+
+// ProgressBackup is reading progress of the library
+type ProgressBackup struct {
+	Version  int               `json:"version"`
+	Exported int64             `json:"exported"` // export time
+	Books    []*ProgressRecord `json:"books"`
+}
+
+// ProgressRecord is reading progress of a book
+type ProgressRecord struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash,omitempty"` // content fingerprint
+	Page    int64  `json:"page"`
+	Fav     int64  `json:"fav"`
+	Ranking int64  `json:"ranking"`
+	Rtime   int64  `json:"rtime"` // read time, the newer one wins on restore
+}
+
+// ProgressRestoreReport is outcome of a restore
+type ProgressRestoreReport struct {
+	Records   int // records in backup
+	Matched   int // records matched to a book
+	Updated   int // books changed
+	Unmatched int // records without a book
+}
+
+// hasProgress tells if the book was ever read, ranked or favourited
+func (b *Book) hasProgress() bool {
+	return b.Page > 0 || b.Fav > 0 || b.Ranking > 0 || b.Rtime > 0
+}
+
+// setProgress copies reading progress from src
+func (b *Book) setProgress(src *Book) {
+	b.Page = src.Page
+	b.Fav = src.Fav
+	b.Ranking = src.Ranking
+	b.Rtime = src.Rtime
+}
+
+// mergeProgress applies the record to the book when it is newer, last read wins.
+// fav and ranking have no time of their own, on same read time they only fill in what is not set. true if book changed
+func (b *Book) mergeProgress(rec *ProgressRecord) bool {
+	if rec.Rtime > b.Rtime {
+		b.Page = rec.Page
+		b.Fav = rec.Fav
+		b.Ranking = rec.Ranking
+		b.Rtime = rec.Rtime
+		return true
+	}
+	if rec.Rtime < b.Rtime {
+		return false
+	}
+
+	changed := false
+	if b.Page == 0 && rec.Page > 0 {
+		b.Page = rec.Page
+		changed = true
+	}
+	if b.Fav == 0 && rec.Fav > 0 {
+		b.Fav = rec.Fav
+		changed = true
+	}
+	if b.Ranking == 0 && rec.Ranking > 0 {
+		b.Ranking = rec.Ranking
+		changed = true
+	}
+	return changed
+}
+
+// exportProgress gives progress of books that were read, ranked or favourited
+func exportProgress(db Library) *ProgressBackup {
+	backup := &ProgressBackup{
+		Version:  ProgressBackupVersion,
+		Exported: time.Now().Unix(),
+		Books:    []*ProgressRecord{},
+	}
+	for _, book := range db.Books() {
+		if !book.hasProgress() {
+			continue
+		}
+		backup.Books = append(backup.Books, &ProgressRecord{
+			ID:      book.ID,
+			Path:    book.Fullpath,
+			Hash:    book.Hash,
+			Page:    book.Page,
+			Fav:     book.Fav,
+			Ranking: book.Ranking,
+			Rtime:   book.Rtime,
+		})
+	}
+
+	return backup
+}
+
+// writeProgress writes progress backup of the library as json
+func writeProgress(db Library, w io.Writer) error {
+	dat, err := json.MarshalIndent(exportProgress(db), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	return err
+}
+
+// readProgress reads progress backup json
+func readProgress(r io.Reader) (*ProgressBackup, error) {
+	backup := &ProgressBackup{}
+	err := json.NewDecoder(r).Decode(backup)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Version > ProgressBackupVersion {
+		return nil, ErrProgressBackupNewer
+	}
+
+	return backup, nil
+}
+
+// restoreProgress merges the backup into the library, see mergeProgress
+func restoreProgress(db Library, backup *ProgressBackup) (*ProgressRestoreReport, error) {
+	report := &ProgressRestoreReport{Records: len(backup.Books)}
+
+	books := db.Books()
+	byID := map[string]*Book{}
+	byPath := map[string]*Book{}
+	byHash := map[string][]*Book{}
+	for _, book := range books {
+		byID[book.ID] = book
+		byPath[book.Fullpath] = book
+		if book.Hash != "" {
+			byHash[book.Hash] = append(byHash[book.Hash], book)
+		}
+	}
+
+	changed := map[string]*Book{}
+	for _, rec := range backup.Books {
+		var match *Book
+
+		// id could be given to a different book on another machine, content tells them apart
+		if book := db.GetBookByID(rec.ID); book != nil && (rec.Hash == "" || book.Hash == "" || rec.Hash == book.Hash) {
+			match = byID[book.ID]
+		} else if rec.Path != "" && byPath[rec.Path] != nil {
+			match = byPath[rec.Path]
+		} else if rec.Hash != "" {
+			match = matchProgressHash(byHash[rec.Hash], rec.Path)
+		}
+
+		if match == nil {
+			report.Unmatched++
+			continue
+		}
+		report.Matched++
+
+		if match.mergeProgress(rec) {
+			changed[match.ID] = match
+		}
+	}
+
+	updates := make([]*Book, 0, len(changed))
+	for _, book := range books {
+		if changed[book.ID] != nil {
+			updates = append(updates, book)
+		}
+	}
+	report.Updated = len(updates)
+	if len(updates) == 0 {
+		return report, nil
+	}
+
+	return report, db.UpdateProgress(updates)
+}
+
+// matchProgressHash picks the book of same content, the one with same file name when content is stored more than once.
+// nil when it cannot be told which one
+func matchProgressHash(books []*Book, fpath string) *Book {
+	if len(books) == 1 {
+		return books[0]
+	}
+
+	var found *Book
+	for _, book := range books {
+		if filepath.Base(book.Fullpath) != filepath.Base(fpath) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = book
+	}
+	return found
+}
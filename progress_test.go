@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreProgress(t *testing.T) {
+	type books struct{ a, b *Book }
+
+	cases := []struct {
+		name    string
+		rec     func(s books) *ProgressRecord
+		matched int
+		page    int64 // page of book a after restore
+		fav     int64 // fav of book a after restore
+	}{
+		{"same id, newer", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: s.a.ID, Hash: s.a.Hash, Page: 5, Fav: 1, Rtime: s.a.Rtime + 1}
+		}, 1, 5, 1},
+		{"same id, older", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: s.a.ID, Hash: s.a.Hash, Page: 5, Fav: 1, Rtime: s.a.Rtime - 1}
+		}, 1, 2, 0},
+		{"same id, same time fills in", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: s.a.ID, Page: 5, Fav: 1, Rtime: s.a.Rtime}
+		}, 1, 2, 1},
+		{"path only", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: "other", Path: s.a.Fullpath, Page: 5, Rtime: s.a.Rtime + 1}
+		}, 1, 5, 0},
+		{"hash only", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: "other", Path: "/elsewhere/a.cbz", Hash: s.a.Hash, Page: 5, Rtime: s.a.Rtime + 1}
+		}, 1, 5, 0},
+		{"id of other content goes by hash", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: s.b.ID, Path: "/elsewhere/a.cbz", Hash: s.a.Hash, Page: 5, Rtime: s.a.Rtime + 1}
+		}, 1, 5, 0},
+		{"unmatched", func(s books) *ProgressRecord {
+			return &ProgressRecord{ID: "other", Path: "/elsewhere/a.cbz", Hash: "none", Page: 5, Rtime: s.a.Rtime + 1}
+		}, 0, 2, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, dir := newTestLibrary(t, LibraryBackendFlat)
+			s := books{}
+			for i, name := range []string{"[Author] A 01.cbz", "[Author] B 01.cbz"} {
+				fpath := filepath.Join(dir, name)
+				writeTestBook(t, fpath, 9)
+				book, err := db.AddFile(fpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					s.a = book
+				} else {
+					s.b = book
+				}
+			}
+			_, err := db.UpdatePage(s.a.ID, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.a = db.GetBookByID(s.a.ID)
+			if s.a.Hash == "" || s.a.Hash == s.b.Hash {
+				t.Fatalf("hash %q %q", s.a.Hash, s.b.Hash)
+			}
+
+			report, err := restoreProgress(db, &ProgressBackup{Version: ProgressBackupVersion, Books: []*ProgressRecord{c.rec(s)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Matched != c.matched || report.Unmatched != 1-c.matched {
+				t.Errorf("matched %d unmatched %d", report.Matched, report.Unmatched)
+			}
+
+			db = reopenTestLibrary(t, db)
+			if a := db.GetBookByID(s.a.ID); a.Page != c.page || a.Fav != c.fav {
+				t.Errorf("a page %d fav %d, want %d %d", a.Page, a.Fav, c.page, c.fav)
+			}
+			if b := db.GetBookByID(s.b.ID); b.hasProgress() {
+				t.Errorf("b changed %+v", b)
+			}
+		})
+	}
+}
+
+func TestMatchProgressHash(t *testing.T) {
+	one := &Book{ID: "1", Fullpath: "/a/title.cbz"}
+	two := &Book{ID: "2", Fullpath: "/b/title.cbz"}
+	other := &Book{ID: "3", Fullpath: "/b/other.cbz"}
+
+	cases := []struct {
+		name  string
+		books []*Book
+		fpath string
+		want  *Book
+	}{
+		{"only one", []*Book{other}, "/x/title.cbz", other},
+		{"by file name", []*Book{one, other}, "/x/title.cbz", one},
+		{"same file name twice", []*Book{one, two}, "/x/title.cbz", nil},
+		{"no file name match", []*Book{one, other}, "/x/none.cbz", nil},
+	}
+
+	for _, c := range cases {
+		if got := matchProgressHash(c.books, c.fpath); got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+// search query, words are matched against author, title and series, all of them must match
+//
+// e.g.
+//   author:oda "one piece" -colour     phrase in quote, minus leaves out
+//   fav:yes rank>=4 pages>200          favourite, ranked 4 or more, more than 200 pages
+//   unread added:<30d                  never opened, added in last 30 days
+//   finished read:>1y                  read to the end, last read more than a year ago
+//   title:naruto OR title:boruto       either one, OR joins the words next to it
+// search that does not parse as a filter is taken as word, e.g. rank>=x
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query is parsed search, all clauses must match
+type Query struct {
+	clauses [][]*queryTerm // terms of a clause are joined by OR
+	books   bool           // has filter that needs book record, not only the name
+}
+
+// queryTerm is a word, phrase or filter
+type queryTerm struct {
+	field  string // blank is author, title and series
+	op     string // compare of number filter, one of = < <= > >=
+	text   string // normalised word or phrase
+	num    int64  // value of number filter, seconds for time filter
+	negate bool
+}
+
+// queryOps are compare operators, longest first
+var queryOps = []string{">=", "<=", ">", "<", "=", ":"}
+
+// queryTextFields are filters that match text
+var queryTextFields = map[string]bool{
+	"author": true,
+	"title":  true,
+	"series": true,
+}
+
+// queryNumberFields are filters that compare number
+var queryNumberFields = map[string]bool{
+	"rank":  true,
+	"pages": true,
+}
+
+// queryTimeFields are filters that compare age, e.g. 30d is 30 days
+var queryTimeFields = map[string]bool{
+	"added": true,
+	"read":  true,
+}
+
+// queryTimeUnits are seconds of age unit
+var queryTimeUnits = map[byte]int64{
+	'h': 60 * 60,
+	'd': 24 * 60 * 60,
+	'w': 7 * 24 * 60 * 60,
+	'm': 30 * 24 * 60 * 60,
+	'y': 365 * 24 * 60 * 60,
+}
+
+// parseQuery parses search, blank matches everything
+func parseQuery(search string) *Query {
+	q := &Query{}
+
+	joinNext := false
+	for _, token := range splitQuery(search) {
+		if token == "OR" {
+			joinNext = len(q.clauses) > 0
+			continue
+		}
+
+		term := parseQueryTerm(token)
+		if term == nil {
+			continue
+		}
+		if term.field != "" {
+			q.books = true
+		}
+
+		if joinNext {
+			last := len(q.clauses) - 1
+			q.clauses[last] = append(q.clauses[last], term)
+		} else {
+			q.clauses = append(q.clauses, []*queryTerm{term})
+		}
+		joinNext = false
+	}
+
+	return q
+}
+
+// splitQuery splits search on space, text in double quote is kept together with its quotes
+func splitQuery(search string) []string {
+	tokens := []string{}
+
+	token := strings.Builder{}
+	quoted := false
+	for _, r := range normaliseWidth(search) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case r == ' ' && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens
+}
+
+// parseQueryTerm parses word, phrase or filter, nil if there is nothing to match
+func parseQueryTerm(token string) *queryTerm {
+	term := &queryTerm{}
+	// lone minus, e.g. "one - piece", leaves out nothing
+	if token == "-" {
+		return nil
+	}
+	if len(token) > 1 && token[0] == '-' {
+		term.negate = true
+		token = token[1:]
+	}
+
+	switch strings.ToLower(token) {
+	case "unread", "finished":
+		term.field = strings.ToLower(token)
+		return term
+	}
+
+	if field, op, value := splitQueryFilter(token); field != "" {
+		switch {
+		case queryTextFields[field] && op == ":":
+			term.field = field
+			term.text = normaliseText(strings.Trim(value, `"`))
+			if term.text == "" {
+				return nil
+			}
+			return term
+
+		case field == "fav" && op == ":":
+			switch strings.ToLower(value) {
+			case "yes", "y", "1", "true":
+				term.field, term.num = field, 1
+				return term
+			case "no", "n", "0", "false":
+				term.field, term.num = field, 0
+				return term
+			}
+
+		case queryNumberFields[field]:
+			op, value = queryFilterOp(op, value, "=")
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				term.field, term.op, term.num = field, op, n
+				return term
+			}
+
+		case queryTimeFields[field]:
+			// e.g. added:<30d, added:30d is same as added:<=30d
+			op, value = queryFilterOp(op, value, "<=")
+			age, ok := parseQueryAge(value)
+			if ok {
+				term.field, term.op, term.num = field, op, age
+				return term
+			}
+		}
+	}
+
+	// word or phrase
+	term.text = normaliseText(strings.Trim(token, `"`))
+	if term.text == "" {
+		return nil
+	}
+	return term
+}
+
+// splitQueryFilter splits filter at the first operator, e.g. rank>=4 to rank, >= and 4. blank field if it is not a filter
+func splitQueryFilter(token string) (field, op, value string) {
+	at := -1
+	for _, o := range queryOps {
+		i := strings.Index(token, o)
+		if i <= 0 || (at >= 0 && i >= at) {
+			continue
+		}
+		at, op = i, o
+	}
+	if at < 0 {
+		return "", "", ""
+	}
+
+	return strings.ToLower(token[:at]), op, token[at+len(op):]
+}
+
+// queryFilterOp gives operator of field:value filter, operator can follow the colon, e.g. rank:>=4
+func queryFilterOp(op, value, def string) (string, string) {
+	if op != ":" {
+		return op, value
+	}
+	for _, o := range queryOps[:5] {
+		if strings.HasPrefix(value, o) {
+			return o, value[len(o):]
+		}
+	}
+	return def, value
+}
+
+// parseQueryAge gives seconds of age, e.g. 30d
+func parseQueryAge(s string) (int64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	unit, ok := queryTimeUnits[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// NeedsBook tells if the query has filter on book record, e.g. author or rank
+func (q *Query) NeedsBook() bool {
+	return q.books
+}
+
+// Match tells if the book matches, words are matched against author, title and series
+func (q *Query) Match(book *Book) bool {
+	return q.match(book, searchText(book))
+}
+
+// searchText gives normalised author, title and series words are matched against
+func searchText(book *Book) string {
+	return normaliseText(book.Author + " " + book.Title + " " + book.Series)
+}
+
+// MatchName tells if the file matches, words are matched against the name. book is nil when file is not in db, filter on book
+// record then does not match
+func (q *Query) MatchName(book *Book, name string) bool {
+	return q.match(book, normaliseText(name))
+}
+
+// match tells if all clauses match, text is normalised
+func (q *Query) match(book *Book, text string) bool {
+	now := time.Now().Unix()
+
+	for _, clause := range q.clauses {
+		found := false
+		for _, term := range clause {
+			if term.match(book, text, now) != term.negate {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// match tells if term matches, negate is not applied
+func (t *queryTerm) match(book *Book, text string, now int64) bool {
+	if t.field == "" {
+		return strings.Contains(text, t.text)
+	}
+	if book == nil {
+		return false
+	}
+
+	switch t.field {
+	case "author":
+		return strings.Contains(normaliseText(book.Author), t.text)
+	case "title":
+		return strings.Contains(normaliseText(book.Title), t.text)
+	case "series":
+		return strings.Contains(normaliseText(book.Series), t.text)
+	case "fav":
+		return (book.Fav > 0) == (t.num > 0)
+	case "rank":
+		return compareQuery(book.Ranking, t.op, t.num)
+	case "pages":
+		return compareQuery(book.Pages, t.op, t.num)
+	case "added":
+		// younger is less
+		return compareQuery(now-book.Itime, t.op, t.num)
+	case "read":
+		if book.Rtime == 0 {
+			return false
+		}
+		return compareQuery(now-book.Rtime, t.op, t.num)
+	case "unread":
+		return book.Rtime == 0
+	case "finished":
+		return book.Rtime > 0 && book.Pages > 0 && book.Page >= book.Pages
+	}
+
+	return false
+}
+
+// compareQuery compares a to b by op
+func compareQuery(a int64, op string, b int64) bool {
+	switch op {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	}
+	return a == b
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// queryString gives the parsed query in short form, clauses split by space and OR terms by |
+func queryString(q *Query) string {
+	clauses := []string{}
+	for _, clause := range q.clauses {
+		terms := []string{}
+		for _, t := range clause {
+			s := ""
+			if t.negate {
+				s = "-"
+			}
+			switch {
+			case t.field == "":
+				s += fmt.Sprintf("%q", t.text)
+			case t.text != "":
+				s += t.field + ":" + fmt.Sprintf("%q", t.text)
+			case t.op != "":
+				s += fmt.Sprintf("%s%s%d", t.field, t.op, t.num)
+			case t.field == "fav":
+				s += fmt.Sprintf("fav:%d", t.num)
+			default:
+				s += t.field
+			}
+			terms = append(terms, s)
+		}
+		clauses = append(clauses, strings.Join(terms, "|"))
+	}
+	return strings.Join(clauses, " ")
+}
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		search string
+		want   string
+		books  bool
+	}{
+		{"", "", false},
+		{"  ", "", false},
+		{"One Piece", `"one" "piece"`, false},
+		{"ＯＮＥ　ｶﾀｶﾅ", `"one" "かたかな"`, false},
+		// quoting
+		{`"one piece" 01`, `"one piece" "01"`, false},
+		{`"one piece`, `"one piece"`, false},
+		{`""`, "", false},
+		{`a "" b`, `"a" "b"`, false},
+		// negation
+		{"-colour", `-"colour"`, false},
+		{`-"one piece"`, `-"one piece"`, false},
+		{"one - piece", `"one" "piece"`, false},
+		{"-", "", false},
+		{`-""`, "", false},
+		// filters
+		{"author:oda", `author:"oda"`, true},
+		{"Author:Oda", `author:"oda"`, true},
+		{`title:"one piece"`, `title:"one piece"`, true},
+		{"author:", "", false},
+		{"-series:naruto", `-series:"naruto"`, true},
+		{"fav:yes fav:no", "fav:1 fav:0", true},
+		{"fav:maybe", `"fav:maybe"`, false},
+		{"rank>=4 rank:>=4 rank:4 pages<200", "rank>=4 rank>=4 rank=4 pages<200", true},
+		{"rank>=x", `"rank>=x"`, false},
+		{"added:<30d read:>1y added:2w", "added<2592000 read>31536000 added<=1209600", true},
+		{"added:30x read:-1d", `"added:30x" "read:-1d"`, false},
+		{"unread -finished", "unread -finished", true},
+		{"http://x", `"http://x"`, false},
+		// OR
+		{"naruto OR boruto", `"naruto"|"boruto"`, false},
+		{"a OR b OR c d", `"a"|"b"|"c" "d"`, false},
+		{"OR a", `"a"`, false},
+		{"a OR", `"a"`, false},
+		{"a OR OR b", `"a"|"b"`, false},
+		{"a or b", `"a" "or" "b"`, false},
+		{"title:naruto OR rank>=4", `title:"naruto"|rank>=4`, true},
+	}
+
+	for _, c := range cases {
+		q := parseQuery(c.search)
+		if got := queryString(q); got != c.want {
+			t.Errorf("%q: %s, want %s", c.search, got, c.want)
+		}
+		if q.NeedsBook() != c.books {
+			t.Errorf("%q: needs book %v", c.search, q.NeedsBook())
+		}
+	}
+}
+
+// TestQueryListDirSameAsSearch file names hold author and title, so dir listing finds the same books as search
+func TestQueryListDirSameAsSearch(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+
+			ids := map[string]string{}
+			for _, name := range []string{"[Oda] One Piece 01.cbz", "[Oda] One Piece 02.cbz", "[Kishimoto] Naruto 01.cbz", "[Toriyama] Dragon Ball 01.cbz"} {
+				fpath := filepath.Join(dir, name)
+				writeTestBook(t, fpath, 3)
+				book, err := db.AddFile(fpath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[name] = book.ID
+			}
+			_, err := db.UpdateRanking(ids["[Kishimoto] Naruto 01.cbz"], 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.UpdatePage(ids["[Oda] One Piece 01.cbz"], 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := func(list FileList) string {
+				found := []string{}
+				for _, fib := range list {
+					if fib.IsBook {
+						found = append(found, fib.Name)
+					}
+				}
+				sort.Strings(found)
+				return strings.Join(found, ", ")
+			}
+
+			queries := []string{
+				"", "piece", "ｐｉｅｃｅ", `"one piece"`, "-piece", "piece OR naruto", "oda -02",
+				"author:oda", "title:naruto OR rank>=4", "rank>=4", "unread", "finished", `"one piece`, "-", "nothing",
+			}
+			for _, query := range queries {
+				_, searched, err := search(db, query, 1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, listed, err := listDir(db, dir, query, 1, sortOrderByFileName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if names(searched) != names(listed) {
+					t.Errorf("%q: search %s, list %s", query, names(searched), names(listed))
+				}
+			}
+		})
+	}
+}
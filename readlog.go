@@ -0,0 +1,295 @@
+package main
+
+// reading event log, every page read is appended, so reading history can be looked back on
+//
+// line format
+//   {read time},{book id},{page}
+// e.g.
+//   1792315752,A6tz9rCQ1u,12
+// consecutive page reads of the same book are joined into reading sessions when calculating stats
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadSessionGap is the longest pause between page reads within one reading session
+const ReadSessionGap = 10 * time.Minute
+
+// ReadEvent is a page read
+type ReadEvent struct {
+	Time   int64  // read time
+	BookID string // book id when read, could be renamed since
+	Page   int64
+}
+
+// ReadSession is pages of a book read in one sitting
+type ReadSession struct {
+	BookID   string
+	Start    int64 // first page read time
+	End      int64 // last page read time
+	LastPage int64 // page reached
+	Pages    int   // pages read, page shown again is not counted
+}
+
+// Duration gives time spent in the session
+func (s *ReadSession) Duration() time.Duration {
+	return time.Duration(s.End-s.Start) * time.Second
+}
+
+// ReadLog is the append-only reading event log, safe for concurrent use
+type ReadLog struct {
+	mutex *sync.Mutex
+	Path  string
+}
+
+// New initialize reading event log
+func (rl *ReadLog) New(logPath string) {
+	rl.mutex = &sync.Mutex{}
+	rl.Path = logPath
+}
+
+// Add appends page read of the book
+func (rl *ReadLog) Add(bookID string, page int) error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	f, err := os.OpenFile(rl.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%d,%s,%d\n", time.Now().Unix(), bookID, page)
+	return err
+}
+
+// Events gives all events in the order they were written, unreadable line is skipped, e.g. torn last line
+func (rl *ReadLog) Events() ([]*ReadEvent, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	f, err := os.Open(rl.Path)
+	if os.IsNotExist(err) {
+		return []*ReadEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := []*ReadEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), ",")
+		if len(cols) != 3 || cols[1] == "" {
+			continue
+		}
+		t, err := strconv.ParseInt(cols[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		page, err := strconv.ParseInt(cols[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		events = append(events, &ReadEvent{
+			Time:   t,
+			BookID: cols[1],
+			Page:   page,
+		})
+	}
+
+	return events, scanner.Err()
+}
+
+// readSessions joins consecutive page reads of the same book, pause longer than ReadSessionGap starts new session
+func readSessions(events []*ReadEvent) []*ReadSession {
+	sessions := []*ReadSession{}
+	var cur *ReadSession
+	var lastPage int64
+
+	for _, e := range events {
+		if cur == nil || cur.BookID != e.BookID || e.Time-cur.End > int64(ReadSessionGap.Seconds()) {
+			cur = &ReadSession{
+				BookID:   e.BookID,
+				Start:    e.Time,
+				End:      e.Time,
+				LastPage: e.Page,
+				Pages:    1,
+			}
+			lastPage = e.Page
+			sessions = append(sessions, cur)
+			continue
+		}
+
+		cur.End = e.Time
+		cur.LastPage = e.Page
+		// page shown again, e.g. read page and the image of it
+		if e.Page != lastPage {
+			cur.Pages++
+		}
+		lastPage = e.Page
+	}
+
+	return sessions
+}
+
+// ReadStats is reading statistics from the event log
+type ReadStats struct {
+	Days          []*ReadStatsDay    // pages per day, most recent first
+	Months        []*ReadStatsMonth  // books finished per month, most recent first
+	Series        []*ReadStatsSeries // time spent per series, most first
+	Streak        int                // days in a row with reading, up to today
+	LongestStreak int                // most days in a row with reading
+	Sessions      int                // reading sessions
+	Pages         int                // pages read
+}
+
+// ReadStatsDay is reading of a day
+type ReadStatsDay struct {
+	Day   string // e.g. 2006-01-02
+	Pages int
+}
+
+// ReadStatsMonth is books finished in a month
+type ReadStatsMonth struct {
+	Month string // e.g. 2006-01
+	Books []*Book
+}
+
+// ReadStatsSeries is time spent on a series
+type ReadStatsSeries struct {
+	Title    string
+	Key      string // series key, for link to the series
+	Duration time.Duration
+	Finished time.Time // last volume finished, zero if none
+}
+
+// readStats calculates statistics from the events, books are looked up in db. days is how many days of pages to give
+func readStats(db Library, events []*ReadEvent, now time.Time, days int) *ReadStats {
+	stats := &ReadStats{}
+	sessions := readSessions(events)
+	stats.Sessions = len(sessions)
+
+	// books looked up once
+	books := map[string]*Book{}
+	getBook := func(id string) *Book {
+		book, ok := books[id]
+		if !ok {
+			book = db.GetBookByID(id)
+			books[id] = book
+		}
+		return book
+	}
+
+	pagesByDay := map[string]int{}
+	finished := map[string]map[string]bool{} // month, book id
+	months := map[string]*ReadStatsMonth{}
+	bySeries := map[string]*ReadStatsSeries{}
+	for _, s := range sessions {
+		start := time.Unix(s.Start, 0).In(now.Location())
+		pagesByDay[start.Format("2006-01-02")] += s.Pages
+		stats.Pages += s.Pages
+
+		book := getBook(s.BookID)
+		if book == nil {
+			// removed from db
+			continue
+		}
+
+		key := seriesKey(book)
+		series := bySeries[key]
+		if series == nil {
+			series = &ReadStatsSeries{
+				Title: book.Series,
+				Key:   key,
+			}
+			bySeries[key] = series
+		}
+		series.Duration += s.Duration()
+
+		// reached the last page
+		if book.Pages <= 0 || s.LastPage < book.Pages {
+			continue
+		}
+		end := time.Unix(s.End, 0).In(now.Location())
+		if end.After(series.Finished) {
+			series.Finished = end
+		}
+		month := end.Format("2006-01")
+		if finished[month] == nil {
+			finished[month] = map[string]bool{}
+			months[month] = &ReadStatsMonth{Month: month}
+		}
+		if !finished[month][book.ID] {
+			finished[month][book.ID] = true
+			months[month].Books = append(months[month].Books, book)
+		}
+	}
+
+	// recent days, days without reading included
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for i := 0; i < days; i++ {
+		day := today.AddDate(0, 0, -i).Format("2006-01-02")
+		stats.Days = append(stats.Days, &ReadStatsDay{Day: day, Pages: pagesByDay[day]})
+	}
+
+	for _, m := range months {
+		stats.Months = append(stats.Months, m)
+	}
+	sort.Slice(stats.Months, func(i, j int) bool {
+		return stats.Months[i].Month > stats.Months[j].Month
+	})
+
+	for _, s := range bySeries {
+		stats.Series = append(stats.Series, s)
+	}
+	sort.Slice(stats.Series, func(i, j int) bool {
+		return stats.Series[i].Duration > stats.Series[j].Duration
+	})
+
+	stats.Streak, stats.LongestStreak = readStreaks(pagesByDay, today)
+
+	return stats
+}
+
+// readStreaks gives days in a row with reading, current one counts from today or yesterday if not read today yet
+func readStreaks(pagesByDay map[string]int, today time.Time) (current, longest int) {
+	days := []string{}
+	for day := range pagesByDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	run := 0
+	var prev time.Time
+	for _, day := range days {
+		t, err := time.ParseInLocation("2006-01-02", day, today.Location())
+		if err != nil {
+			continue
+		}
+		if run > 0 && prev.AddDate(0, 0, 1).Equal(t) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = t
+	}
+
+	// streak is broken when last reading is before yesterday
+	if run > 0 && !prev.Before(today.AddDate(0, 0, -1)) {
+		current = run
+	}
+
+	return current, longest
+}
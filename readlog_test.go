@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadSessions(t *testing.T) {
+	gap := int64(ReadSessionGap.Seconds())
+	events := []*ReadEvent{
+		{Time: 1000, BookID: "a", Page: 1},
+		{Time: 1010, BookID: "a", Page: 1}, // same page again, e.g. image of the page
+		{Time: 1020, BookID: "a", Page: 2},
+		{Time: 1020 + gap, BookID: "a", Page: 3},       // pause of exactly the gap is same session
+		{Time: 1020 + gap*2 + 1, BookID: "a", Page: 4}, // longer pause is new session
+		{Time: 1020 + gap*2 + 2, BookID: "b", Page: 1}, // other book is new session
+	}
+
+	sessions := readSessions(events)
+	want := []ReadSession{
+		{BookID: "a", Start: 1000, End: 1020 + gap, LastPage: 3, Pages: 3},
+		{BookID: "a", Start: 1020 + gap*2 + 1, End: 1020 + gap*2 + 1, LastPage: 4, Pages: 1},
+		{BookID: "b", Start: 1020 + gap*2 + 2, End: 1020 + gap*2 + 2, LastPage: 1, Pages: 1},
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("%d sessions, want %d", len(sessions), len(want))
+	}
+	for i, s := range sessions {
+		if *s != want[i] {
+			t.Errorf("session %d: %+v, want %+v", i, *s, want[i])
+		}
+	}
+}
+
+func TestReadStreaks(t *testing.T) {
+	db, _ := newTestLibrary(t, LibraryBackendFlat)
+	jst := time.FixedZone("JST", 9*3600)
+	est := time.FixedZone("EST", -5*3600)
+
+	// page reads of different books, so each is own session
+	at := func(loc *time.Location, times ...string) []*ReadEvent {
+		events := []*ReadEvent{}
+		for i, s := range times {
+			tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, &ReadEvent{Time: tm.Unix(), BookID: string(rune('a' + i)), Page: 1})
+		}
+		return events
+	}
+
+	cases := []struct {
+		name             string
+		loc              *time.Location
+		events           []*ReadEvent
+		current, longest int
+	}{
+		{"none", time.UTC, nil, 0, 0},
+		{"today", time.UTC, at(time.UTC, "2026-10-18 08:00"), 1, 1},
+		{"yesterday keeps streak", time.UTC, at(time.UTC, "2026-10-16 10:00", "2026-10-17 10:00"), 2, 2},
+		{"before yesterday breaks streak", time.UTC, at(time.UTC, "2026-10-15 10:00", "2026-10-16 10:00"), 0, 2},
+		{"across midnight", time.UTC, at(time.UTC, "2026-10-16 23:59", "2026-10-17 00:01", "2026-10-18 00:00"), 3, 3},
+		{"gap day", time.UTC, at(time.UTC, "2026-10-10 10:00", "2026-10-11 10:00", "2026-10-12 10:00", "2026-10-14 10:00", "2026-10-18 10:00"), 1, 3},
+		// 14:30 and 15:30 utc are either side of midnight in tokyo, same morning in new york
+		{"tokyo", jst, at(time.UTC, "2026-10-17 14:30", "2026-10-17 15:30"), 2, 2},
+		{"new york", est, at(time.UTC, "2026-10-17 14:30", "2026-10-17 15:30"), 1, 1},
+	}
+
+	for _, c := range cases {
+		now := time.Date(2026, 10, 18, 12, 0, 0, 0, c.loc)
+		stats := readStats(db, c.events, now, 7)
+		if stats.Streak != c.current || stats.LongestStreak != c.longest {
+			t.Errorf("%s: streak %d longest %d, want %d %d", c.name, stats.Streak, stats.LongestStreak, c.current, c.longest)
+		}
+	}
+
+	// session over midnight counts on the day it started
+	events := []*ReadEvent{
+		{Time: time.Date(2026, 10, 16, 23, 55, 0, 0, time.UTC).Unix(), BookID: "a", Page: 1},
+		{Time: time.Date(2026, 10, 17, 0, 5, 0, 0, time.UTC).Unix(), BookID: "a", Page: 2},
+	}
+	stats := readStats(db, events, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), 7)
+	if stats.Sessions != 1 || stats.Streak != 0 || stats.Days[2].Day != "2026-10-16" || stats.Days[2].Pages != 2 {
+		t.Errorf("over midnight: %d sessions, streak %d, %+v", stats.Sessions, stats.Streak, stats.Days[2])
+	}
+}
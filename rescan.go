@@ -0,0 +1,244 @@
+package main
+
+// periodic rescan of allowed dirs, picks up added, replaced and removed books
+//
+// dir listing is only read again when the dir mtime changed, as adding or removing a file changes it.
+// known books are checked by stat, the file is only opened again when size or mtime changed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RescanReport is the result of one rescan pass
+type RescanReport struct {
+	Dirs     int // dirs listed, unchanged dirs are not counted
+	Checked  int // known books checked
+	Added    int // new books
+	Changed  int // books with replaced file
+	Missing  int // books found missing in this pass
+	Returned int // missing books found again
+}
+
+// String gives summary for the log
+func (r *RescanReport) String() string {
+	return fmt.Sprintf("dirs %d, checked %d, added %d, changed %d, missing %d, returned %d",
+		r.Dirs, r.Checked, r.Added, r.Changed, r.Missing, r.Returned)
+}
+
+// scannedDir is state of dir from the last pass
+type scannedDir struct {
+	mtime   int64
+	subdirs []string
+}
+
+// Rescanner checks allowed dirs for changes, keeps the dir state between passes
+type Rescanner struct {
+	db      Library
+	scanner *Scanner // pass waits for its running scan, and the other way round
+	dirs    []string
+	seen    map[string]*scannedDir // by dir path
+}
+
+// newRescanner gives rescanner of the dirs, first pass lists every dir
+func newRescanner(db Library, scanner *Scanner, dirs []string) *Rescanner {
+	return &Rescanner{
+		db:      db,
+		scanner: scanner,
+		dirs:    dirs,
+		seen:    map[string]*scannedDir{},
+	}
+}
+
+// Run rescans on every interval, never returns
+func (s *Rescanner) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		start := time.Now()
+		report, err := s.Scan()
+		if err != nil {
+			log.Println("rescan failed -", err)
+			continue
+		}
+		log.Println("rescan done in", time.Since(start).Round(time.Millisecond), "-", report)
+	}
+}
+
+// Scan does one pass, updates known books then adds new files
+func (s *Rescanner) Scan() (*RescanReport, error) {
+	s.scanner.lock.Lock()
+	defer s.scanner.lock.Unlock()
+
+	report := &RescanReport{}
+
+	// known books, missing ones too
+	books := s.db.Books()
+	known := make(map[string]bool, len(books))
+	for _, book := range books {
+		known[book.Fullpath] = true
+	}
+
+	// allowed dir that cannot be reached, e.g. unmounted drive, its books are not marked missing
+	offline := []string{}
+	for _, dir := range s.dirs {
+		_, err := os.Stat(dir)
+		if err != nil {
+			offline = append(offline, dir)
+		}
+	}
+
+	// check known books
+	now := time.Now().Unix()
+	updates := []*Book{}
+	for _, book := range books {
+		report.Checked++
+
+		fstat, err := os.Stat(book.Fullpath)
+		if err != nil {
+			if !os.IsNotExist(err) || book.Cond == 2 || inDirs(book.Fullpath, offline) {
+				continue
+			}
+			book.Cond = 2
+			if book.Gtime == 0 {
+				book.Gtime = now
+			}
+			report.Missing++
+			updates = append(updates, book)
+			log.Println("book missing", book.ID, book.Fullpath)
+			continue
+		}
+
+		changed := false
+		if book.Cond != 1 {
+			if book.Cond == 2 {
+				report.Returned++
+			}
+			book.Cond = 1
+			book.Gtime = 0
+			changed = true
+		}
+
+		// inode changes on copy, device is not known for books from older db
+		if inode, dev := fileInode(fstat), fileDevice(fstat); book.Inode != inode || book.Dev != dev {
+			book.Inode = inode
+			book.Dev = dev
+			changed = true
+		}
+
+		// file replaced, read it again. unreadable file is tried again next pass, returned book is still saved
+		if fstat.Size() != book.Size || fstat.ModTime().Unix() != book.Mtime {
+			pages, hash, info, err := cbzRead(book.Fullpath)
+			if err != nil {
+				log.Println("failed to read book", book.Fullpath, err)
+			} else {
+				book.Size = fstat.Size()
+				book.Mtime = fstat.ModTime().Unix()
+				book.Pages = pages
+				book.Hash = hash
+				book.Info = info
+				report.Changed++
+				changed = true
+				log.Println("book changed", book.ID, book.Fullpath)
+			}
+		}
+
+		if changed {
+			updates = append(updates, book)
+		}
+	}
+
+	if len(updates) > 0 {
+		err := s.db.UpdateFileState(updates)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// new files, only from changed dirs
+	fpaths := []string{}
+	for _, dir := range s.dirs {
+		s.walk(dir, known, &fpaths, report)
+	}
+	if len(fpaths) > 0 {
+		added, err := s.db.AddFiles(fpaths)
+		report.Added = len(added)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// walk goes through dir and subdirs, collects files not in db from dirs changed since last pass
+func (s *Rescanner) walk(dir string, known map[string]bool, fpaths *[]string, report *RescanReport) {
+	fstat, err := os.Stat(dir)
+	if err != nil || !fstat.IsDir() {
+		delete(s.seen, dir)
+		return
+	}
+
+	last := s.seen[dir]
+	if last == nil || last.mtime != fstat.ModTime().UnixNano() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Println("failed to list dir", dir, err)
+			return
+		}
+		report.Dirs++
+
+		last = &scannedDir{mtime: fstat.ModTime().UnixNano()}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			fpath := filepath.Join(dir, f.Name())
+			if f.IsDir() {
+				last.subdirs = append(last.subdirs, fpath)
+				continue
+			}
+			if !known[fpath] {
+				*fpaths = append(*fpaths, fpath)
+			}
+		}
+		s.seen[dir] = last
+	}
+
+	for _, subdir := range last.subdirs {
+		s.walk(subdir, known, fpaths, report)
+	}
+}
+
+// inDirs checks if file is within one of the dirs
+func inDirs(fpath string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(fpath, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFileState copies what rescan reads from the file, user data is kept
+func (b *Book) setFileState(src *Book) {
+	b.Cond = src.Cond
+	b.Gtime = src.Gtime
+	b.Size = src.Size
+	b.Mtime = src.Mtime
+	b.Inode = src.Inode
+	b.Dev = src.Dev
+	b.Pages = src.Pages
+	b.Hash = src.Hash
+	b.Info = src.Info
+
+	// ComicInfo could have changed
+	fname := filepath.Base(b.Fullpath)
+	b.setMetadata(getTitle(fname), getAuthor(fname), getNumber(fname))
+}
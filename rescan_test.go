@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRescanReturnedUnreadable(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+			rescanner := newRescanner(db, newScanner(db, 1), []string{dir})
+
+			fpath := filepath.Join(dir, "[Author] Title 01.cbz")
+			writeTestBook(t, fpath, 3)
+			book, err := db.AddFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = os.Remove(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := rescanner.Scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Missing != 1 || db.GetBookByID(book.ID).Cond != 2 {
+				t.Fatalf("missing %d, cond %d", report.Missing, db.GetBookByID(book.ID).Cond)
+			}
+
+			// back, but cannot be read
+			err = ioutil.WriteFile(fpath, []byte("not a zip"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err = rescanner.Scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := db.GetBookByID(book.ID)
+			if report.Returned != 1 || got.Cond != 1 || got.Gtime != 0 {
+				t.Errorf("returned %d, cond %d, gtime %d", report.Returned, got.Cond, got.Gtime)
+			}
+			if got.Pages != 3 {
+				t.Errorf("pages %d, want the last read 3", got.Pages)
+			}
+		})
+	}
+}
+
+func TestScanAndRescanConcurrent(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			db, dir := newTestLibrary(t, backend)
+			scanner := newScanner(db, 4)
+			rescanner := newRescanner(db, scanner, []string{dir})
+
+			fpaths := []string{}
+			for i := 0; i < 20; i++ {
+				fpath := filepath.Join(dir, fmt.Sprintf("[Author] Title %02d.cbz", i))
+				writeTestBook(t, fpath, 2)
+				fpaths = append(fpaths, fpath)
+			}
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					scanner.Scan([]string{dir})
+				}()
+				go func() {
+					defer wg.Done()
+					rescanner.Scan()
+				}()
+			}
+			wg.Wait()
+
+			if db.Count() != len(fpaths) {
+				t.Errorf("%d books, want %d", db.Count(), len(fpaths))
+			}
+			for _, fpath := range fpaths {
+				if n := countPath(db, fpath); n != 1 {
+					t.Errorf("%s: %d books", filepath.Base(fpath), n)
+				}
+			}
+		})
+	}
+}
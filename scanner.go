@@ -0,0 +1,248 @@
+package main
+
+// library scanner, book files are read by a pool of workers and added to db by one writer
+//
+// reading the cbz is the slow part on spinning disk and network drive, db file is written by one goroutine
+// in batches so the records stay in order and the db lock is held briefly
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrScanRunning scan is already running
+var ErrScanRunning = errors.New("scan is already running")
+
+// ScanProgress is the state of the last or running scan
+type ScanProgress struct {
+	Running   bool      `json:"running"`
+	Cancelled bool      `json:"cancelled"`
+	Total     int       `json:"total"`  // files found
+	Seen      int       `json:"seen"`   // files done
+	Added     int       `json:"added"`  // new books
+	Failed    int       `json:"failed"` // files that cannot be read as book
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	ETA       int64     `json:"eta"` // seconds left, estimated from the speed so far
+	Error     string    `json:"error,omitempty"`
+}
+
+// Scanner adds books from dirs, one scan at a time
+type Scanner struct {
+	db      Library
+	workers int
+
+	mutex    sync.Mutex
+	progress ScanProgress
+	cancel   context.CancelFunc
+
+	// held while scan or rescan runs, so only one of them reads dirs and adds to db at a time
+	lock sync.Mutex
+}
+
+// newScanner gives scanner with number of workers reading book files
+func newScanner(db Library, workers int) *Scanner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scanner{
+		db:      db,
+		workers: workers,
+	}
+}
+
+// Progress gives copy of the progress, with ETA
+func (s *Scanner) Progress() ScanProgress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p := s.progress
+	if p.Running && p.Seen > 0 && p.Total > p.Seen {
+		perFile := time.Since(p.Started) / time.Duration(p.Seen)
+		p.ETA = int64((perFile * time.Duration(p.Total-p.Seen)).Seconds())
+	}
+
+	return p
+}
+
+// Start scans the dirs in background
+func (s *Scanner) Start(dirs []string) error {
+	ctx, cancel, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	go s.run(ctx, cancel, dirs)
+
+	return nil
+}
+
+// Scan scans the dirs, returns when done or cancelled
+func (s *Scanner) Scan(dirs []string) (ScanProgress, error) {
+	ctx, cancel, err := s.begin()
+	if err != nil {
+		return s.Progress(), err
+	}
+
+	err = s.run(ctx, cancel, dirs)
+
+	return s.Progress(), err
+}
+
+// Cancel stops the running scan, books read so far are still added. false if no scan is running
+func (s *Scanner) Cancel() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.progress.Running {
+		return false
+	}
+	s.cancel()
+	s.progress.Cancelled = true
+
+	return true
+}
+
+// begin marks scan as running, progress is reset
+func (s *Scanner) begin() (context.Context, context.CancelFunc, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.progress.Running {
+		return nil, nil, ErrScanRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.progress = ScanProgress{
+		Running: true,
+		Started: time.Now(),
+	}
+
+	return ctx, cancel, nil
+}
+
+// update changes the progress under lock
+func (s *Scanner) update(fn func(p *ScanProgress)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fn(&s.progress)
+}
+
+// run does the scan, progress is marked done at the end
+func (s *Scanner) run(ctx context.Context, cancel context.CancelFunc, dirs []string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defer func() {
+		cancel()
+		s.update(func(p *ScanProgress) {
+			p.Running = false
+			p.Finished = time.Now()
+			if err != nil {
+				p.Error = err.Error()
+			}
+		})
+		p := s.Progress()
+		log.Println("scan done, found", p.Total, "added", p.Added, "failed", p.Failed, "cancelled", p.Cancelled)
+	}()
+
+	// files not in db yet
+	fpaths := []string{}
+	for _, dir := range dirs {
+		files, err := listFiles(dir, true)
+		if err != nil {
+			log.Println("failed to list dir", dir, err)
+			continue
+		}
+		for _, fpath := range files {
+			if checkBookFileType(fpath) != nil || s.db.GetBookByPath(fpath) != nil {
+				continue
+			}
+			fpaths = append(fpaths, fpath)
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	s.update(func(p *ScanProgress) {
+		p.Total = len(fpaths)
+	})
+
+	// workers read the files
+	jobs := make(chan string)
+	results := make(chan *Book)
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fpath := range jobs {
+				book, err := newBook(fpath)
+				s.update(func(p *ScanProgress) {
+					p.Seen++
+					if err != nil {
+						p.Failed++
+					}
+				})
+				if err != nil {
+					log.Println("failed to read book", fpath, err)
+					continue
+				}
+				results <- book
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, fpath := range fpaths {
+			select {
+			case jobs <- fpath:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// one writer adds to db in batches
+	batch := []*Book{}
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		added, err := s.db.AddBooks(batch)
+		batch = []*Book{}
+		s.update(func(p *ScanProgress) {
+			p.Added += len(added)
+		})
+		return err
+	}
+	for book := range results {
+		if err != nil {
+			// drain, so workers can finish
+			continue
+		}
+		batch = append(batch, book)
+		if len(batch) >= FlatDBBatchSize {
+			err = commit()
+			if err != nil {
+				// stop workers, db is not writable
+				cancel()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return commit()
+}
@@ -0,0 +1,262 @@
+package main
+
+// in-memory search index, bigrams of the normalised author, title and series of each book
+//
+// word of 2 or more characters only needs the books that have all of its bigrams, so most books are never looked at.
+// bigram works for japanese without word splitting, e.g. ワンピース is わん んぴ ぴす (long vowel dropped).
+// books found are checked against the whole query, so index only has to give too many, never too few
+
+import "unicode/utf8"
+
+// searchIndexCompactRatio is how many replaced docs per live doc before the index is rebuilt
+const searchIndexCompactRatio = 1
+
+// searchIndex is bigram index of books, caller must hold the db lock
+type searchIndex struct {
+	docs  []*searchDoc       // in order added, replaced ones are kept as dead
+	byID  map[string]int32   // live doc of book id
+	grams map[string][]int32 // docs that have the bigram, ascending
+	dead  int                // number of dead docs
+}
+
+// searchDoc is a book in the index
+type searchDoc struct {
+	book *Book
+	text string // normalised author, title and series
+	dead bool
+
+	// as indexed, to tell if the book changed without normalising again
+	author string
+	title  string
+	series string
+}
+
+// newSearchIndex gives blank index
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		byID:  make(map[string]int32),
+		grams: make(map[string][]int32),
+	}
+}
+
+// put adds the book, or updates it when author, title or series changed
+func (idx *searchIndex) put(book *Book) {
+	var doc *searchDoc
+	if n, ok := idx.byID[book.ID]; ok {
+		doc = idx.docs[n]
+		if doc.book == book && doc.author == book.Author && doc.title == book.Title && doc.series == book.Series {
+			return
+		}
+	}
+
+	text := searchText(book)
+	if doc != nil {
+		// e.g. only case changed
+		if doc.text == text {
+			doc.book, doc.author, doc.title, doc.series = book, book.Author, book.Title, book.Series
+			return
+		}
+		doc.dead = true
+		idx.dead++
+	}
+
+	n := int32(len(idx.docs))
+	idx.docs = append(idx.docs, &searchDoc{
+		book:   book,
+		text:   text,
+		author: book.Author,
+		title:  book.Title,
+		series: book.Series,
+	})
+	idx.byID[book.ID] = n
+	for _, gram := range bigrams(text) {
+		idx.grams[gram] = append(idx.grams[gram], n)
+	}
+
+	idx.compactIfSparse()
+}
+
+// remove drops the book of the id, nothing if it is not in the index
+func (idx *searchIndex) remove(id string) {
+	n, ok := idx.byID[id]
+	if !ok {
+		return
+	}
+	idx.docs[n].dead = true
+	idx.dead++
+	delete(idx.byID, id)
+
+	idx.compactIfSparse()
+}
+
+// retain drops books that keep does not want, e.g. purged or given new id
+func (idx *searchIndex) retain(keep func(id string) bool) {
+	ids := []string{}
+	for id := range idx.byID {
+		if !keep(id) {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		idx.remove(id)
+	}
+}
+
+// compactIfSparse compacts when there are too many dead docs
+func (idx *searchIndex) compactIfSparse() {
+	if idx.dead > 0 && idx.dead > (len(idx.docs)-idx.dead)*searchIndexCompactRatio {
+		idx.compact()
+	}
+}
+
+// compact rebuilds the index without dead docs
+func (idx *searchIndex) compact() {
+	docs := idx.docs
+
+	*idx = *newSearchIndex()
+	for _, doc := range docs {
+		if !doc.dead {
+			idx.put(doc.book)
+		}
+	}
+}
+
+// search gives books that match the query, in order added
+func (idx *searchIndex) search(q *Query) []*Book {
+	books := []*Book{}
+
+	match := func(doc *searchDoc) {
+		if !doc.dead && q.match(doc.book, doc.text) {
+			books = append(books, doc.book)
+		}
+	}
+
+	docs, ok := idx.candidates(q)
+	if !ok {
+		for _, doc := range idx.docs {
+			match(doc)
+		}
+		return books
+	}
+	for _, n := range docs {
+		match(idx.docs[n])
+	}
+
+	return books
+}
+
+// candidates gives docs that could match the query, false if the query has no word to narrow down with
+func (idx *searchIndex) candidates(q *Query) ([]int32, bool) {
+	var docs []int32
+	narrowed := false
+
+	for _, clause := range q.clauses {
+		found, ok := idx.clauseCandidates(clause)
+		if !ok {
+			continue
+		}
+		if narrowed {
+			docs = intersectDocs(docs, found)
+		} else {
+			docs = found
+			narrowed = true
+		}
+		if len(docs) == 0 {
+			break
+		}
+	}
+
+	return docs, narrowed
+}
+
+// clauseCandidates gives docs that could match any of the terms, false if a term cannot be looked up,
+// e.g. filter, left out word or word of 1 character
+func (idx *searchIndex) clauseCandidates(clause []*queryTerm) ([]int32, bool) {
+	var docs []int32
+
+	for _, term := range clause {
+		if term.negate || (term.field != "" && !queryTextFields[term.field]) {
+			return nil, false
+		}
+		grams := bigrams(term.text)
+		if len(grams) == 0 {
+			return nil, false
+		}
+
+		// rarest bigram first, so the list stays short
+		found := idx.grams[grams[0]]
+		for _, gram := range grams[1:] {
+			if len(idx.grams[gram]) < len(found) {
+				found = idx.grams[gram]
+			}
+		}
+		for _, gram := range grams {
+			found = intersectDocs(found, idx.grams[gram])
+		}
+
+		docs = unionDocs(docs, found)
+	}
+
+	return docs, true
+}
+
+// bigrams gives each pair of characters in text once
+func bigrams(text string) []string {
+	if utf8.RuneCountInString(text) < 2 {
+		return nil
+	}
+
+	rs := []rune(text)
+	seen := make(map[string]bool, len(rs))
+	grams := make([]string, 0, len(rs)-1)
+	for i := 0; i < len(rs)-1; i++ {
+		gram := string(rs[i : i+2])
+		if seen[gram] {
+			continue
+		}
+		seen[gram] = true
+		grams = append(grams, gram)
+	}
+
+	return grams
+}
+
+// intersectDocs gives docs in both ascending lists
+func intersectDocs(a, b []int32) []int32 {
+	docs := []int32{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			docs = append(docs, a[i])
+			i++
+			j++
+		}
+	}
+	return docs
+}
+
+// unionDocs gives docs in either ascending list
+func unionDocs(a, b []int32) []int32 {
+	docs := make([]int32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			docs = append(docs, a[i])
+			i++
+		case a[i] > b[j]:
+			docs = append(docs, b[j])
+			j++
+		default:
+			docs = append(docs, a[i])
+			i++
+			j++
+		}
+	}
+	docs = append(docs, a[i:]...)
+	return append(docs, b[j:]...)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchIndexPut(t *testing.T) {
+	idx := newSearchIndex()
+	one := &Book{ID: "one", Title: "One Piece", Author: "Oda"}
+	naruto := &Book{ID: "naruto", Title: "Naruto", Author: "Kishimoto"}
+	idx.put(one)
+	idx.put(naruto)
+
+	// unchanged book is not added again
+	idx.put(one)
+	if len(idx.docs) != 2 {
+		t.Fatalf("%d docs, want 2", len(idx.docs))
+	}
+
+	// changed in place
+	one.Title = "Wan Pisu"
+	idx.put(one)
+	if books := idx.search(parseQuery("piece")); len(books) != 0 {
+		t.Errorf("old title found %d books", len(books))
+	}
+	if books := idx.search(parseQuery("pisu")); len(books) != 1 || books[0] != one {
+		t.Errorf("new title found %v", books)
+	}
+
+	idx.remove("naruto")
+	if books := idx.search(parseQuery("")); len(books) != 1 || books[0] != one {
+		t.Errorf("after remove %v", books)
+	}
+	if idx.dead != 0 || len(idx.docs) != 1 {
+		t.Errorf("not compacted, %d docs, %d dead", len(idx.docs), idx.dead)
+	}
+}
+
+func TestFlatDBReindexKeepsSearch(t *testing.T) {
+	lib, dir := newTestLibrary(t, LibraryBackendFlat)
+	db := lib.(*FlatDB)
+
+	fpaths := []string{}
+	for _, name := range []string{"[Oda] One Piece 01.cbz", "[Kishimoto] Naruto 01.cbz", "[Toriyama] Dragon Ball 01.cbz"} {
+		fpath := filepath.Join(dir, name)
+		writeTestBook(t, fpath, 3)
+		fpaths = append(fpaths, fpath)
+	}
+	books, err := db.AddFiles(fpaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := db.search.docs[0]
+
+	_, err = db.UpdateMeta(books[1].ID, BookMeta{Title: "Boruto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.search.docs[0] != first {
+		t.Error("unchanged book is indexed again")
+	}
+	if found := db.Search("naruto"); len(found) != 0 {
+		t.Errorf("old title found %d books", len(found))
+	}
+	if found := db.Search("boruto"); len(found) != 1 || found[0].ID != books[1].ID {
+		t.Errorf("new title found %v", found)
+	}
+
+	// purged book is gone from search
+	err = os.Remove(fpaths[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Compact(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := db.Search("dragon"); len(found) != 0 {
+		t.Errorf("purged book found %d books", len(found))
+	}
+	if found := db.Search(""); len(found) != 2 {
+		t.Errorf("%d books, want 2", len(found))
+	}
+}
+
+func TestSearchPageSkipsMissing(t *testing.T) {
+	defer func(n int) { ItemsPerPage = n }(ItemsPerPage)
+	ItemsPerPage = 3
+
+	db, dir := newTestLibrary(t, LibraryBackendFlat)
+	fpaths := []string{}
+	for i := 0; i < 8; i++ {
+		fpath := filepath.Join(dir, fmt.Sprintf("[Author] Title %02d.cbz", i))
+		writeTestBook(t, fpath, 2)
+		fpaths = append(fpaths, fpath)
+	}
+	_, err := db.AddFiles(fpaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gone from first and second page
+	for _, i := range []int{1, 3, 4} {
+		err = os.Remove(fpaths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		page   int
+		status int
+		names  []int
+	}{
+		{1, 2, []int{0, 2, 5}},
+		{2, 1, []int{6, 7}},
+		{3, 1, []int{}},
+	}
+	for _, c := range cases {
+		status, list, err := search(db, "", c.page, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, fib := range list {
+			names = append(names, fib.Name)
+		}
+		want := []string{}
+		for _, i := range c.names {
+			want = append(want, filepath.Base(fpaths[i]))
+		}
+		if status != c.status || fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("page %d: status %d %v, want %d %v", c.page, status, names, c.status, want)
+		}
+	}
+}
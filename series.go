@@ -0,0 +1,159 @@
+package main
+
+// series, books grouped by title and author, volumes in order of the number
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Series is books of the same title and author
+type Series struct {
+	Key     string  // id of the series, from the normalised title and author
+	Title   string  // title of the first volume
+	Author  string  // author of the first volume
+	Books   []*Book // volumes, in order of number
+	Read    int     // volumes read to the end
+	Missing []int   // volume numbers not in the library, from 1 to the last one
+}
+
+// Cover gives the book that represents the series
+func (s *Series) Cover() *Book {
+	return s.Books[0]
+}
+
+var (
+	regexVolumeRange = regexp.MustCompile(`(\d+)\s*(?:[\-\~〜]\s*(\d+))?`)
+	regexSpaces      = regexp.MustCompile(`\s+`)
+)
+
+// volumeRange gives the volume numbers a book number covers, e.g. 第01巻 is 1 to 1, 1-3話 is 1 to 3.
+// full width digit and kanji numeral are read too, e.g. 第１２巻 and 第十二巻 are 12. ok is false when number has no volume number
+func volumeRange(number string) (first, last int, ok bool) {
+	// 上中下巻
+	for i, s := range []string{"上", "中", "下"} {
+		if strings.HasPrefix(number, s) {
+			return i + 1, i + 1, true
+		}
+	}
+
+	// regexp digit is ascii only
+	result := regexVolumeRange.FindStringSubmatch(normaliseText(number))
+	if result == nil {
+		return 0, 0, false
+	}
+	first, err := strconv.Atoi(result[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	last = first
+	if result[2] != "" {
+		last, err = strconv.Atoi(result[2])
+		if err != nil || last < first {
+			last = first
+		}
+	}
+
+	return first, last, true
+}
+
+// normaliseName gives name for comparing, case, width and spacing are ignored
+func normaliseName(name string) string {
+	return strings.TrimSpace(regexSpaces.ReplaceAllString(strings.ToLower(normaliseWidth(name)), " "))
+}
+
+// seriesKey gives id of the series the book belongs to
+func seriesKey(book *Book) string {
+	sum := sha1.Sum([]byte(normaliseName(book.Series) + "\x00" + normaliseName(book.Author)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// buildSeries groups books by series, ordered by title
+func buildSeries(books []*Book) []*Series {
+	byKey := map[string]*Series{}
+	list := []*Series{}
+
+	for _, book := range books {
+		key := seriesKey(book)
+		series := byKey[key]
+		if series == nil {
+			series = &Series{
+				Key:    key,
+				Title:  book.Series,
+				Author: book.Author,
+			}
+			byKey[key] = series
+			list = append(list, series)
+		}
+		series.Books = append(series.Books, book)
+	}
+
+	for _, series := range list {
+		series.order()
+	}
+	keys := naturalKeys{}
+	sort.Slice(list, func(i, j int) bool {
+		return keys.less(list[i].Title+" "+list[i].Author, list[j].Title+" "+list[j].Author)
+	})
+
+	return list
+}
+
+// SeriesMaxVolume is the highest number taken as volume when counting missing volumes
+const SeriesMaxVolume = 2000
+
+// SeriesMaxGap is the most volumes between a volume and the one before it, counted as missing
+const SeriesMaxGap = 100
+
+// order sorts the volumes by number, then counts read and missing volumes
+func (s *Series) order() {
+	books := s.Books
+	keys := naturalKeys{}
+	sort.SliceStable(books, func(i, j int) bool {
+		a, _, okA := volumeRange(books[i].Number)
+		b, _, okB := volumeRange(books[j].Number)
+		if okA != okB {
+			// unnumbered, e.g. one shot, goes first
+			return !okA
+		}
+		if a != b {
+			return a < b
+		}
+		return keys.less(books[i].Fullpath, books[j].Fullpath)
+	})
+
+	s.Read = 0
+	have := map[int]bool{}
+	maxNum := 0
+	for _, book := range books {
+		if book.Rtime > 0 && book.Page >= book.Pages {
+			s.Read++
+		}
+
+		first, last, ok := volumeRange(book.Number)
+		if !ok {
+			continue
+		}
+		// not a volume, e.g. date 20190101 as ComicInfo number, or too far ahead to count the gap
+		if last > SeriesMaxVolume || last-maxNum > SeriesMaxGap {
+			continue
+		}
+		for n := first; n <= last; n++ {
+			have[n] = true
+		}
+		if last > maxNum {
+			maxNum = last
+		}
+	}
+
+	s.Missing = nil
+	for n := 1; n < maxNum; n++ {
+		if !have[n] {
+			s.Missing = append(s.Missing, n)
+		}
+	}
+}
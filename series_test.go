@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestVolumeRange(t *testing.T) {
+	cases := []struct {
+		number      string
+		first, last int
+		ok          bool
+	}{
+		{"第01巻", 1, 1, true},
+		{"1-3話", 1, 3, true},
+		{"v05", 5, 5, true},
+		{"第１２巻", 12, 12, true},
+		{"第十二巻", 12, 12, true},
+		{"二十一〜二十三", 21, 23, true},
+		{"１～３", 1, 3, true},
+		{"3-1", 3, 3, true},
+		{"上巻", 1, 1, true},
+		{"下", 3, 3, true},
+		{"extra", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		first, last, ok := volumeRange(c.number)
+		if first != c.first || last != c.last || ok != c.ok {
+			t.Errorf("%q: %d %d %v, want %d %d %v", c.number, first, last, ok, c.first, c.last, c.ok)
+		}
+	}
+}
+
+func TestSeriesOrderKanjiNumber(t *testing.T) {
+	books := []*Book{
+		{ID: "c", Title: "T", Series: "T", Number: "第十巻", Fullpath: "/c"},
+		{ID: "a", Title: "T", Series: "T", Number: "第二巻", Fullpath: "/a"},
+		{ID: "b", Title: "T", Series: "T", Number: "第３巻", Fullpath: "/b"},
+	}
+
+	list := buildSeries(books)
+	if len(list) != 1 {
+		t.Fatalf("%d series, want 1", len(list))
+	}
+	ids := ""
+	for _, book := range list[0].Books {
+		ids += book.ID
+	}
+	if ids != "abc" {
+		t.Errorf("order %s, want abc", ids)
+	}
+}
+
+func TestSeriesMissingImplausible(t *testing.T) {
+	cases := []struct {
+		numbers []string
+		missing string
+	}{
+		{[]string{"1", "4"}, "[2 3]"},
+		{[]string{"1", "20190101"}, "[]"},
+		{[]string{"1", "2018年10月号"}, "[]"},
+		{[]string{"1", "2", "500"}, "[]"},
+		{[]string{"1", "3", "1-99999"}, "[2]"},
+	}
+
+	for _, c := range cases {
+		books := []*Book{}
+		for i, number := range c.numbers {
+			books = append(books, &Book{ID: strconv.Itoa(i), Title: "T", Series: "T", Number: number, Fullpath: "/" + strconv.Itoa(i)})
+		}
+		list := buildSeries(books)
+		if len(list) != 1 {
+			t.Fatalf("%v: %d series, want 1", c.numbers, len(list))
+		}
+		if got := fmt.Sprint(list[0].Missing); got != c.missing {
+			t.Errorf("%v: missing %s, want %s", c.numbers, got, c.missing)
+		}
+	}
+}
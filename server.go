@@ -12,14 +12,17 @@ import (
 
 // Server holds link to database and configuration
 type Server struct {
-	Database *FlatDB
+	Database Library
 	Config   *Config
+	Scanner  *Scanner
+	ReadLog  *ReadLog
 }
 
 // Start launches http server
 func (svr *Server) Start() {
 	cfg := svr.Config
 	db := svr.Database
+	readLog := svr.ReadLog
 
 	// setup sessions
 	httpSession := &SessionStore{
@@ -58,10 +61,33 @@ func (svr *Server) Start() {
 
 	// private api, page
 	h.HandleFunc("/api/thumbnail/", renderThumbnail(db, cfg)) // /thumbnail/{bookID}              get book cover thumbnail
-	h.HandleFunc("/api/read/", readPage(db, true))            // /read?book={bookID}&page={page}  get image and update last read
+	h.HandleFunc("/api/read/", readPage(db, readLog, true))   // /read?book={bookID}&page={page}  get image and update last read
+	h.HandleFunc("/api/ranking/", rankBook(db))               // /api/ranking/{bookID}/{rank}     set book ranking and go back
+	h.HandleFunc("/api/edit", editPost(db))                   // /api/edit                        save book metadata
+	h.HandleFunc("/api/edit/write", editWritePost(db))        // /api/edit/write                  write book metadata into book file
 	h.HandleFunc("/browse.html", browseGet(cfg, db, tmplBrowse))
 	h.HandleFunc("/legacy.html", browseGet(cfg, db, tmplBrowseLegacy))
-	h.HandleFunc("/read.html", readGet(cfg, db, tmplRead))
+	h.HandleFunc("/read.html", readGet(cfg, db, readLog, tmplRead))
+	h.HandleFunc("/edit.html", editGet(cfg, db, tmplEdit))
+	h.HandleFunc("/authors.html", authorsGet(cfg, db, tmplAuthors))
+	h.HandleFunc("/stats.html", statsGet(cfg, db, readLog, tmplStats))
+	h.HandleFunc("/duplicates.html", duplicatesGet(cfg, db, tmplDuplicates))
+
+	// maintenance
+	h.HandleFunc("/api/admin/scan", adminScanPost(cfg, svr.Scanner))            // /api/admin/scan                  scan allowed dirs for new books
+	h.HandleFunc("/api/admin/scan/cancel", adminScanCancelPost(svr.Scanner))    // /api/admin/scan/cancel           stop running scan
+	h.HandleFunc("/api/admin/scan/progress", adminScanProgressGet(svr.Scanner)) // /api/admin/scan/progress         scan progress in json
+	h.HandleFunc("/api/admin/reparse", adminReparsePost(db))                    // /api/admin/reparse               guess book title, author, number from file name again
+	h.HandleFunc("/admin.html", adminGet(cfg, db, svr.Scanner, tmplAdmin))
+
+	// reading progress backup
+	h.HandleFunc("/api/admin/progress/export", adminProgressExportGet(db))    // /api/admin/progress/export       download reading progress backup
+	h.HandleFunc("/api/admin/progress/restore", adminProgressRestorePost(db)) // /api/admin/progress/restore      merge uploaded reading progress backup
+
+	// maintenance of flat file db
+	if fdb, ok := db.(*FlatDB); ok {
+		h.HandleFunc("/api/admin/compact", adminCompactPost(cfg, fdb)) // /api/admin/compact               purge missing books
+	}
 
 	// middleware
 	slog := svrLogging(h, httpSession, cfg)
@@ -17,21 +17,21 @@ func sortNatural(arr []string, filter *regexp.Regexp) []string {
 		newArr = nil
 	}()
 
-	stringQuicksort(newArr, filter, 0, len(arr)-1)
+	stringQuicksort(newArr, filter, naturalKeys{}, 0, len(arr)-1)
 
 	return newArr
 }
 
-func stringQuicksort(arr []string, filter *regexp.Regexp, low, high int) {
+func stringQuicksort(arr []string, filter *regexp.Regexp, keys naturalKeys, low, high int) {
 	if low < high {
-		var pi int = stringPartition(arr, filter, low, high)
+		var pi int = stringPartition(arr, filter, keys, low, high)
 
-		stringQuicksort(arr, filter, low, pi-1)
-		stringQuicksort(arr, filter, pi+1, high)
+		stringQuicksort(arr, filter, keys, low, pi-1)
+		stringQuicksort(arr, filter, keys, pi+1, high)
 	}
 }
 
-func stringPartition(arr []string, filter *regexp.Regexp, low, high int) int {
+func stringPartition(arr []string, filter *regexp.Regexp, keys naturalKeys, low, high int) int {
 	var pivot *string = &arr[high]
 
 	var i int = (low - 1)
@@ -47,7 +47,7 @@ func stringPartition(arr []string, filter *regexp.Regexp, low, high int) int {
 		}
 
 		// natural compare
-		if AlphaNumCaseCompare(a, b) {
+		if keys.less(a, b) {
 			i++
 			arr[i], arr[j] = arr[j], arr[i]
 		}
@@ -65,7 +65,8 @@ func stringPartition(arr []string, filter *regexp.Regexp, low, high int) int {
 func filterBooksBy(inBooks []*Book, filter, byType string) []*Book {
 	books := []*Book{}
 
-	search := strings.ToLower(filter)
+	// width, case, kana and kanji numerals are ignored
+	search := normaliseText(filter)
 	keywords := strings.Split(search, " ")
 	keywords = StringSliceFlatten(keywords)
 
@@ -79,15 +80,15 @@ OUTER:
 	for _, book := range inBooks {
 		foundKeywords := 0
 
-		for _, keyword := range keywords {
-			target := strings.ToLower(book.Title)
-			switch byType {
-			case "author":
-				target = strings.ToLower(book.Author)
-			case "author-title":
-				target = strings.ToLower(book.Author + book.Title)
-			}
+		target := normaliseText(book.Title)
+		switch byType {
+		case "author":
+			target = normaliseText(book.Author)
+		case "author-title":
+			target = normaliseText(book.Author + book.Title + book.Series)
+		}
 
+		for _, keyword := range keywords {
 			// no match, next book
 			if !strings.Contains(target, keyword) {
 				continue OUTER
@@ -118,34 +119,34 @@ func filterBooksByAuthorTitle(books []*Book, filter string) []*Book {
 }
 
 func sortBooksByTitle(books []*Book) []*Book {
-	booksQuicksort(books, "title", 0, len(books)-1)
+	booksQuicksort(books, "title", naturalKeys{}, 0, len(books)-1)
 
 	return books
 }
 
 func sortBooksByAuthor(books []*Book) []*Book {
-	booksQuicksort(books, "author", 0, len(books)-1)
+	booksQuicksort(books, "author", naturalKeys{}, 0, len(books)-1)
 
 	return books
 }
 
 func sortBooksByAuthorTitle(books []*Book) []*Book {
 	// sort by author then boook title
-	booksQuicksort(books, "author-title", 0, len(books)-1)
+	booksQuicksort(books, "author-title", naturalKeys{}, 0, len(books)-1)
 
 	return books
 }
 
-func booksQuicksort(arr []*Book, byType string, low, high int) {
+func booksQuicksort(arr []*Book, byType string, keys naturalKeys, low, high int) {
 	if low < high {
-		var pi int = booksPartition(arr, byType, low, high)
+		var pi int = booksPartition(arr, byType, keys, low, high)
 
-		booksQuicksort(arr, byType, low, pi-1)
-		booksQuicksort(arr, byType, pi+1, high)
+		booksQuicksort(arr, byType, keys, low, pi-1)
+		booksQuicksort(arr, byType, keys, pi+1, high)
 	}
 }
 
-func booksPartition(arr []*Book, byType string, low, high int) int {
+func booksPartition(arr []*Book, byType string, keys naturalKeys, low, high int) int {
 	var pivot *Book = arr[high]
 
 	var i int = (low - 1)
@@ -158,7 +159,7 @@ func booksPartition(arr []*Book, byType string, low, high int) int {
 			b := fmt.Sprintf("%s %s", pivot.Title, pivot.Number)
 
 			// natural compare
-			if AlphaNumCaseCompare(a, b) {
+			if keys.less(a, b) {
 				i++
 				arr[i], arr[j] = arr[j], arr[i]
 			}
@@ -168,7 +169,7 @@ func booksPartition(arr []*Book, byType string, low, high int) int {
 			b := pivot.Author
 
 			// natural compare
-			if AlphaNumCaseCompare(a, b) {
+			if keys.less(a, b) {
 				i++
 				arr[i], arr[j] = arr[j], arr[i]
 			}
@@ -178,7 +179,7 @@ func booksPartition(arr []*Book, byType string, low, high int) int {
 			b := pivot.Author + pivot.Title
 
 			// natural compare
-			if AlphaNumCaseCompare(a, b) {
+			if keys.less(a, b) {
 				i++
 				arr[i], arr[j] = arr[j], arr[i]
 			}
@@ -194,16 +195,16 @@ func booksPartition(arr []*Book, byType string, low, high int) int {
 // FileInfoBasic, support functions
 //
 
-func fibsQuicksort(arr []*FileInfoBasic, byType string, low, high int) {
+func fibsQuicksort(arr []*FileInfoBasic, byType string, keys naturalKeys, low, high int) {
 	if low < high {
-		var pi int = fibsPartition(arr, byType, low, high)
+		var pi int = fibsPartition(arr, byType, keys, low, high)
 
-		fibsQuicksort(arr, byType, low, pi-1)
-		fibsQuicksort(arr, byType, pi+1, high)
+		fibsQuicksort(arr, byType, keys, low, pi-1)
+		fibsQuicksort(arr, byType, keys, pi+1, high)
 	}
 }
 
-func fibsPartition(arr []*FileInfoBasic, byType string, low, high int) int {
+func fibsPartition(arr []*FileInfoBasic, byType string, keys naturalKeys, low, high int) int {
 	var pivot *FileInfoBasic = arr[high]
 
 	var i int = (low - 1)
@@ -216,7 +217,7 @@ func fibsPartition(arr []*FileInfoBasic, byType string, low, high int) int {
 			b := fmt.Sprintf("%s", pivot.Name)
 
 			// natural compare
-			if AlphaNumCaseCompare(a, b) {
+			if keys.less(a, b) {
 				i++
 				arr[i], arr[j] = arr[j], arr[i]
 			}
@@ -236,6 +237,15 @@ func fibsPartition(arr []*FileInfoBasic, byType string, low, high int) int {
 			b := pivot.Rtime
 
 			// natural compare
+			if a > b {
+				i++
+				arr[i], arr[j] = arr[j], arr[i]
+			}
+		case sortOrderByRanking:
+			// sort by ranking, most liked first
+			a := arr[j].Ranking
+			b := pivot.Ranking
+
 			if a > b {
 				i++
 				arr[i], arr[j] = arr[j], arr[i]
@@ -270,7 +280,7 @@ func sortByFileName(arr []*FileInfoBasic) []*FileInfoBasic {
 		newArr = nil
 	}()
 
-	fibsQuicksort(newArr, sortOrderByFileName, 0, len(arr)-1)
+	fibsQuicksort(newArr, sortOrderByFileName, naturalKeys{}, 0, len(arr)-1)
 
 	return newArr
 }
@@ -283,7 +293,7 @@ func sortByReadTime(arr []*FileInfoBasic) []*FileInfoBasic {
 		newArr = nil
 	}()
 
-	fibsQuicksort(newArr, sortOrderByReadTime, 0, len(arr)-1)
+	fibsQuicksort(newArr, sortOrderByReadTime, naturalKeys{}, 0, len(arr)-1)
 
 	return newArr
 }
@@ -296,7 +306,7 @@ func sortByFileModTime(arr []*FileInfoBasic) []*FileInfoBasic {
 		newArr = nil
 	}()
 
-	fibsQuicksort(newArr, sortOrderByFileModTime, 0, len(arr)-1)
+	fibsQuicksort(newArr, sortOrderByFileModTime, naturalKeys{}, 0, len(arr)-1)
 
 	return newArr
 }
@@ -309,7 +319,20 @@ func sortByAuthorTitle(arr []*FileInfoBasic) []*FileInfoBasic {
 		newArr = nil
 	}()
 
-	fibsQuicksort(newArr, sortOrderByAuthor, 0, len(arr)-1)
+	fibsQuicksort(newArr, sortOrderByAuthor, naturalKeys{}, 0, len(arr)-1)
+
+	return newArr
+}
+
+// sort by ranking, most liked first
+func sortByRanking(arr []*FileInfoBasic) []*FileInfoBasic {
+	newArr := append([]*FileInfoBasic{}, arr...)
+	// free memory
+	defer func() {
+		newArr = nil
+	}()
+
+	fibsQuicksort(newArr, sortOrderByRanking, naturalKeys{}, 0, len(arr)-1)
 
 	return newArr
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSortByRanking(t *testing.T) {
+	rankings := []int64{3, 0, 5, 1, 5, 4, 0, 2}
+	arr := []*FileInfoBasic{}
+	for i, ranking := range rankings {
+		arr = append(arr, &FileInfoBasic{Book: Book{ID: string(rune('a' + i)), Ranking: ranking}})
+	}
+
+	sorted := sortByRanking(arr)
+	if len(sorted) != len(arr) {
+		t.Fatalf("%d items, want %d", len(sorted), len(arr))
+	}
+	// most liked first
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].Ranking < sorted[i].Ranking {
+			t.Errorf("ranking %d before %d at %d", sorted[i-1].Ranking, sorted[i].Ranking, i)
+		}
+	}
+	// given slice is left as is
+	for i, fib := range arr {
+		if fib.Ranking != rankings[i] {
+			t.Errorf("item %d changed to ranking %d", i, fib.Ranking)
+		}
+	}
+
+	if sorted := sortByRanking([]*FileInfoBasic{}); len(sorted) != 0 {
+		t.Errorf("empty gives %d items", len(sorted))
+	}
+}